@@ -2,14 +2,16 @@ module sheet
 
 go 1.25.0
 
-require github.com/gdamore/tcell/v2 v2.9.0
+require (
+	github.com/gdamore/tcell/v2 v2.9.0
+	github.com/rivo/uniseg v0.4.3
+)
 
 require (
 	github.com/gdamore/encoding v1.0.1 // indirect
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
 	github.com/mattn/go-runewidth v0.0.16 // indirect
 	github.com/nsf/termbox-go v1.1.1 // indirect
-	github.com/rivo/uniseg v0.4.3 // indirect
 	golang.org/x/sys v0.35.0 // indirect
 	golang.org/x/term v0.34.0 // indirect
 	golang.org/x/text v0.28.0 // indirect
@@ -1,12 +1,14 @@
 package app
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"sheet/internal/calc"
 	"sheet/internal/grid"
@@ -22,12 +24,25 @@ type App struct {
 	DefaultWidth  int
 	DefaultHeight int
 
-	CellPadding int
+	CellPadding  int
+	Gridlines    bool // lines between columns and rows (:set gridlines)
+	FormulaBar   bool // raw content of the current cell above the grid (:set formulabar)
+	ShowFormulas bool // cells show their formulas instead of values (:set showformulas)
+	barExpanded  bool // the formula bar wraps long content over several rows
+	barWidth     int  // screen width the formula bar was last drawn for
 
 	// grid data
 	ColWidths  []int
 	RowHeights []int
+	HiddenRows map[int]bool // rows hidden with :hide or a collapsed group
+	HiddenCols map[int]bool
+	RowLevels  map[int]int // outline level of grouped rows (:group), 0 if none
+	ColLevels  map[int]int
 	Grid       map[[2]int]grid.Cell
+	Names      map[string]string // named ranges/constants: NAME -> "B2:B200"
+	Merges     map[[2]int][2]int // merged blocks (:merge): top-left -> bottom-right cell
+	Rules      []storage.Rule    // conditional formatting (:cf), applied in order
+	Checks     []storage.Check   // input validation (:validate)
 
 	// cursor / view
 	CurRow  int
@@ -35,11 +50,18 @@ type App struct {
 	ViewRow int
 	ViewCol int
 
+	// panes: rows above FrozenRows and columns left of FrozenCols stay on
+	// screen while the rest scrolls (:freeze)
+	FrozenRows int
+	FrozenCols int
+
 	// UI state
-	Mode       string // normal | insert | command | confirm
-	InputBuf   string
+	Mode       string     // normal | insert | command | confirm
+	Input      LineEditor // cell text being edited in insert mode
 	CommandBuf string
 	ConfirmMsg string
+	StatusMsg  string    // one-shot message for the status line, cleared on next key
+	Point      *pointRef // reference picked with arrows while editing a formula
 	Quit       bool
 
 	// editing behavior options
@@ -48,9 +70,45 @@ type App struct {
 	MoveAfterEnter      bool
 	SelectAllOnEdit     bool
 	ReplaceOnNextRune   bool
+	AutoGrow            bool // widen the column and heighten the row to fit entered text
+
+	// search options, overridable per search with flags (see compileSearch)
+	IgnoreCase   bool
+	SearchRegex  bool
+	SearchValues bool
+
+	// colours: the theme name (:theme) and its styles resolved for the
+	// terminal (see useColors)
+	Theme       string
+	themeSpec   map[string]string
+	styles      map[string]tcell.Style
+	styleColors int
 
 	// UI: help popup visibility
 	HelpVisible bool
+	// UI: text shown in an info popup (e.g. :name list), closed with Esc
+	InfoText string
+
+	// normal-mode key dispatch (see keymap.go)
+	Marks      map[rune][2]int   // ma / 'a
+	keymap     map[string]string // key sequence -> action name
+	keySeq     string            // keys typed so far of a multi-key binding
+	pendingArg string            // action waiting for its argument key
+	count      int               // count prefix, 0 if none
+	lastChange *change           // repeated by '.'
+	Anchor     *[2]int           // other corner of the selection (v, Shift+arrows), nil if none
+
+	drag      *mouseDrag // left button held since a press, nil if none
+	lastClick time.Time  // for double-clicks
+
+	search   *searchState // last / or ? search
+	searchHL bool         // highlight matches of search
+	filter   *filterState // :filter, nil when off
+	undo     []snapshot
+	redo     []snapshot
+
+	// formula values cached while the grid is unchanged (see withEvalCache)
+	cache *evalCache
 }
 
 func NewApp() *App {
@@ -60,15 +118,21 @@ func NewApp() *App {
 		DefaultWidth:        16,
 		DefaultHeight:       1,
 		CellPadding:         1,
+		FormulaBar:          true,
 		ColWidths:           []int{},
 		RowHeights:          []int{},
+		HiddenRows:          map[int]bool{},
+		HiddenCols:          map[int]bool{},
+		RowLevels:           map[int]int{},
+		ColLevels:           map[int]int{},
 		Grid:                map[[2]int]grid.Cell{},
+		Names:               map[string]string{},
+		Merges:              map[[2]int][2]int{},
 		CurRow:              0,
 		CurCol:              0,
 		ViewRow:             0,
 		ViewCol:             0,
 		Mode:                "normal",
-		InputBuf:            "",
 		CommandBuf:          "",
 		ConfirmMsg:          "",
 		Quit:                false,
@@ -78,6 +142,10 @@ func NewApp() *App {
 		SelectAllOnEdit:     true,
 		ReplaceOnNextRune:   false,
 		HelpVisible:         false,
+		Marks:               map[rune][2]int{},
+		keymap:              defaultKeymap(),
+		Theme:               "dark",
+		themeSpec:           themes["dark"],
 	}
 	// initial sizes (like original)
 	for i := 0; i < 8; i++ {
@@ -91,52 +159,45 @@ func NewApp() *App {
 
 func (a *App) HandleKeyEvent(s tcell.Screen, ev *tcell.EventKey) {
 	if a.Mode == "insert" {
+		if buf, pos, ok := a.pointKey(s, ev, a.Input.Runes(), a.Input.Pos()); ok {
+			a.Input.Set(buf, pos)
+			a.ReplaceOnNextRune = false
+			return
+		}
+		a.Point = nil
+		a.StatusMsg = ""
 		mod := ev.Modifiers()
 		switch ev.Key() {
 		case tcell.KeyEsc:
 			// cancel edit
 			a.Mode = "normal"
-			a.InputBuf = ""
+			a.Input.SetText("")
 			a.ReplaceOnNextRune = false
 		case tcell.KeyEnter:
 			// Shift+Enter or Alt+Enter -> insert newline into cell (if supported)
 			if mod&tcell.ModShift != 0 || mod&tcell.ModAlt != 0 {
-				a.InputBuf += "\n"
+				a.Input.Insert("\n")
 			} else {
-				// commit
-				if a.InputBuf != "" {
-					a.EnsureColExists(a.CurCol)
-					a.EnsureRowExists(a.CurRow)
-					a.Grid[[2]int{a.CurRow, a.CurCol}] = grid.Cell{Text: a.InputBuf}
-				} else {
-					delete(a.Grid, [2]int{a.CurRow, a.CurCol})
+				// commit, or stay in the editor if validation rejects the text
+				if !a.commitEdit(a.Input.String()) {
+					return
 				}
 				a.Mode = "normal"
-				a.InputBuf = ""
+				a.Input.SetText("")
 				a.ReplaceOnNextRune = false
 				// move after enter unless Ctrl held
 				if mod&tcell.ModCtrl == 0 && a.MoveAfterEnter {
-					a.CurRow++
-					a.EnsureRowExists(a.CurRow)
+					r, _ := a.blockEnd(a.CurRow, a.CurCol)
+					a.moveTo(s, r+1, a.CurCol)
 				}
 			}
-		case tcell.KeyBackspace, tcell.KeyBackspace2:
-			if len(a.InputBuf) > 0 {
-				a.InputBuf = a.InputBuf[:len(a.InputBuf)-1]
-			}
-			a.ReplaceOnNextRune = false
 		default:
-			// regular rune input
-			r := ev.Rune()
-			if r != 0 {
-				if a.ReplaceOnNextRune {
-					// replace entire buffer with this rune
-					a.InputBuf = string(r)
-					a.ReplaceOnNextRune = false
-				} else {
-					a.InputBuf += string(r)
-				}
+			if a.ReplaceOnNextRune && ev.Key() == tcell.KeyRune {
+				// replace entire buffer with this rune
+				a.Input.SetText("")
 			}
+			a.Input.HandleKey(ev)
+			a.ReplaceOnNextRune = false
 		}
 		return
 	}
@@ -164,9 +225,17 @@ func (a *App) HandleKeyEvent(s tcell.Screen, ev *tcell.EventKey) {
 	//     return
 	// }
 
-	// If help popup is visible, consume most keys and only allow closing with Esc or "?"
+	// Info popup: any of Esc, Enter or q closes it
+	if a.InfoText != "" {
+		if ev.Key() == tcell.KeyEsc || ev.Key() == tcell.KeyEnter || ev.Rune() == 'q' {
+			a.InfoText = ""
+		}
+		return
+	}
+
+	// If help popup is visible, consume most keys and only allow closing with Esc, F1 or "?"
 	if a.HelpVisible {
-		if ev.Key() == tcell.KeyEsc {
+		if ev.Key() == tcell.KeyEsc || ev.Key() == tcell.KeyF1 {
 			a.HelpVisible = false
 			return
 		}
@@ -179,233 +248,80 @@ func (a *App) HandleKeyEvent(s tcell.Screen, ev *tcell.EventKey) {
 	}
 
 	// normal mode
-	mod := ev.Modifiers()
-	switch ev.Key() {
-	case tcell.KeyEsc:
-		// noop
-	case tcell.KeyCtrlC:
-		a.Quit = true
-	case tcell.KeyUp:
-		if mod&tcell.ModCtrl != 0 {
-			// ctrl+up -> decrease row height
-			if a.CurRow >= 0 && a.CurRow < len(a.RowHeights) {
-				if a.RowHeights[a.CurRow] > 1 {
-					a.RowHeights[a.CurRow]--
-				}
-			}
-		} else {
-			if a.CurRow > 0 {
-				a.CurRow--
-			}
-		}
-	case tcell.KeyDown:
-		if mod&tcell.ModCtrl != 0 {
-			if a.CurRow >= 0 && a.CurRow < len(a.RowHeights) {
-				a.RowHeights[a.CurRow]++
-			}
-		} else {
-			a.CurRow++
-			a.EnsureRowExists(a.CurRow)
-		}
-	case tcell.KeyLeft:
-		if mod&tcell.ModCtrl != 0 {
-			if a.CurCol >= 0 && a.CurCol < len(a.ColWidths) {
-				if a.ColWidths[a.CurCol] > 4 {
-					a.ColWidths[a.CurCol]--
-				}
-			}
-		} else {
-			if a.CurCol > 0 {
-				a.CurCol--
-			}
-		}
-	case tcell.KeyRight:
-		if mod&tcell.ModCtrl != 0 {
-			if a.CurCol >= 0 && a.CurCol < len(a.ColWidths) {
-				a.ColWidths[a.CurCol]++
-			}
-		} else {
-			a.CurCol++
-			a.EnsureColExists(a.CurCol)
-		}
-	case tcell.KeyPgUp:
-		vr, _ := a.ComputeVisible(s)
-		a.ViewRow -= vr
-		if a.ViewRow < 0 {
-			a.ViewRow = 0
-		}
-	case tcell.KeyPgDn:
-		vr, _ := a.ComputeVisible(s)
-		a.ViewRow += vr
-		if a.ViewRow >= len(a.RowHeights) {
-			a.ViewRow = maxInt(0, len(a.RowHeights)-1)
-		}
-	case tcell.KeyHome:
-		a.ViewCol = 0
-		a.ViewRow = 0
-	case tcell.KeyEnd:
-		a.ViewCol = maxInt(0, len(a.ColWidths)-1)
-		a.ViewRow = maxInt(0, len(a.RowHeights)-1)
-	case tcell.KeyF2:
-		// add row after current
-		idx := a.CurRow + 1
-		if idx < 0 {
-			idx = 0
-		}
-		if idx > len(a.RowHeights) {
-			idx = len(a.RowHeights)
-		}
-		a.RowHeights = append(a.RowHeights[:idx], append([]int{a.DefaultHeight}, a.RowHeights[idx:]...)...)
-	case tcell.KeyF3:
-		// add column after current
-		idx := a.CurCol + 1
-		if idx < 0 {
-			idx = 0
-		}
-		if idx > len(a.ColWidths) {
-			idx = len(a.ColWidths)
-		}
-		a.ColWidths = append(a.ColWidths[:idx], append([]int{a.DefaultWidth}, a.ColWidths[idx:]...)...)
-		// shift existing cells to the right for columns >= idx
-		newGrid := map[[2]int]grid.Cell{}
-		for k, v := range a.Grid {
-			r, c := k[0], k[1]
-			if c >= idx {
-				newGrid[[2]int{r, c + 1}] = v
-			} else {
-				newGrid[[2]int{r, c}] = v
-			}
-		}
-		a.Grid = newGrid
-	case tcell.KeyF4:
-		// delete current row
-		if len(a.RowHeights) > 0 && a.CurRow >= 0 && a.CurRow < len(a.RowHeights) {
-			a.RowHeights = append(a.RowHeights[:a.CurRow], a.RowHeights[a.CurRow+1:]...)
-			newGrid := map[[2]int]grid.Cell{}
-			for k, v := range a.Grid {
-				r, c := k[0], k[1]
-				if r == a.CurRow {
-					continue
-				}
-				if r > a.CurRow {
-					newGrid[[2]int{r - 1, c}] = v
-				} else {
-					newGrid[[2]int{r, c}] = v
-				}
-			}
-			a.Grid = newGrid
-			if a.CurRow >= len(a.RowHeights) {
-				a.CurRow = maxInt(0, len(a.RowHeights)-1)
-			}
-		}
-	case tcell.KeyF5:
-		// delete current column
-		if len(a.ColWidths) > 0 && a.CurCol >= 0 && a.CurCol < len(a.ColWidths) {
-			colIdx := a.CurCol
-			a.ColWidths = append(a.ColWidths[:colIdx], a.ColWidths[colIdx+1:]...)
-			newGrid := map[[2]int]grid.Cell{}
-			for k, v := range a.Grid {
-				r, c := k[0], k[1]
-				if c == colIdx {
-					continue
-				}
-				if c > colIdx {
-					newGrid[[2]int{r, c - 1}] = v
-				} else {
-					newGrid[[2]int{r, c}] = v
-				}
-			}
-			a.Grid = newGrid
-			if a.CurCol >= len(a.ColWidths) {
-				a.CurCol = maxInt(0, len(a.ColWidths)-1)
-			}
-		}
-	default:
-		// printable keys and special handling for Enter -> start edit
-		r := ev.Rune()
+	a.StatusMsg = ""
+	a.dispatchKey(s, ev)
+}
 
-		// handle Enter starting edit (if configured)
-		if ev.Key() == tcell.KeyEnter && a.EnterStartsEdit {
-			// start edit mode
-			a.Mode = "insert"
-			if cell, ok := a.Grid[[2]int{a.CurRow, a.CurCol}]; ok {
-				a.InputBuf = cell.Text
-			} else {
-				a.InputBuf = ""
-			}
-			if a.SelectAllOnEdit {
-				a.ReplaceOnNextRune = true
-			} else {
-				a.ReplaceOnNextRune = false
-			}
+// startEdit switches to insert mode on the current cell.
+func (a *App) startEdit() {
+	a.Mode = "insert"
+	a.Input.SetText(a.Grid[[2]int{a.CurRow, a.CurCol}].Text)
+	a.ReplaceOnNextRune = a.SelectAllOnEdit
+}
+
+// commitEdit stores text in the current cell and remembers it for '.'. It
+// reports false, with the reason in the status line, when validation
+// rejects the text; a value only flagged by a warn rule is stored.
+func (a *App) commitEdit(text string) bool {
+	a.pushUndo()
+	if err := a.SetCellValue(text); err != nil {
+		a.dropUndo()
+		a.StatusMsg = err.Error()
+		return false
+	}
+	if reason := a.invalid(a.CurRow, a.CurCol); reason != "" {
+		a.StatusMsg = "warning: " + reason
+	}
+	if a.AutoGrow {
+		a.growToFit()
+	}
+	a.lastChange = &change{act: action{run: func(a *App, s tcell.Screen, _ int, _ rune) {
+		if err := a.SetCellValue(text); err != nil {
+			a.dropUndo()
+			a.StatusMsg = err.Error()
 			return
 		}
-
-		if r != 0 {
-			switch r {
-			case 'q':
-				a.Quit = true
-			case 'i':
-				// vim-like insert
-				a.Mode = "insert"
-				if cell, ok := a.Grid[[2]int{a.CurRow, a.CurCol}]; ok {
-					a.InputBuf = cell.Text
-				} else {
-					a.InputBuf = ""
-				}
-				if a.SelectAllOnEdit {
-					a.ReplaceOnNextRune = true
-				} else {
-					a.ReplaceOnNextRune = false
-				}
-
-			// =========================================================================
-			// НОВЫЙ КОД для обработки ':' и '=' с помощью PopupInput
-			case ':':
-				// Вместо установки a.Mode = "command", вызываем PopupInput
-				command, ok := a.PopupInput(s, ":", "")
-				if ok {
-					a.ExecuteCommand(command)
-				}
-				// PopupInput уже вернул режим normal и перерисовал основной UI,
-				// поэтому a.Mode = "normal" и a.CommandBuf = "" не нужны.
-				// Возвращаемся из обработчика события.
-				return
-			case '=':
-				// Вызываем PopupInput для ввода значения
-				value, ok := a.PopupInput(s, "", "=")
-				if ok {
-					// Здесь ваша логика обработки введенного значения
-					// Например, обновить ячейку, или вызвать другой метод App
-					a.SetCellValue(value) // Предполагаем, что у вас есть такой метод
-				}
-				return
-			// =========================================================================
-
-			case '?':
-				// show help popup centered with border
-				a.HelpVisible = true
-			default:
-				// other printable character
-				if a.PrintableStartsEdit {
-					a.Mode = "insert"
-					// start editing with this rune (replace)
-					a.InputBuf = string(r)
-					a.ReplaceOnNextRune = false
-				}
-			}
+		if a.AutoGrow {
+			a.growToFit()
 		}
-	}
+	}}}
+	return true
 }
 
 // Добавьте этот вспомогательный метод в вашу структуру App,
 // если его еще нет, или используйте существующую логику.
 // Этот метод будет вызываться при вводе "="
-func (a *App) SetCellValue(value string) {
+func (a *App) SetCellValue(value string) error {
 	// Пример: установить значение в текущую ячейку
+	// (формат ячейки, например рамки, сохраняется)
+	key := [2]int{a.CurRow, a.CurCol}
+	old, had := a.Grid[key]
+	cell := old
+	cell.Text = value
+	if bareCell(cell) {
+		delete(a.Grid, key)
+		return nil
+	}
 	a.EnsureColExists(a.CurCol)
 	a.EnsureRowExists(a.CurRow)
-	a.Grid[[2]int{a.CurRow, a.CurCol}] = grid.Cell{Text: value}
+	a.Grid[key] = cell
+	// значение, не прошедшее проверку (:validate), не сохраняется
+	ch, _, _, _ := a.checkFor(a.CurRow, a.CurCol)
+	if reason := a.invalid(a.CurRow, a.CurCol); reason != "" && !ch.Warn {
+		if had {
+			a.Grid[key] = old
+		} else {
+			delete(a.Grid, key)
+		}
+		return errors.New("invalid: " + reason)
+	}
+	return nil
+}
+
+// bareCell reports whether cell has nothing to keep: no text, format or
+// comment.
+func bareCell(cell grid.Cell) bool {
+	return cell.Text == "" && len(cell.Format) == 0 && cell.Comment == ""
 }
 
 // УДАЛИТЕ ЭТУ СТРОКУ, т.к.PopupInput взял на себя эту ответственность
@@ -419,12 +335,21 @@ func (a *App) SetCellValue(value string) {
 // ----------------------------- Drawing -----------------------------
 
 func (a *App) Draw(s tcell.Screen) {
+	a.useColors(s.Colors())
+	a.withEvalCache(func() { a.draw(s) })
+}
+
+func (a *App) draw(s tcell.Screen) {
 	s.Clear()
 	w, h := s.Size()
+	if a.FormulaBar {
+		a.drawFormulaBar(s, w)
+	}
 
 	// header row: column names
+	top := a.gridTop()
 	x := a.LeftGutter
-	for c := a.ViewCol; c < len(a.ColWidths); c++ {
+	for c := range a.displayCols() {
 		wc := a.ColWidths[c]
 		if x+wc > w {
 			// truncated column: we'll still attempt to draw header fragment and then break
@@ -432,15 +357,22 @@ func (a *App) Draw(s tcell.Screen) {
 		name := grid.ColToName(c)
 
 		// header style; invert if this is the active column
-		hdrStyle := tcell.StyleDefault.Foreground(tcell.ColorYellow)
+		hdrStyle := a.style("header")
 		if c == a.CurCol {
-			hdrStyle = tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorYellow)
+			hdrStyle = a.style("header-active")
 			for dx := 0; dx < wc; dx++ {
 				if x+dx >= 0 && x+dx < w {
-					s.SetContent(x+dx, 0, ' ', nil, hdrStyle)
+					s.SetContent(x+dx, top, ' ', nil, hdrStyle)
 				}
 			}
 		}
+		// grouped columns are underlined, + marks hidden columns on the left
+		if a.ColLevels[c] > 0 {
+			hdrStyle = hdrStyle.Underline(true)
+		}
+		if c > 0 && a.HiddenCols[c-1] {
+			s.SetContent(x, top, '+', nil, hdrStyle)
+		}
 
 		innerX := x + a.CellPadding
 		innerW := wc - 2*a.CellPadding
@@ -448,28 +380,37 @@ func (a *App) Draw(s tcell.Screen) {
 			innerW = 0
 		}
 		if innerW > 0 {
-			a.printTextFixedWidth(s, innerX, 0, name, hdrStyle, innerW)
+			a.printTextFixedWidth(s, innerX, top, name, hdrStyle, innerW)
 		} else {
-			a.printTextFixedWidth(s, x, 0, name, hdrStyle, wc)
+			a.printTextFixedWidth(s, x, top, name, hdrStyle, wc)
 		}
 
-		x += wc
+		if a.Gridlines && x+wc < w {
+			s.SetContent(x+wc, top, borderLines[""][1], nil, a.style("gridline"))
+		}
+
+		x += a.colSpan(c)
 		if x >= w {
 			break
 		}
 	}
 
-	// draw rows
-	y := 1
-	for r := a.ViewRow; r < len(a.RowHeights); r++ {
+	// draw rows; a merged block is drawn once, from its first shown cell
+	y := top + 1
+	blocks := map[[2]int]bool{}
+	conds := a.condFormats()
+	for r := range a.displayRows() {
 		if y >= h-a.StatusLines {
 			break
 		}
-		// row number in the gutter
+		// row number in the gutter; rows under an active filter are blue
 		rowNum := fmt.Sprintf("%d", r+1)
-		gutterStyle := tcell.StyleDefault.Foreground(tcell.ColorYellow)
+		gutterStyle := a.style("gutter")
+		if a.filtered(r) {
+			gutterStyle = a.style("gutter-filtered")
+		}
 		if r == a.CurRow {
-			gutterStyle = tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorYellow)
+			gutterStyle = a.style("header-active")
 			for gx := 0; gx < a.LeftGutter-1; gx++ {
 				if gx >= 0 && gx < w {
 					s.SetContent(gx, y, ' ', nil, gutterStyle)
@@ -477,27 +418,55 @@ func (a *App) Draw(s tcell.Screen) {
 			}
 		}
 		a.printTextFixedWidth(s, 0, y, rowNum, gutterStyle, a.LeftGutter-1)
+		s.SetContent(a.LeftGutter-1, y, a.outlineMark(r), nil, gutterStyle)
 
 		x = a.LeftGutter
-		hh := a.RowHeights[r]
-		for c := a.ViewCol; c < len(a.ColWidths); c++ {
+		for c := range a.displayCols() {
 			if y >= h-a.StatusLines {
 				break
 			}
-			wc := a.ColWidths[c]
-			dispText := a.GetDisplayText(r, c)
-			if a.Mode == "insert" && r == a.CurRow && c == a.CurCol {
-				dispText = a.InputBuf
+			wc, hh := a.ColWidths[c], a.RowHeights[r]
+			// br, bc is the cell whose text and state are shown: the
+			// top-left one of a merged block
+			br, bc, r2, c2, merged := a.mergeAt(r, c)
+			if merged {
+				if blocks[[2]int{br, bc}] {
+					x += a.colSpan(c)
+					if x >= w {
+						break
+					}
+					continue
+				}
+				blocks[[2]int{br, bc}] = true
+				wc, hh = a.spanSize(r, c, r2, c2)
+			}
+			var lines []string
+			if a.Mode == "insert" && br == a.CurRow && bc == a.CurCol {
+				// the edited text scrolls to keep the cursor inside the cell
+				lines, _, _ = a.Input.visibleLines(a.cellTextWidth(wc), hh)
+			} else {
+				lines = a.splitLines(a.shownText(br, bc), hh)
 			}
-			lines := a.splitLines(dispText, hh)
 
-			isSelected := (r == a.CurRow && c == a.CurCol)
+			isSelected := (br == a.CurRow && bc == a.CurCol)
 
 			var baseStyle tcell.Style
-			if isSelected {
-				baseStyle = tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorLightGray)
+			plain := false
+			if a.Point != nil && a.Point.contains(br, bc) {
+				baseStyle = a.style("point")
+			} else if isSelected {
+				baseStyle = a.style("cursor")
+			} else if a.selected(br, bc) {
+				baseStyle = a.style("selection")
+			} else if a.matches(br, bc) {
+				baseStyle = a.style("match")
 			} else {
-				baseStyle = tcell.StyleDefault
+				baseStyle = a.style("cell")
+				plain = true
+			}
+			baseStyle = a.condStyle(conds, br, bc, baseStyle, plain)
+			if plain && a.invalid(br, bc) != "" {
+				baseStyle = a.overlay(baseStyle, "invalid")
 			}
 
 			// clear cell rectangle
@@ -527,13 +496,24 @@ func (a *App) Draw(s tcell.Screen) {
 					a.printTextFixedWidth(s, x, y+dy, txt, baseStyle, wc)
 				}
 			}
+			a.drawCondBlocks(s, conds, br, bc, x, y, wc, hh)
+			if a.Grid[[2]int{br, bc}].Comment != "" && x+wc-1 < w {
+				s.SetContent(x+wc-1, y, noteMark, nil, a.overlay(baseStyle, "note"))
+			}
+			if mark, st, ok := a.filterButton(r, c, baseStyle); ok && x+wc-1 < w {
+				s.SetContent(x+wc-1, y, mark, nil, st)
+			}
+			if isSelected && a.listCell(br, bc) && x+wc-1 < w {
+				s.SetContent(x+wc-1, y, dropdownMark, nil, baseStyle)
+			}
+			a.drawEdges(s, r, c, x, y, wc, hh, baseStyle)
 
-			x += wc
+			x += a.colSpan(c)
 			if x >= w {
 				break
 			}
 		}
-		y += hh
+		y += a.rowSpan(r)
 	}
 
 	// Status area
@@ -541,7 +521,7 @@ func (a *App) Draw(s tcell.Screen) {
 	if statusY < 0 {
 		statusY = 0
 	}
-	statusStyle := tcell.StyleDefault.Background(tcell.ColorGray).Foreground(tcell.ColorWhite)
+	statusStyle := a.style("status")
 
 	curColW := a.DefaultWidth
 	curRowH := a.DefaultHeight
@@ -553,17 +533,37 @@ func (a *App) Draw(s tcell.Screen) {
 	}
 
 	statusLeft := fmt.Sprintf("Mode:%s  Cell:%d,%d  cw(cur)=%d rh(cur)=%d  View:%d,%d", a.Mode, a.CurRow+1, a.CurCol+1, curColW, curRowH, a.ViewRow+1, a.ViewCol+1)
+	if sel := a.selectionText(); sel != "" {
+		statusLeft += "  Sel:" + sel
+	}
+	if f := a.filter; f != nil {
+		statusLeft += fmt.Sprintf("  Filter:%d/%d", f.end-f.header-1-len(f.hidden), f.end-f.header-1)
+	}
+	if keys := a.pendingKeys(); keys != "" {
+		statusLeft += "  " + keys
+	}
 	wTotal, _ := s.Size()
 	a.printTextFixedWidth(s, 0, statusY, statusLeft, statusStyle, wTotal)
 
-	if a.Mode == "insert" {
-		prompt := "EDIT: " + a.InputBuf
+	if a.Mode == "insert" && a.StatusMsg != "" {
+		// the edit was rejected (see commitEdit)
+		a.printTextFixedWidth(s, 0, statusY+1, a.StatusMsg, a.style("error"), wTotal)
+	} else if a.Mode == "insert" {
+		prompt := "EDIT: " + a.Input.String()
 		a.printTextFixedWidth(s, 0, statusY+1, prompt, statusStyle, wTotal)
 	} else if a.Mode == "command" {
 		prompt := ":" + a.CommandBuf
 		a.printTextFixedWidth(s, 0, statusY+1, prompt, statusStyle, wTotal)
 	} else if a.Mode == "confirm" {
 		a.printTextFixedWidth(s, 0, statusY+1, a.ConfirmMsg, statusStyle, wTotal)
+	} else if a.StatusMsg != "" {
+		a.printTextFixedWidth(s, 0, statusY+1, a.StatusMsg, statusStyle, wTotal)
+	} else if msg := a.cellErrorText(); msg != "" {
+		a.printTextFixedWidth(s, 0, statusY+1, msg, a.style("error"), wTotal)
+	} else if reason := a.invalid(a.CurRow, a.CurCol); reason != "" {
+		a.printTextFixedWidth(s, 0, statusY+1, "invalid: "+reason, a.style("error"), wTotal)
+	} else if note := a.cursorNote(); note != "" {
+		a.printTextFixedWidth(s, 0, statusY+1, "note: "+oneLine(note), statusStyle, wTotal)
 	}
 
 	// If help popup requested, draw it on top
@@ -574,10 +574,13 @@ func (a *App) Draw(s tcell.Screen) {
 			"│ Esc              - Выйти из режима редактирования             │\n" +
 			"│ :                - Открыть командную строку                   │\n" +
 			"│ =                - Ввести формулу в текущую ячейку            │\n" +
-			"│ ?                - Показать/скрыть эту справку                │\n" +
+			"│ F1 / :help       - Показать/скрыть эту справку                │\n" +
 			"└───────────────────────────────────────────────────────────────┘\n" +
 			"┌─ Навигация ───────────────────────────────────────────────────┐\n" +
-			"│ Стрелки          - Перемещение по ячейкам                     │\n" +
+			"│ Стрелки / hjkl   - Перемещение по ячейкам (5j - на 5 вниз)    │\n" +
+			"│ gg / G, 0 / $    - Первая/последняя строка, ячейка строки     │\n" +
+			"│ w / b, Alt+←↑↓→  - Соседняя непустая ячейка, край данных      │\n" +
+			"│ ma / 'a, .       - Метка, переход к метке, повтор изменения   │\n" +
 			"│ Ctrl+↑/↓         - Изменить высоту строки                     │\n" +
 			"│ Ctrl+←/→         - Изменить ширину столбца                    │\n" +
 			"│ PgUp / PgDn      - Прокрутка страниц                          │\n" +
@@ -603,73 +606,36 @@ func (a *App) Draw(s tcell.Screen) {
 			"│ SUM, AVERAGE, MIN, MAX, COUNT, ROUND, IF, AND, OR, NOT, LEN   │\n" +
 			"└───────────────────────────────────────────────────────────────┘\n"
 		a.drawHelpPopup(s, help)
+	} else if a.InfoText != "" {
+		a.drawHelpPopup(s, a.InfoText)
 	}
 
 	// Show cursor while in insert mode
 	if a.Mode == "insert" {
 		w, h := s.Size()
 		// compute cell top-left
-		cellX := a.LeftGutter
-		if a.CurCol >= a.ViewCol {
-			for cc := a.ViewCol; cc < a.CurCol && cc < len(a.ColWidths); cc++ {
-				cellX += a.ColWidths[cc]
-			}
-		} else {
-			for cc := a.ViewCol - 1; cc >= a.CurCol && cc >= 0 && cc < len(a.ColWidths); cc-- {
-				cellX -= a.ColWidths[cc]
-			}
-		}
-		cellY := 1
-		if a.CurRow >= a.ViewRow {
-			for rr := a.ViewRow; rr < a.CurRow && rr < len(a.RowHeights); rr++ {
-				cellY += a.RowHeights[rr]
-			}
-		} else {
-			for rr := a.ViewRow - 1; rr >= a.CurRow && rr >= 0 && rr < len(a.RowHeights); rr-- {
-				cellY -= a.RowHeights[rr]
-			}
-		}
+		cellX, cellY, drawn := a.cellOrigin(a.CurRow, a.CurCol)
 
 		// basic bounds check
-		if cellX >= 0 && cellY >= 0 && cellX < w && cellY < h-a.StatusLines {
-			lines := strings.Split(a.InputBuf, "\n")
-			lastIdx := len(lines) - 1
-			if lastIdx < 0 {
-				lastIdx = 0
-			}
-			lastLine := ""
-			if len(lines) > 0 {
-				lastLine = lines[lastIdx]
-			}
+		if drawn && cellX < w && cellY < h-a.StatusLines {
 			colW := a.DefaultWidth
 			rowH := a.DefaultHeight
-			if a.CurCol >= 0 && a.CurCol < len(a.ColWidths) {
-				colW = a.ColWidths[a.CurCol]
+			if a.CurCol >= 0 && a.CurCol < len(a.ColWidths) && a.CurRow >= 0 && a.CurRow < len(a.RowHeights) {
+				colW, rowH = a.cellSize(a.CurRow, a.CurCol)
 			}
-			if a.CurRow >= 0 && a.CurRow < len(a.RowHeights) {
-				rowH = a.RowHeights[a.CurRow]
+			textW := a.cellTextWidth(colW)
+			if textW < colW {
+				cellX += a.CellPadding
 			}
-
-			innerW := colW - 2*a.CellPadding
-			if innerW < 1 {
-				cx := cellX + minInt(runeLen(lastLine), maxInt(0, colW-1))
-				cy := cellY + minInt(lastIdx, maxInt(0, rowH-1))
-				if cx >= 0 && cx < w && cy >= 0 && cy < h {
-					s.SetContent(cx, cy, '▏', nil,
-						tcell.StyleDefault.Foreground(tcell.ColorRed).Background(tcell.ColorLightGray))
-				} else {
-					s.HideCursor()
-				}
+			_, dx, dy := a.Input.visibleLines(textW, rowH)
+			cx, cy := cellX+dx, cellY+dy
+			if cx >= 0 && cx < w && cy >= 0 && cy < h-a.StatusLines {
+				// the character under the cursor is shown inverted
+				ch, comb, _, _ := s.GetContent(cx, cy)
+				s.SetContent(cx, cy, ch, comb, a.style("edit-cursor"))
+				s.ShowCursor(cx, cy)
 			} else {
-				xOffset := minInt(runeLen(lastLine), maxInt(0, innerW-1))
-				cx := cellX + a.CellPadding + xOffset
-				cy := cellY + minInt(lastIdx, maxInt(0, rowH-1))
-				if cx >= 0 && cx < w && cy >= 0 && cy < h {
-					s.SetContent(cx, cy, '▏', nil,
-						tcell.StyleDefault.Foreground(tcell.ColorRed).Background(tcell.ColorLightGray))
-				} else {
-					s.HideCursor()
-				}
+				s.HideCursor()
 			}
 		} else {
 			s.HideCursor()
@@ -695,19 +661,158 @@ func (a *App) EnsureRowExists(idx int) {
 	}
 }
 
-func (a *App) printTextFixedWidth(s tcell.Screen, x, y int, str string, style tcell.Style, width int) {
-	runes := []rune(str)
-	for i := 0; i < width; i++ {
-		var ch rune = ' '
-		if i < len(runes) {
-			ch = runes[i]
+// InsertRows inserts n empty rows before idx, shifting cells and names down.
+func (a *App) InsertRows(idx, n int) {
+	if n <= 0 {
+		return
+	}
+	if idx < 0 {
+		idx = 0
+	}
+	if idx > len(a.RowHeights) {
+		idx = len(a.RowHeights)
+	}
+	rows := make([]int, n)
+	for i := range rows {
+		rows[i] = a.DefaultHeight
+	}
+	a.RowHeights = append(a.RowHeights[:idx], append(rows, a.RowHeights[idx:]...)...)
+	newGrid := map[[2]int]grid.Cell{}
+	for k, v := range a.Grid {
+		r, c := k[0], k[1]
+		if r >= idx {
+			newGrid[[2]int{r + n, c}] = v
+		} else {
+			newGrid[[2]int{r, c}] = v
+		}
+	}
+	a.Grid = newGrid
+	a.shiftNames(func(def string) string { return calc.ShiftRows(def, idx, n) })
+	a.shiftRules(func(expr string) string { return calc.ShiftRows(expr, idx, n) })
+	a.shiftChecks(func(expr string) string { return calc.ShiftRows(expr, idx, n) })
+	a.shiftFilterRows(idx, n)
+	a.HiddenRows = shiftKeys(a.HiddenRows, idx, n)
+	a.RowLevels = shiftKeys(a.RowLevels, idx, n)
+	a.shiftMerges(true, idx, n)
+}
+
+// InsertCols inserts n empty columns before idx, shifting cells and names
+// right.
+func (a *App) InsertCols(idx, n int) {
+	if n <= 0 {
+		return
+	}
+	if idx < 0 {
+		idx = 0
+	}
+	if idx > len(a.ColWidths) {
+		idx = len(a.ColWidths)
+	}
+	cols := make([]int, n)
+	for i := range cols {
+		cols[i] = a.DefaultWidth
+	}
+	a.ColWidths = append(a.ColWidths[:idx], append(cols, a.ColWidths[idx:]...)...)
+	// shift existing cells to the right for columns >= idx
+	newGrid := map[[2]int]grid.Cell{}
+	for k, v := range a.Grid {
+		r, c := k[0], k[1]
+		if c >= idx {
+			newGrid[[2]int{r, c + n}] = v
+		} else {
+			newGrid[[2]int{r, c}] = v
+		}
+	}
+	a.Grid = newGrid
+	a.shiftNames(func(def string) string { return calc.ShiftCols(def, idx, n) })
+	a.shiftRules(func(expr string) string { return calc.ShiftCols(expr, idx, n) })
+	a.shiftChecks(func(expr string) string { return calc.ShiftCols(expr, idx, n) })
+	a.shiftFilterCols(idx, n)
+	a.HiddenCols = shiftKeys(a.HiddenCols, idx, n)
+	a.ColLevels = shiftKeys(a.ColLevels, idx, n)
+	a.shiftMerges(false, idx, n)
+}
+
+// DeleteRow removes row idx with its cells; names pointing below move up.
+func (a *App) DeleteRow(idx int) {
+	if len(a.RowHeights) == 0 || idx < 0 || idx >= len(a.RowHeights) {
+		return
+	}
+	a.RowHeights = append(a.RowHeights[:idx], a.RowHeights[idx+1:]...)
+	newGrid := map[[2]int]grid.Cell{}
+	for k, v := range a.Grid {
+		r, c := k[0], k[1]
+		if r == idx {
+			continue
+		}
+		if r > idx {
+			newGrid[[2]int{r - 1, c}] = v
+		} else {
+			newGrid[[2]int{r, c}] = v
+		}
+	}
+	a.Grid = newGrid
+	a.shiftNames(func(def string) string { return calc.ShiftRows(def, idx, -1) })
+	a.shiftRules(func(expr string) string { return calc.ShiftRows(expr, idx, -1) })
+	a.shiftChecks(func(expr string) string { return calc.ShiftRows(expr, idx, -1) })
+	a.shiftFilterRows(idx, -1)
+	a.HiddenRows = shiftKeys(a.HiddenRows, idx, -1)
+	a.RowLevels = shiftKeys(a.RowLevels, idx, -1)
+	a.shiftMerges(true, idx, -1)
+	if a.CurRow >= len(a.RowHeights) {
+		a.CurRow = maxInt(0, len(a.RowHeights)-1)
+	}
+}
+
+// DeleteCol removes column idx with its cells; names pointing right of it move left.
+func (a *App) DeleteCol(idx int) {
+	if len(a.ColWidths) == 0 || idx < 0 || idx >= len(a.ColWidths) {
+		return
+	}
+	a.ColWidths = append(a.ColWidths[:idx], a.ColWidths[idx+1:]...)
+	newGrid := map[[2]int]grid.Cell{}
+	for k, v := range a.Grid {
+		r, c := k[0], k[1]
+		if c == idx {
+			continue
 		}
-		if x+i >= 0 && y >= 0 {
-			s.SetContent(x+i, y, ch, nil, style)
+		if c > idx {
+			newGrid[[2]int{r, c - 1}] = v
+		} else {
+			newGrid[[2]int{r, c}] = v
+		}
+	}
+	a.Grid = newGrid
+	a.shiftNames(func(def string) string { return calc.ShiftCols(def, idx, -1) })
+	a.shiftRules(func(expr string) string { return calc.ShiftCols(expr, idx, -1) })
+	a.shiftChecks(func(expr string) string { return calc.ShiftCols(expr, idx, -1) })
+	a.shiftFilterCols(idx, -1)
+	a.HiddenCols = shiftKeys(a.HiddenCols, idx, -1)
+	a.ColLevels = shiftKeys(a.ColLevels, idx, -1)
+	a.shiftMerges(false, idx, -1)
+	if a.CurCol >= len(a.ColWidths) {
+		a.CurCol = maxInt(0, len(a.ColWidths)-1)
+	}
+}
+
+// printTextFixedWidth draws str in width cells from x, padded with spaces
+// or cut with an ellipsis.
+func (a *App) printTextFixedWidth(s tcell.Screen, x, y int, str string, style tcell.Style, width int) {
+	for i := putText(s, x, y, fitText(str, width), style, x+width); i < x+width; i++ {
+		if i >= 0 && y >= 0 {
+			s.SetContent(i, y, ' ', nil, style)
 		}
 	}
 }
 
+// cellTextWidth is the width available for text in a column of width wc.
+func (a *App) cellTextWidth(wc int) int {
+	if inner := wc - 2*a.CellPadding; inner > 0 {
+		return inner
+	}
+	return maxInt(1, wc)
+}
+
 func (a *App) splitLines(text string, maxLines int) []string {
 	if maxLines <= 0 {
 		return []string{}
@@ -742,9 +847,7 @@ func (a *App) drawHelpPopup(s tcell.Screen, help string) {
 	// Определяем максимальную ширину строки
 	maxWidth := 0
 	for _, line := range lines {
-		if len([]rune(line)) > maxWidth {
-			maxWidth = len([]rune(line))
-		}
+		maxWidth = maxInt(maxWidth, textWidth(line))
 	}
 
 	// Добавляем отступы
@@ -765,8 +868,8 @@ func (a *App) drawHelpPopup(s tcell.Screen, help string) {
 	left := (w - pw) / 2
 	top := (h - ph) / 2
 
-	borderStyle := tcell.StyleDefault.Foreground(tcell.ColorWhite).Background(tcell.ColorDefault)
-	bgStyle := tcell.StyleDefault.Background(tcell.ColorDefault).Foreground(tcell.ColorWhite)
+	borderStyle := a.style("popup")
+	bgStyle := a.style("popup")
 
 	// рисуем фон
 	for yy := 0; yy < ph; yy++ {
@@ -797,22 +900,10 @@ func (a *App) drawHelpPopup(s tcell.Screen, help string) {
 	}
 
 	for i := startLine; i < len(lines); i++ {
-		line := lines[i]
-		// Если строка длиннее доступного пространства, обрезаем её
-		runes := []rune(line)
-		if len(runes) > innerW {
-			runes = runes[:innerW]
-		}
-
-		// Печатаем каждый рун (символ) по отдельности, чтобы избежать проблем с кириллицей
-		for j, r := range runes {
-			xPos := left + padding + j
-			yPos := top + padding + (i - startLine)
-
-			// Проверяем границы экрана
-			if xPos >= left && xPos < left+pw-1 && yPos >= top && yPos < top+ph-1 {
-				s.SetContent(xPos, yPos, r, nil, bgStyle)
-			}
+		// Если строка длиннее доступного пространства, она обрезается с многоточием
+		yPos := top + padding + (i - startLine)
+		if yPos >= top && yPos < top+ph-1 {
+			a.printTextFixedWidth(s, left+padding, yPos, lines[i], bgStyle, minInt(innerW, pw-padding-1))
 		}
 	}
 }
@@ -835,11 +926,11 @@ func wrapText(s string, max int) []string {
 		cur := " " // левый отступ
 
 		for _, w := range words {
-			if runeLen(w) > max-1 {
-				chunks := chunkString(w, max-1)
+			if textWidth(w) > max-1 {
+				chunks := chunkText(w, max-1)
 				for i, c := range chunks {
 					if i == 0 {
-						if runeLen(cur)+1+runeLen(c) <= max {
+						if textWidth(cur)+1+textWidth(c) <= max {
 							cur += " " + c
 						} else {
 							result = append(result, cur)
@@ -853,8 +944,8 @@ func wrapText(s string, max int) []string {
 				continue
 			}
 
-			if runeLen(cur)+1+runeLen(w) <= max {
-				if runeLen(cur) > 1 {
+			if textWidth(cur)+1+textWidth(w) <= max {
+				if textWidth(cur) > 1 {
 					cur += " " + w
 				} else {
 					cur += w
@@ -877,29 +968,16 @@ func wrapText(s string, max int) []string {
 	return result
 }
 
-func runeLen(s string) int {
-	return len([]rune(s))
-}
-
-func chunkString(s string, size int) []string {
-	r := []rune(s)
-	var out []string
-	for i := 0; i < len(r); i += size {
-		j := i + size
-		if j > len(r) {
-			j = len(r)
-		}
-		out = append(out, string(r[i:j]))
-	}
-	return out
-}
-
 // ----------------------------- Commands / Storage -----------------------------
 
 func (a *App) ExecuteCommand(cmd string) {
 	if cmd == "" {
 		return
 	}
+	if isSubstitute(cmd) {
+		a.substitute(cmd)
+		return
+	}
 	parts := strings.Fields(cmd)
 	if len(parts) == 0 {
 		return
@@ -941,11 +1019,53 @@ func (a *App) ExecuteCommand(cmd string) {
 				}
 			} else {
 				// Сохраняем в формате grider
-				if err := storage.SaveDocument(a.Grid, a.ColWidths, a.RowHeights, filename); err != nil {
+				if err := storage.SaveDocument(a.sheet(), filename); err != nil {
 					fmt.Fprintf(os.Stderr, "error saving document: %v\n", err)
 				}
 			}
 		}
+	case "name":
+		a.nameCommand(parts[1:])
+	case "undo", "u":
+		if !a.Undo() {
+			a.StatusMsg = "already at oldest change"
+		}
+	case "redo", "red":
+		if !a.Redo() {
+			a.StatusMsg = "already at newest change"
+		}
+	case "noh", "nohlsearch":
+		a.searchHL = false
+	case "set", "se":
+		a.setCommand(parts[1:])
+	case "map", "unmap":
+		a.mapCommand(parts[0], parts[1:])
+	case "sort", "sor":
+		a.sortCommand(parts[1:])
+	case "filter", "filt":
+		a.filterCommand(parts[1:])
+	case "autofit", "af":
+		a.autofitCommand(parts[1:])
+	case "theme", "colo", "colorscheme":
+		a.themeCommand(parts[1:])
+	case "border", "bo":
+		a.borderCommand(parts[1:])
+	case "merge", "unmerge":
+		a.mergeCommand(parts[0], parts[1:])
+	case "cf":
+		a.cfCommand(parts[1:])
+	case "note", "note!":
+		a.noteCommand(parts[0], parts[1:])
+	case "notes":
+		a.notesCommand()
+	case "validate", "va":
+		a.validateCommand(parts[1:])
+	case "fill":
+		a.fillCommand(parts[1:])
+	case "freeze", "unfreeze":
+		a.freezeCommand(parts[0], parts[1:])
+	case "hide", "unhide", "group", "ungroup", "collapse", "expand":
+		a.outlineCommand(parts[0], parts[1:])
 	case "o":
 		if len(parts) >= 2 {
 			// Проверяем, хотим ли загрузить из формата CSV или grider
@@ -965,6 +1085,13 @@ func (a *App) ExecuteCommand(cmd string) {
 					return
 				}
 				a.Grid = gridMap
+				a.Names = map[string]string{}
+				a.FrozenRows, a.FrozenCols = 0, 0
+				a.HiddenRows, a.HiddenCols = map[int]bool{}, map[int]bool{}
+				a.RowLevels, a.ColLevels = map[int]int{}, map[int]int{}
+				a.Merges = map[[2]int][2]int{}
+				a.Rules = nil
+				a.Checks = nil
 				for i := 0; i <= maxC; i++ {
 					a.EnsureColExists(i)
 				}
@@ -973,94 +1100,212 @@ func (a *App) ExecuteCommand(cmd string) {
 				}
 			} else {
 				// Загружаем из формата grider
-				grid, colWidths, rowHeights, err := storage.LoadDocument(filename)
+				sheet, err := storage.LoadDocument(filename)
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "error loading document: %v\n", err)
 					return
 				}
-				a.Grid = grid
-				a.ColWidths = colWidths
-				a.RowHeights = rowHeights
+				a.setSheet(sheet)
 			}
 			a.CurRow = 0
 			a.CurCol = 0
-			a.ViewRow = 0
-			a.ViewCol = 0
+			a.ViewRow = a.FrozenRows
+			a.ViewCol = a.FrozenCols
+			a.Anchor = nil
+			a.filter = nil
+			a.clearUndo()
+		}
+	case "goto", "g":
+		if len(parts) >= 2 {
+			if err := a.gotoCommand(parts[1]); err != nil {
+				a.StatusMsg = err.Error()
+			}
 		}
 	default:
 		// unknown command
 		if parts[0] == "help" {
 			// Показываем справку
 			a.HelpVisible = true
+		} else if len(parts) > 1 {
+			a.StatusMsg = "unknown command: " + parts[0]
+		} else if err := a.gotoCommand(parts[0]); errors.Is(err, errNotCell) {
+			// :A120 - переход к ячейке, остальное неизвестно
+			a.StatusMsg = "unknown command: " + parts[0]
+		} else if err != nil {
+			a.StatusMsg = err.Error()
 		}
 	}
 }
 
+// popupCommand runs the commands that open a popup and so need the
+// screen: :note without text (edit the note of the current cell), :notes
+// (pick a note to jump to) and :pick (pick a value for a list-validated
+// cell). It reports whether cmd was one of them.
+func (a *App) popupCommand(s tcell.Screen, cmd string) bool {
+	switch strings.TrimSpace(cmd) {
+	case "note":
+		a.editNote(s)
+	case "notes":
+		a.pickNote(s)
+	case "pick":
+		a.pickValue(s)
+	default:
+		return false
+	}
+	return true
+}
+
+// sheet collects the document state that is saved to .grider files.
+func (a *App) sheet() *storage.Sheet {
+	return &storage.Sheet{
+		Grid:       a.Grid,
+		ColWidths:  a.ColWidths,
+		RowHeights: a.RowHeights,
+		Names:      a.Names,
+		FrozenRows: a.FrozenRows,
+		FrozenCols: a.FrozenCols,
+		HiddenRows: a.HiddenRows,
+		HiddenCols: a.HiddenCols,
+		RowLevels:  a.RowLevels,
+		ColLevels:  a.ColLevels,
+		Merges:     a.Merges,
+		Rules:      a.Rules,
+		Checks:     a.Checks,
+	}
+}
+
+// setSheet replaces the document state with a loaded sheet.
+func (a *App) setSheet(sh *storage.Sheet) {
+	a.Grid = sh.Grid
+	a.ColWidths = sh.ColWidths
+	a.RowHeights = sh.RowHeights
+	a.Names = sh.Names
+	if a.Names == nil {
+		a.Names = map[string]string{}
+	}
+	a.FrozenRows, a.FrozenCols = sh.FrozenRows, sh.FrozenCols
+	a.HiddenRows, a.HiddenCols = orEmpty(sh.HiddenRows), orEmpty(sh.HiddenCols)
+	a.RowLevels, a.ColLevels = orEmpty(sh.RowLevels), orEmpty(sh.ColLevels)
+	a.Merges = sh.Merges
+	a.Rules = sh.Rules
+	a.Checks = sh.Checks
+	if a.Merges == nil {
+		a.Merges = map[[2]int][2]int{}
+	}
+}
+
+// orEmpty returns m, or an empty map when m is nil.
+func orEmpty[V any](m map[int]V) map[int]V {
+	if m == nil {
+		return map[int]V{}
+	}
+	return m
+}
+
 // ----------------------------- Display / Formulas -----------------------------
 
 func (a *App) GetDisplayText(r, c int) string {
 	key := [2]int{r, c}
 	cell, ok := a.Grid[key]
-	if !ok {
-		return ""
+	if !ok || cell.Text == "" {
+		// empty cells may show part of an array formula's spill range
+		text := ""
+		a.withEvalCache(func() {
+			if v, ok := a.spilledValue(r, c, map[[2]int]bool{}); ok {
+				text = formatValue(v)
+			}
+		})
+		return text
 	}
 	text := cell.Text
-	if text == "" {
-		return ""
-	}
 	if !strings.HasPrefix(text, "=") {
 		return text
 	}
-	expr := text[1:]
-	visited := map[[2]int]bool{}
-	// mark base to detect self reference
-	baseKey := [2]int{r, c}
-	if visited[baseKey] {
-		return "#CYCLE"
-	}
-	visited[baseKey] = true
-	defer delete(visited, baseKey)
-
-	// resolver closure to give to calc package
-	resolve := func(name string) (float64, string) {
-		ridx, cidx, ok := grid.ParseCellRef(name)
-		if !ok {
-			return 0, "#REF"
-		}
-		if ridx < 0 || cidx < 0 {
-			return 0, "#REF"
-		}
-		if ridx >= len(a.RowHeights) || cidx >= len(a.ColWidths) {
-			return 0, "#REF"
-		}
-		k := [2]int{ridx, cidx}
-		if visited[k] {
-			return 0, "#CYCLE"
-		}
-		cell, ok := a.Grid[k]
-		if !ok || cell.Text == "" {
-			return 0, ""
-		}
-		if strings.HasPrefix(cell.Text, "=") {
-			visited[k] = true
-			val, err := a.evalFormulaForCell(cell.Text[1:], ridx, cidx, visited)
-			delete(visited, k)
-			return val, err
-		}
-		v, err := strconv.ParseFloat(cell.Text, 64)
-		if err != nil {
-			return 0, "#ERR"
-		}
-		return v, ""
-	}
+	return formatValue(a.CellValue(r, c))
+}
+
+// CellValue evaluates the cell at r, c: formulas are calculated, other text
+// is interpreted as a number, an error literal or plain text. The anchor of
+// a spill range returns the whole array; empty cells inside the range
+// return their element.
+func (a *App) CellValue(r, c int) calc.Value {
+	var v calc.Value
+	a.withEvalCache(func() {
+		v = a.cellValue(r, c, map[[2]int]bool{})
+	})
+	return v
+}
 
-	val, errCode := calc.EvalExprForCell(expr, r, c, resolve, visited)
-	if errCode != "" {
-		return errCode
+// cellValue evaluates a cell; cells being evaluated are tracked in visited
+// to detect cycles. It must run inside withEvalCache.
+func (a *App) cellValue(r, c int, visited map[[2]int]bool) calc.Value {
+	k := [2]int{r, c}
+	if v, ok := a.cache.values[k]; ok {
+		return v
+	}
+	cell, ok := a.Grid[k]
+	if !ok || cell.Text == "" {
+		v, _ := a.spilledValue(r, c, visited)
+		return v
+	}
+	if !strings.HasPrefix(cell.Text, "=") {
+		return calc.LiteralValue(cell.Text)
+	}
+	if visited[k] {
+		return calc.Errorf(calc.ErrCirc, "circular reference through %s", grid.ColRowToName(c, r))
+	}
+	visited[k] = true
+	defer delete(visited, k)
+	v := calc.EvalExprForCell(cell.Text[1:], a.formulaEnv(visited))
+	if v.Kind == calc.KindBlank {
+		// a formula referring to an empty cell shows 0
+		v = calc.Number(0)
+	}
+	v = a.spillArray(r, c, v, visited)
+	a.cache.values[k] = v
+	if v.Kind == calc.KindArray {
+		a.cache.addSpill(k, v)
+	}
+	return v
+}
+
+// formulaEnv builds the calc environment for the current grid.
+func (a *App) formulaEnv(visited map[[2]int]bool) calc.Env {
+	resolve := func(ridx, cidx int) calc.Value {
+		name := grid.ColRowToName(cidx, ridx)
+		if ridx < 0 || cidx < 0 || ridx >= len(a.RowHeights) || cidx >= len(a.ColWidths) {
+			return calc.Errorf(calc.ErrRef, "%s is outside the grid", name)
+		}
+		// a plain reference to a spill anchor sees its top-left value
+		v := a.cellValue(ridx, cidx, visited).First()
+		if v.IsError() && v.Err != calc.ErrCirc && strings.HasPrefix(a.Grid[[2]int{ridx, cidx}].Text, "=") {
+			// say where a propagated error comes from
+			v.Msg = "in " + name + ": " + v.Msg
+		}
+		return v
+	}
+	return calc.Env{
+		Rows:   len(a.RowHeights),
+		Cols:   len(a.ColWidths),
+		Cell:   resolve,
+		Name:   a.lookupName,
+		Spill:  a.spillSize(visited),
+		Hidden: a.hiddenBy,
 	}
-	if math.IsNaN(val) || math.IsInf(val, 0) {
-		return "#ERR"
+}
+
+// formatValue renders a calculated value for display in a cell.
+func formatValue(v calc.Value) string {
+	v = v.First()
+	switch v.Kind {
+	case calc.KindError:
+		return v.Err.String()
+	case calc.KindText:
+		return v.Str
+	case calc.KindBlank:
+		return ""
 	}
+	val := v.Num
 	if math.Abs(val-math.Round(val)) < 1e-9 {
 		return fmt.Sprintf("%.0f", math.Round(val))
 	}
@@ -1070,59 +1315,37 @@ func (a *App) GetDisplayText(r, c int) string {
 	return s
 }
 
-// helper to evaluate formula string given visited; delegates to calc (keeps same semantics)
-func (a *App) evalFormulaForCell(expr string, baseR, baseC int, visited map[[2]int]bool) (float64, string) {
-	// create a resolver similar to above (used by GetDisplayText recursion)
-	resolve := func(name string) (float64, string) {
-		ridx, cidx, ok := grid.ParseCellRef(name)
-		if !ok {
-			return 0, "#REF"
-		}
-		if ridx < 0 || cidx < 0 {
-			return 0, "#REF"
-		}
-		if ridx >= len(a.RowHeights) || cidx >= len(a.ColWidths) {
-			return 0, "#REF"
-		}
-		k := [2]int{ridx, cidx}
-		if visited[k] {
-			return 0, "#CYCLE"
-		}
-		cell, ok := a.Grid[k]
-		if !ok || cell.Text == "" {
-			return 0, ""
-		}
-		if strings.HasPrefix(cell.Text, "=") {
-			visited[k] = true
-			val, err := a.evalFormulaForCell(cell.Text[1:], ridx, cidx, visited)
-			delete(visited, k)
-			return val, err
-		}
-		v, err := strconv.ParseFloat(cell.Text, 64)
-		if err != nil {
-			return 0, "#ERR"
-		}
-		return v, ""
+// cellErrorText explains why the current cell shows an error, for the
+// status line; it is empty when the cell is fine.
+func (a *App) cellErrorText() string {
+	v := a.CellValue(a.CurRow, a.CurCol)
+	if !v.IsError() {
+		return ""
 	}
-	return calc.EvalExprForCell(expr, baseR, baseC, resolve, visited)
+	return grid.ColRowToName(a.CurCol, a.CurRow) + ": " + v.Explain()
 }
 
 // ----------------------------- Viewport / Geometry -----------------------------
 
-func (a *App) ComputeVisible(s tcell.Screen) (visibleRows, visibleCols int) {
+// viewSize returns the width and height of the screen area for cells,
+// below the header and right of the gutter.
+func (a *App) viewSize(s tcell.Screen) (width, height int) {
 	w, h := s.Size()
-	usableW := w - a.LeftGutter
-	if usableW < 1 {
-		usableW = 1
-	}
-	usableH := h - a.StatusLines - 1
-	if usableH < 1 {
-		usableH = 1
-	}
+	return maxInt(1, w-a.LeftGutter), maxInt(1, h-a.StatusLines-a.gridTop()-1)
+}
+
+func (a *App) ComputeVisible(s tcell.Screen) (visibleRows, visibleCols int) {
+	usableW, usableH := a.viewSize(s)
+	frozenH, frozenW := a.frozenSize()
+	usableW = maxInt(1, usableW-frozenW)
+	usableH = maxInt(1, usableH-frozenH)
 	sumW := 0
 	cols := 0
-	for c := a.ViewCol; c < len(a.ColWidths); c++ {
-		wc := a.ColWidths[c]
+	for c := maxInt(a.ViewCol, a.FrozenCols); c < len(a.ColWidths); c++ {
+		if a.colHidden(c) {
+			continue
+		}
+		wc := a.colSpan(c)
 		if sumW+wc > usableW {
 			break
 		}
@@ -1134,8 +1357,11 @@ func (a *App) ComputeVisible(s tcell.Screen) (visibleRows, visibleCols int) {
 	}
 	sumH := 0
 	rows := 0
-	for r := a.ViewRow; r < len(a.RowHeights); r++ {
-		hh := a.RowHeights[r]
+	for r := maxInt(a.ViewRow, a.FrozenRows); r < len(a.RowHeights); r++ {
+		if a.rowHidden(r) {
+			continue
+		}
+		hh := a.rowSpan(r)
 		if sumH+hh > usableH {
 			break
 		}
@@ -1149,77 +1375,69 @@ func (a *App) ComputeVisible(s tcell.Screen) (visibleRows, visibleCols int) {
 }
 
 func (a *App) EnsureCursorVisible(s tcell.Screen) {
+	a.ensureVisible(s, a.CurRow, a.CurCol)
+}
+
+// ensureVisible scrolls the view so that cell row, col is on screen. Frozen
+// rows and columns are always on screen and take space from the scrolling
+// part.
+func (a *App) ensureVisible(s tcell.Screen, row, col int) {
 	if s == nil {
 		return
 	}
-	w, h := s.Size()
-	usableW := w - a.LeftGutter
-	if usableW < 1 {
-		usableW = 1
-	}
-	usableH := h - a.StatusLines - 1
-	if usableH < 1 {
-		usableH = 1
-	}
-
-	visibleCols := 0
-	sumW := 0
-	for c := a.ViewCol; c < len(a.ColWidths); c++ {
-		wc := a.ColWidths[c]
-		if sumW+wc > usableW {
-			break
+	usableW, usableH := a.viewSize(s)
+	frozenH, frozenW := a.frozenSize()
+	usableW = maxInt(1, usableW-frozenW)
+	usableH = maxInt(1, usableH-frozenH)
+	a.ViewRow = maxInt(a.ViewRow, a.FrozenRows)
+	a.ViewCol = maxInt(a.ViewCol, a.FrozenCols)
+
+	switch {
+	case col < a.FrozenCols:
+		// frozen columns are always drawn
+	case col < a.ViewCol:
+		a.ViewCol = col
+	default:
+		// scroll right until the columns from ViewCol to col fit
+		sumW := 0
+		for c := a.ViewCol; c <= col && c < len(a.ColWidths); c++ {
+			if !a.colHidden(c) {
+				sumW += a.colSpan(c)
+			}
 		}
-		sumW += wc
-		visibleCols++
-	}
-	if visibleCols < 1 {
-		visibleCols = 1
-	}
-
-	visibleRows := 0
-	sumH := 0
-	for r := a.ViewRow; r < len(a.RowHeights); r++ {
-		hh := a.RowHeights[r]
-		if sumH+hh > usableH {
-			break
+		for sumW > usableW && a.ViewCol < col {
+			if !a.colHidden(a.ViewCol) {
+				sumW -= a.colSpan(a.ViewCol)
+			}
+			a.ViewCol++
 		}
-		sumH += hh
-		visibleRows++
-	}
-	if visibleRows < 1 {
-		visibleRows = 1
-	}
-
-	if a.CurCol < a.ViewCol {
-		a.ViewCol = a.CurCol
-	} else if a.CurCol >= a.ViewCol+visibleCols {
-		a.ViewCol = a.CurCol - visibleCols + 1
-	}
-	if a.ViewCol < 0 {
-		a.ViewCol = 0
 	}
 	if a.ViewCol >= len(a.ColWidths) {
-		if len(a.ColWidths) == 0 {
-			a.ViewCol = 0
-		} else {
-			a.ViewCol = len(a.ColWidths) - 1
-		}
+		a.ViewCol = maxInt(a.FrozenCols, len(a.ColWidths)-1)
 	}
 
-	if a.CurRow < a.ViewRow {
-		a.ViewRow = a.CurRow
-	} else if a.CurRow >= a.ViewRow+visibleRows {
-		a.ViewRow = a.CurRow - visibleRows + 1
-	}
-	if a.ViewRow < 0 {
-		a.ViewRow = 0
+	switch {
+	case row < a.FrozenRows:
+		// frozen rows are always drawn
+	case row < a.ViewRow:
+		a.ViewRow = row
+	default:
+		// scroll down until the shown rows from ViewRow to row fit
+		sumH := 0
+		for r := a.ViewRow; r <= row && r < len(a.RowHeights); r++ {
+			if !a.rowHidden(r) {
+				sumH += a.rowSpan(r)
+			}
+		}
+		for sumH > usableH && a.ViewRow < row {
+			if !a.rowHidden(a.ViewRow) {
+				sumH -= a.rowSpan(a.ViewRow)
+			}
+			a.ViewRow++
+		}
 	}
 	if a.ViewRow >= len(a.RowHeights) {
-		if len(a.RowHeights) == 0 {
-			a.ViewRow = 0
-		} else {
-			a.ViewRow = len(a.RowHeights) - 1
-		}
+		a.ViewRow = maxInt(a.FrozenRows, len(a.RowHeights)-1)
 	}
 }
 
@@ -0,0 +1,169 @@
+package app
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+
+	"sheet/internal/calc"
+)
+
+// maxSuggestions bounds the completion list under the = popup.
+const maxSuggestions = 8
+
+// suggestion is one completion for the identifier under the cursor.
+type suggestion struct {
+	Insert string // text replacing the typed prefix
+	Label  string // what the list shows
+}
+
+// formulaPrefix returns the start (in runes) of the identifier that ends
+// at pos in a formula buffer starting with '='. ok is false when there is
+// nothing to complete, e.g. inside a string literal or after a digit.
+func formulaPrefix(buf []rune, pos int) (start int, ok bool) {
+	if len(buf) == 0 || buf[0] != '=' || pos > len(buf) {
+		return 0, false
+	}
+	start = pos
+	for start > 1 && isIdentRune(buf[start-1]) {
+		start--
+	}
+	if start == pos || !(isLetterRune(buf[start]) || buf[start] == '_') {
+		return 0, false
+	}
+	expr := string(buf[1:])
+	at := len(string(buf[1:start]))
+	for _, t := range calc.Tokenize(expr) {
+		if t.Kind == calc.TokString && t.Start < at && at < t.End {
+			return 0, false
+		}
+	}
+	return start, true
+}
+
+// suggestions lists functions and defined names starting with the
+// identifier at pos. Functions come first, names after, both sorted.
+func (a *App) suggestions(buf []rune, pos int) (start int, out []suggestion) {
+	start, ok := formulaPrefix(buf, pos)
+	if !ok {
+		return 0, nil
+	}
+	prefix := strings.ToUpper(string(buf[start:pos]))
+	for _, f := range calc.FuncsWithPrefix(prefix) {
+		out = append(out, suggestion{Insert: f.Name + "(", Label: f.Signature() + " - " + f.Desc})
+	}
+	var names []string
+	for name := range a.Names {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		out = append(out, suggestion{Insert: name, Label: name + " = " + a.Names[name]})
+	}
+	// an exact, complete match needs no list
+	if len(out) == 1 && strings.EqualFold(strings.TrimSuffix(out[0].Insert, "("), prefix) &&
+		(pos < len(buf) && buf[pos] == '(' || !strings.HasSuffix(out[0].Insert, "(")) {
+		return start, nil
+	}
+	return start, out
+}
+
+// signatureHelp describes the function call around pos: the signature is
+// split so that the parameter being typed can be emphasised.
+func signatureHelp(buf []rune, pos int) (before, param, after string, ok bool) {
+	if len(buf) == 0 || buf[0] != '=' {
+		return "", "", "", false
+	}
+	fn, arg, ok := calc.CallContext(string(buf[1:]), len(string(buf[1:pos])))
+	if !ok {
+		return "", "", "", false
+	}
+	info, ok := calc.LookupFunc(fn)
+	if !ok {
+		return "", "", "", false
+	}
+	idx := info.Param(arg)
+	before = info.Name + "("
+	for i, p := range info.Params {
+		if i > 0 {
+			if i <= idx {
+				before += ", "
+			} else {
+				after += ", "
+			}
+		}
+		switch {
+		case i < idx:
+			before += p
+		case i == idx:
+			param = p
+		default:
+			after += p
+		}
+	}
+	after += ")"
+	if info.Desc != "" {
+		after += "  " + info.Desc
+	}
+	return before, param, after, true
+}
+
+// formulaStyles colours a formula buffer rune by rune. Problems found by
+// calc.Tokenize (unbalanced parentheses, unterminated strings, unknown
+// error literals) get the formula-bad style of the theme.
+func (a *App) formulaStyles(buf []rune, base tcell.Style) []tcell.Style {
+	styles := make([]tcell.Style, len(buf))
+	for i := range styles {
+		styles[i] = base
+	}
+	if len(buf) == 0 || buf[0] != '=' {
+		return styles
+	}
+	expr := string(buf[1:])
+	// byte offset in expr -> rune index in buf
+	runeAt := make([]int, len(expr)+1)
+	ri := 1
+	for bi, r := range expr {
+		for k := 0; k < utf8.RuneLen(r); k++ {
+			runeAt[bi+k] = ri
+		}
+		ri++
+	}
+	runeAt[len(expr)] = len(buf)
+	for _, t := range calc.Tokenize(expr) {
+		st := base
+		switch t.Kind {
+		case calc.TokNumber:
+			st = a.overlay(st, "formula-number")
+		case calc.TokString:
+			st = a.overlay(st, "formula-string")
+		case calc.TokRef:
+			st = a.overlay(st, "formula-ref")
+		case calc.TokFunc:
+			st = a.overlay(st, "formula-func")
+		case calc.TokName:
+			st = a.overlay(st, "formula-name")
+		case calc.TokError:
+			st = a.overlay(st, "formula-error")
+		}
+		if t.Bad {
+			st = a.overlay(st, "formula-bad")
+		}
+		for i := runeAt[t.Start]; i < runeAt[t.End]; i++ {
+			styles[i] = st
+		}
+	}
+	return styles
+}
+
+func isLetterRune(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+}
+
+func isIdentRune(r rune) bool {
+	return isLetterRune(r) || r >= '0' && r <= '9' || r == '_' || r == '.'
+}
@@ -0,0 +1,122 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+
+	"sheet/internal/grid"
+)
+
+// maxFitWidth bounds the width :autofit gives a column, so that one long
+// text does not push everything else off the screen.
+const maxFitWidth = 60
+
+// textSize returns the width in screen cells of the widest line of text
+// (wide East Asian characters and emoji count as two) and its line count.
+func textSize(text string) (width, height int) {
+	lines := strings.Split(text, "\n")
+	for _, line := range lines {
+		width = maxInt(width, textWidth(line))
+	}
+	return width, len(lines)
+}
+
+// fitWidth is the width column c needs to show the displayed text of its
+// shown cells and its header. Merged blocks are left out, as they have the
+// room of several columns.
+func (a *App) fitWidth(c int) int {
+	w := len(grid.ColToName(c))
+	if a.filter != nil && c >= a.filter.c1 && c <= a.filter.c2 {
+		w++ // room for the filter button
+	}
+	for r := range a.RowHeights {
+		if _, _, _, _, merged := a.mergeAt(r, c); merged || a.rowHidden(r) {
+			continue
+		}
+		tw, _ := textSize(a.shownText(r, c))
+		w = maxInt(w, tw)
+	}
+	return minInt(maxInt(w+2*a.CellPadding, 4), maxFitWidth)
+}
+
+// fitHeight is the height row r needs to show every line of its shown
+// cells, merged blocks left out.
+func (a *App) fitHeight(r int) int {
+	h := 1
+	for c := range a.ColWidths {
+		if _, _, _, _, merged := a.mergeAt(r, c); merged || a.colHidden(c) {
+			continue
+		}
+		if text := a.shownText(r, c); text != "" {
+			_, th := textSize(text)
+			h = maxInt(h, th)
+		}
+	}
+	return h
+}
+
+// autofitCommand handles :autofit: the width of the current column and the
+// height of the current row, of the selected columns and rows, or with
+// :autofit all of the whole sheet. :autofit col and :autofit row fit only
+// one direction.
+func (a *App) autofitCommand(args []string) {
+	cols, rows, all := true, true, false
+	for _, arg := range args {
+		switch {
+		case arg == "all":
+			all = true
+		case strings.HasPrefix(arg, "col"):
+			rows = false
+		case strings.HasPrefix(arg, "row"):
+			cols = false
+		default:
+			a.StatusMsg = "usage: :autofit [col|row] [all]"
+			return
+		}
+	}
+	r1, c1, r2, c2 := a.CurRow, a.CurCol, a.CurRow, a.CurCol
+	if all {
+		r1, c1, r2, c2 = 0, 0, len(a.RowHeights)-1, len(a.ColWidths)-1
+	} else if sr1, sc1, sr2, sc2, ok := a.selection(); ok {
+		r1, c1, r2, c2 = sr1, sc1, sr2, sc2
+	}
+	a.EnsureRowExists(r2)
+	a.EnsureColExists(c2)
+
+	a.pushUndo()
+	nc, nr := 0, 0
+	a.withEvalCache(func() {
+		if cols {
+			for c := c1; c <= c2; c++ {
+				if !a.colHidden(c) {
+					a.ColWidths[c] = a.fitWidth(c)
+					nc++
+				}
+			}
+		}
+		if rows {
+			for r := r1; r <= r2; r++ {
+				if !a.rowHidden(r) {
+					a.RowHeights[r] = a.fitHeight(r)
+					nr++
+				}
+			}
+		}
+	})
+	a.Anchor = nil
+	a.StatusMsg = fmt.Sprintf("fitted %d column(s) and %d row(s)", nc, nr)
+}
+
+// growToFit widens the current column and heightens the current row when
+// the text just entered does not fit (:set autogrow). It never shrinks
+// them.
+func (a *App) growToFit() {
+	text := a.shownText(a.CurRow, a.CurCol)
+	if text == "" {
+		return
+	}
+	w, h := textSize(text)
+	w = minInt(w+2*a.CellPadding, maxFitWidth)
+	a.ColWidths[a.CurCol] = maxInt(a.ColWidths[a.CurCol], w)
+	a.RowHeights[a.CurRow] = maxInt(a.RowHeights[a.CurRow], h)
+}
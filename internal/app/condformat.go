@@ -0,0 +1,408 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+
+	"sheet/internal/calc"
+	"sheet/internal/grid"
+	"sheet/internal/storage"
+)
+
+// condOps are the comparisons of value rules.
+var condOps = []string{"<", "<=", ">", ">=", "=", "<>"}
+
+// The colours of scales and bars when :cf gives none.
+const (
+	defaultScale = "red yellow green"
+	defaultBar   = "steelblue"
+)
+
+// barBlocks are the eighths of a screen cell a data bar ends with.
+var barBlocks = []rune{' ', '▏', '▎', '▍', '▌', '▋', '▊', '▉', '█'}
+
+// shadeBlocks show the level of a colour scale on terminals with too few
+// colours for its gradient.
+var shadeBlocks = []rune{'░', '▒', '▓', '█'}
+
+// condFormat is a conditional formatting rule prepared for drawing one
+// frame.
+type condFormat struct {
+	rule           storage.Rule
+	r1, c1, r2, c2 int
+	style          tcell.Style   // value rules
+	colors         []tcell.Color // scales and bars
+	lo, hi         float64       // scales and bars: the smallest and largest number in the range
+}
+
+func (f *condFormat) contains(r, c int) bool {
+	return r >= f.r1 && r <= f.r2 && c >= f.c1 && c <= f.c2
+}
+
+// rangeBounds resolves a cell, a range or a name to its bounds in the grid.
+func (a *App) rangeBounds(ref string) (r1, c1, r2, c2 int, ok bool) {
+	if def, found := a.lookupName(ref); found {
+		ref = def
+	}
+	if r, c, isCell := grid.ParseCellRef(ref); isCell {
+		return r, c, r, c, true
+	}
+	return grid.ParseRangeRef(ref, len(a.RowHeights), len(a.ColWidths))
+}
+
+// touchesSelection reports whether the range ref overlaps the selection,
+// or holds the cursor when nothing is selected.
+func (a *App) touchesSelection(ref string) bool {
+	r1, c1, r2, c2, ok := a.selection()
+	if !ok {
+		r1, c1, r2, c2 = a.CurRow, a.CurCol, a.CurRow, a.CurCol
+	}
+	fr1, fc1, fr2, fc2, ok := a.rangeBounds(ref)
+	return ok && fr1 <= r2 && fr2 >= r1 && fc1 <= c2 && fc2 >= c1
+}
+
+// isRangeRef reports whether ref looks like a cell, a range or a name,
+// wherever it lies.
+func (a *App) isRangeRef(ref string) bool {
+	if _, ok := a.lookupName(ref); ok {
+		return true
+	}
+	if _, _, ok := grid.ParseCellRef(ref); ok {
+		return true
+	}
+	_, _, _, _, ok := grid.ParseRangeRef(ref, maxRows, maxCols)
+	return ok
+}
+
+// parseColors parses the colours of a scale or a bar, e.g. "red yellow
+// green".
+func parseColors(spec string) ([]tcell.Color, error) {
+	var colors []tcell.Color
+	for _, word := range strings.Fields(spec) {
+		st, err := parseStyle(word)
+		fg, _, _ := st.Decompose()
+		if err != nil || !fg.Valid() {
+			return nil, fmt.Errorf("unknown colour %q", word)
+		}
+		colors = append(colors, fg)
+	}
+	if len(colors) == 0 {
+		return nil, fmt.Errorf("no colours")
+	}
+	return colors, nil
+}
+
+// gradient returns the colour at level (0 to 1) of the gradient through
+// colors.
+func gradient(colors []tcell.Color, level float64) tcell.Color {
+	if len(colors) == 1 {
+		return colors[0]
+	}
+	pos := math.Max(0, math.Min(1, level)) * float64(len(colors)-1)
+	i := minInt(int(pos), len(colors)-2)
+	t := pos - float64(i)
+	r1, g1, b1 := colors[i].RGB()
+	r2, g2, b2 := colors[i+1].RGB()
+	mix := func(p, q int32) int32 { return p + int32(math.Round(float64(q-p)*t)) }
+	return tcell.NewRGBColor(mix(r1, r2), mix(g1, g2), mix(b1, b2))
+}
+
+// contrast returns black or white, whichever reads better on bg.
+func contrast(bg tcell.Color) tcell.Color {
+	r, g, b := bg.RGB()
+	if 299*r+587*g+114*b > 150000 {
+		return tcell.ColorBlack
+	}
+	return tcell.ColorWhite
+}
+
+// condFormats prepares the rules for a frame; rules that no longer make
+// sense (e.g. their range was deleted) are left out. It must run inside
+// withEvalCache.
+func (a *App) condFormats() []condFormat {
+	var out []condFormat
+	for _, rule := range a.Rules {
+		f := condFormat{rule: rule}
+		var ok bool
+		if f.r1, f.c1, f.r2, f.c2, ok = a.rangeBounds(rule.Range); !ok {
+			continue
+		}
+		if rule.Kind == "value" {
+			st, err := parseStyle(rule.Style)
+			if err != nil {
+				continue
+			}
+			f.style = degrade(st, a.styleColors)
+			out = append(out, f)
+			continue
+		}
+		colors, err := parseColors(rule.Style)
+		if err != nil {
+			continue
+		}
+		f.colors = colors
+		found := false
+		for r := f.r1; r <= f.r2; r++ {
+			for c := f.c1; c <= f.c2; c++ {
+				v := a.cellValue(r, c, map[[2]int]bool{}).First()
+				if v.Kind != calc.KindNumber {
+					continue
+				}
+				if !found {
+					f.lo, f.hi, found = v.Num, v.Num, true
+				}
+				f.lo, f.hi = math.Min(f.lo, v.Num), math.Max(f.hi, v.Num)
+			}
+		}
+		if rule.Kind == "bar" {
+			// bars grow from zero
+			f.lo, f.hi = math.Min(f.lo, 0), math.Max(f.hi, 0)
+		}
+		if found {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// condHolds reports whether the value of cell r, c passes the comparison
+// of rule f. The compared value is a formula; its relative references are
+// written for the top-left cell of the range and move with the cell, as
+// when a formula is copied. Blank cells never match.
+func (a *App) condHolds(f *condFormat, r, c int) bool {
+	if v := a.cellValue(r, c, map[[2]int]bool{}).First(); v.Kind == calc.KindBlank || v.IsError() {
+		return false
+	}
+	value := calc.OffsetRefs(f.rule.Value, r-f.r1, c-f.c1)
+	expr := grid.ColRowToName(c, r) + f.rule.Op + "(" + value + ")"
+	v := calc.EvalExprForCell(expr, a.formulaEnv(map[[2]int]bool{})).AsNumber()
+	return !v.IsError() && v.Num != 0
+}
+
+// condValue checks the compared value of a new rule by evaluating it once,
+// as written for the top-left cell. A bare word that does not evaluate,
+// like yes, is taken as text and quoted; an unknown name or function and a
+// malformed formula are rejected. Other errors depend on the cells
+// referred to and may go away, so they are let through.
+func (a *App) condValue(value string) (string, error) {
+	var v calc.Value
+	a.withEvalCache(func() {
+		v = calc.EvalExprForCell(value, a.formulaEnv(map[[2]int]bool{}))
+	})
+	if !v.IsError() {
+		return value, nil
+	}
+	if !strings.ContainsFunc(value, func(r rune) bool { return !unicode.IsLetter(r) }) {
+		return strconv.Quote(value), nil
+	}
+	if v.Err == calc.ErrName || v.Err == calc.ErrValue {
+		return "", fmt.Errorf("%s: %s", value, v.Msg)
+	}
+	return value, nil
+}
+
+// condStyle applies the value rules matching cell r, c, in order, to its
+// style. On the cursor, the selection and other highlighted cells (plain
+// false) only the text changes, so that they stay visible.
+func (a *App) condStyle(fs []condFormat, r, c int, base tcell.Style, plain bool) tcell.Style {
+	for i := range fs {
+		f := &fs[i]
+		if f.rule.Kind != "value" || !f.contains(r, c) || !a.condHolds(f, r, c) {
+			continue
+		}
+		st := f.style
+		if !plain {
+			st = st.Background(tcell.ColorDefault)
+		}
+		base = overlayStyle(base, st)
+	}
+	return base
+}
+
+// drawCondBlocks draws the colour scales and data bars matching cell r, c
+// over the cell drawn at x, y of size wc x hh. A scale colours the
+// background, or with fewer than 256 colours fills the blanks with shades;
+// a bar fills the blanks of its length with blocks and puts its colour
+// behind the text there.
+func (a *App) drawCondBlocks(s tcell.Screen, fs []condFormat, r, c, x, y, wc, hh int) {
+	w, h := s.Size()
+	for i := range fs {
+		f := &fs[i]
+		if f.rule.Kind == "value" || !f.contains(r, c) {
+			continue
+		}
+		v := a.cellValue(r, c, map[[2]int]bool{}).First()
+		if v.Kind != calc.KindNumber {
+			continue
+		}
+		level := 1.0
+		if f.hi > f.lo {
+			level = (v.Num - f.lo) / (f.hi - f.lo)
+		}
+		color := gradient(f.colors, level)
+		fg, _, _ := degrade(tcell.StyleDefault.Foreground(color), a.styleColors).Decompose()
+		eighths := int(math.Round(level * float64(wc*8)))
+		for dy := 0; dy < hh; dy++ {
+			for dx := 0; dx < wc; dx++ {
+				px, py := x+dx, y+dy
+				if px < 0 || py < 0 || px >= w || py >= h-a.StatusLines {
+					continue
+				}
+				ch, comb, st, _ := s.GetContent(px, py)
+				blank := ch == ' '
+				switch {
+				case f.rule.Kind == "scale" && a.styleColors >= 256:
+					st = st.Background(color).Foreground(contrast(color))
+				case f.rule.Kind == "scale" && blank:
+					ch, st = shadeBlocks[minInt(int(level*4), 3)], st.Foreground(fg)
+				case f.rule.Kind == "bar" && dx < eighths/8:
+					if blank {
+						ch, st = '█', st.Foreground(fg)
+					} else {
+						st = st.Background(fg).Foreground(contrast(color))
+					}
+				case f.rule.Kind == "bar" && dx == eighths/8 && blank && eighths%8 > 0:
+					ch, st = barBlocks[eighths%8], st.Foreground(fg)
+				default:
+					continue
+				}
+				s.SetContent(px, py, ch, comb, st)
+			}
+		}
+	}
+}
+
+// shiftRules rewrites the ranges and compared values of the rules after
+// rows or columns were inserted or deleted; rules whose range was deleted
+// are dropped.
+func (a *App) shiftRules(shift func(expr string) string) {
+	var out []storage.Rule
+	for _, rule := range a.Rules {
+		rule.Range = shift(rule.Range)
+		if strings.Contains(rule.Range, "#REF!") {
+			continue
+		}
+		if rule.Value != "" {
+			rule.Value = shift(rule.Value)
+		}
+		out = append(out, rule)
+	}
+	a.Rules = out
+}
+
+// ruleText formats a rule as the arguments of :cf that define it.
+func ruleText(rule storage.Rule) string {
+	if rule.Kind == "value" {
+		return strings.Join([]string{rule.Range, rule.Op, rule.Value, rule.Style}, " ")
+	}
+	return strings.Join([]string{rule.Range, rule.Kind, rule.Style}, " ")
+}
+
+func (a *App) rulesText() string {
+	var b strings.Builder
+	b.WriteString("Conditional formats:\n")
+	for i, rule := range a.Rules {
+		fmt.Fprintf(&b, "%2d  %s\n", i+1, ruleText(rule))
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// cfCommand handles conditional formatting:
+//
+//	:cf [RANGE] OP VALUE STYLE  style the cells whose value compares true, e.g. :cf B2:B20 < 0 red
+//	:cf [RANGE] scale [COLORS]  colour scale from the smallest to the largest number
+//	:cf [RANGE] bar [COLOR]     data bars
+//	:cf                         list the rules
+//	:cf delete N                delete rule N of the list
+//	:cf clear [all]             delete the rules on the selection or the cursor (all: every rule)
+//
+// RANGE is a cell, a range or a name and defaults to the selection or the
+// current cell. Rules are applied in order, later ones over earlier ones.
+func (a *App) cfCommand(args []string) {
+	const usage = "usage: :cf [RANGE] <|<=|>|>=|=|<> VALUE STYLE | scale [COLORS] | bar [COLOR] | delete N | clear [all]"
+	if len(args) == 0 || args[0] == "list" {
+		if len(a.Rules) == 0 {
+			a.StatusMsg = "no conditional formats"
+			return
+		}
+		a.InfoText = a.rulesText()
+		return
+	}
+	switch args[0] {
+	case "delete", "del":
+		n := 0
+		if len(args) == 2 {
+			n, _ = strconv.Atoi(args[1])
+		}
+		if n < 1 || n > len(a.Rules) {
+			a.StatusMsg = "usage: :cf delete N (see :cf for the numbers)"
+			return
+		}
+		a.pushUndo()
+		a.Rules = slices.Delete(a.Rules, n-1, n)
+		return
+	case "clear":
+		if len(args) == 2 && args[1] == "all" {
+			a.pushUndo()
+			a.Rules = nil
+			return
+		}
+		a.pushUndo()
+		n := len(a.Rules)
+		a.Rules = slices.DeleteFunc(a.Rules, func(rule storage.Rule) bool { return a.touchesSelection(rule.Range) })
+		a.StatusMsg = fmt.Sprintf("deleted %d conditional format(s)", n-len(a.Rules))
+		return
+	}
+
+	var rule storage.Rule
+	switch {
+	case len(args) > 1 && a.isRangeRef(args[0]):
+		rule.Range, args = strings.ToUpper(args[0]), args[1:]
+	case a.Anchor != nil:
+		rule.Range = a.selectionText()
+	default:
+		rule.Range = grid.ColRowToName(a.CurCol, a.CurRow)
+	}
+	switch {
+	case args[0] == "scale" || args[0] == "bar":
+		rule.Kind = args[0]
+		rule.Style = strings.Join(args[1:], " ")
+		if rule.Style == "" {
+			rule.Style = defaultScale
+			if rule.Kind == "bar" {
+				rule.Style = defaultBar
+			}
+		}
+		if _, err := parseColors(rule.Style); err != nil {
+			a.StatusMsg = "cf: " + err.Error()
+			return
+		}
+	case slices.Contains(condOps, args[0]) && len(args) >= 3:
+		rule.Kind, rule.Op = "value", args[0]
+		rule.Value = strings.TrimPrefix(args[1], "=")
+		rule.Style = strings.Join(args[2:], " ")
+		if _, err := parseStyle(rule.Style); err != nil {
+			a.StatusMsg = "cf: " + err.Error()
+			return
+		}
+		value, err := a.condValue(rule.Value)
+		if err != nil {
+			a.StatusMsg = "cf: " + err.Error()
+			return
+		}
+		rule.Value = value
+	default:
+		a.StatusMsg = usage
+		return
+	}
+	a.pushUndo()
+	a.Rules = append(a.Rules, rule)
+	a.Anchor = nil
+	a.StatusMsg = "cf " + ruleText(rule)
+}
@@ -0,0 +1,133 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Config is the settings file read at startup, by default
+// $XDG_CONFIG_HOME/grider/config.json:
+//
+//	{
+//	  "set":  {"moveafterenter": false, "defaultwidth": 12, "theme": "light"},
+//	  "keys": {"<C-d>": "page-down", "J": "edge-down", "q": ""}
+//	}
+//
+// "set" takes the options of :set, "keys" binds key sequences to actions
+// (an empty action removes a binding).
+type Config struct {
+	Set  map[string]any    `json:"set"`
+	Keys map[string]string `json:"keys"`
+}
+
+// ConfigPath returns the default location of the config file.
+func ConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "grider", "config.json")
+}
+
+// LoadConfig reads and applies the config file at path. A missing file is
+// not an error.
+func (a *App) LoadConfig(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var cfg Config
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if err := a.ApplyConfig(cfg); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// ApplyConfig sets the options and key bindings of cfg. Invalid entries are
+// skipped and reported together.
+func (a *App) ApplyConfig(cfg Config) error {
+	var errs []error
+	for _, name := range sortedKeys(cfg.Set) {
+		errs = append(errs, a.SetOption(name, fmt.Sprint(cfg.Set[name])))
+	}
+	for _, keys := range sortedKeys(cfg.Keys) {
+		errs = append(errs, a.MapKey(keys, cfg.Keys[keys]))
+	}
+	return errors.Join(errs...)
+}
+
+// MapKey binds a key sequence such as "gg", "<C-d>" or "<A-Down>" (see
+// keyName) to a named action; an empty action removes the binding.
+func (a *App) MapKey(keys, name string) error {
+	if keys == "" {
+		return errors.New("empty key")
+	}
+	if name == "" {
+		delete(a.keymap, keys)
+		return nil
+	}
+	if _, ok := actions[name]; !ok {
+		return fmt.Errorf("unknown action %s for %s", name, keys)
+	}
+	a.keymap[keys] = name
+	return nil
+}
+
+// mapCommand handles ":map KEYS ACTION", ":unmap KEYS" and ":map" (list).
+func (a *App) mapCommand(cmd string, args []string) {
+	switch {
+	case cmd == "unmap" && len(args) == 1:
+		if err := a.MapKey(args[0], ""); err != nil {
+			a.StatusMsg = err.Error()
+		}
+	case cmd == "map" && len(args) == 2:
+		if err := a.MapKey(args[0], args[1]); err != nil {
+			a.StatusMsg = err.Error()
+		}
+	case cmd == "map" && len(args) == 0:
+		a.InfoText = a.keymapText()
+	default:
+		a.StatusMsg = "usage: :map KEYS ACTION | :unmap KEYS | :map"
+	}
+}
+
+func (a *App) keymapText() string {
+	keys := sortedKeys(a.keymap)
+	width := 0
+	for _, k := range keys {
+		width = maxInt(width, len(k))
+	}
+	var b strings.Builder
+	b.WriteString("Keys:\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%-*s  %s\n", width, k, a.keymap[k])
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
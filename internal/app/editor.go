@@ -0,0 +1,207 @@
+package app
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// LineEditor is the rune-aware text editor behind insert mode and
+// PopupInput. The text may contain '\n'; pos is the cursor in runes. The
+// cursor moves and deletes by grapheme clusters, so that a letter with
+// combining marks or a ZWJ emoji is never split.
+type LineEditor struct {
+	buf []rune
+	pos int
+}
+
+// String returns the edited text.
+func (e *LineEditor) String() string { return string(e.buf) }
+
+// Runes returns the edited text; the slice must not be modified.
+func (e *LineEditor) Runes() []rune { return e.buf }
+
+// Pos returns the cursor position in runes.
+func (e *LineEditor) Pos() int { return e.pos }
+
+// Len returns the length of the text in runes.
+func (e *LineEditor) Len() int { return len(e.buf) }
+
+// SetText replaces the text and puts the cursor at its end.
+func (e *LineEditor) SetText(text string) {
+	e.buf = []rune(text)
+	e.pos = len(e.buf)
+}
+
+// Set replaces the text and the cursor position.
+func (e *LineEditor) Set(buf []rune, pos int) {
+	e.buf = buf
+	e.pos = minInt(maxInt(pos, 0), len(buf))
+}
+
+// Insert inserts text at the cursor.
+func (e *LineEditor) Insert(text string) {
+	ins := []rune(text)
+	e.buf = append(e.buf[:e.pos], append(ins, e.buf[e.pos:]...)...)
+	e.pos += len(ins)
+}
+
+// Cursor returns the line and column (both in runes) of the cursor.
+func (e *LineEditor) Cursor() (line, col int) {
+	start := 0
+	for i := 0; i < e.pos; i++ {
+		if e.buf[i] == '\n' {
+			line++
+			start = i + 1
+		}
+	}
+	return line, e.pos - start
+}
+
+// HandleKey applies an editing key. It returns false for keys the editor
+// does not handle, e.g. Enter, Esc, or Up on the first line.
+func (e *LineEditor) HandleKey(ev *tcell.EventKey) bool {
+	word := ev.Modifiers()&(tcell.ModCtrl|tcell.ModAlt) != 0
+	switch ev.Key() {
+	case tcell.KeyLeft:
+		if word {
+			e.pos = e.wordLeft()
+		} else if e.pos > 0 {
+			e.pos = e.clusterStart(e.pos - 1)
+		}
+	case tcell.KeyRight:
+		if word {
+			e.pos = e.wordRight()
+		} else if e.pos < len(e.buf) {
+			e.pos = e.clusterEnd(e.pos)
+		}
+	case tcell.KeyHome, tcell.KeyCtrlA:
+		e.pos = e.lineStart(e.pos)
+	case tcell.KeyEnd, tcell.KeyCtrlE:
+		e.pos = e.lineEnd(e.pos)
+	case tcell.KeyUp:
+		start := e.lineStart(e.pos)
+		if start == 0 {
+			return false
+		}
+		prev := e.lineStart(start - 1)
+		e.pos = e.clusterStart(minInt(prev+(e.pos-start), start-1))
+	case tcell.KeyDown:
+		end := e.lineEnd(e.pos)
+		if end == len(e.buf) {
+			return false
+		}
+		next := end + 1
+		e.pos = e.clusterStart(minInt(next+(e.pos-e.lineStart(e.pos)), e.lineEnd(next)))
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if e.pos > 0 {
+			e.delete(e.clusterStart(e.pos-1), e.pos)
+		}
+	case tcell.KeyDelete:
+		if e.pos < len(e.buf) {
+			e.delete(e.pos, e.clusterEnd(e.pos))
+		}
+	case tcell.KeyCtrlW:
+		e.delete(e.wordLeft(), e.pos)
+	case tcell.KeyCtrlU:
+		e.delete(e.lineStart(e.pos), e.pos)
+	case tcell.KeyRune:
+		e.Insert(string(ev.Rune()))
+	default:
+		return false
+	}
+	return true
+}
+
+func (e *LineEditor) delete(from, to int) {
+	e.buf = append(e.buf[:from], e.buf[to:]...)
+	e.pos = from
+}
+
+// clusterStart is the start of the grapheme cluster holding rune i (i
+// itself at the end of the text).
+func (e *LineEditor) clusterStart(i int) int {
+	for _, cl := range runeClusters(e.buf) {
+		if i < cl.end {
+			return cl.start
+		}
+	}
+	return len(e.buf)
+}
+
+// clusterEnd is the end of the grapheme cluster holding rune i.
+func (e *LineEditor) clusterEnd(i int) int {
+	for _, cl := range runeClusters(e.buf) {
+		if i < cl.end {
+			return cl.end
+		}
+	}
+	return len(e.buf)
+}
+
+func (e *LineEditor) lineStart(pos int) int {
+	for pos > 0 && e.buf[pos-1] != '\n' {
+		pos--
+	}
+	return pos
+}
+
+func (e *LineEditor) lineEnd(pos int) int {
+	for pos < len(e.buf) && e.buf[pos] != '\n' {
+		pos++
+	}
+	return pos
+}
+
+// wordLeft is the start of the word before the cursor.
+func (e *LineEditor) wordLeft() int {
+	pos := e.pos
+	for pos > 0 && !isWordRune(e.buf[pos-1]) {
+		pos--
+	}
+	for pos > 0 && isWordRune(e.buf[pos-1]) {
+		pos--
+	}
+	return pos
+}
+
+// wordRight is the end of the word after the cursor.
+func (e *LineEditor) wordRight() int {
+	pos := e.pos
+	for pos < len(e.buf) && !isWordRune(e.buf[pos]) {
+		pos++
+	}
+	for pos < len(e.buf) && isWordRune(e.buf[pos]) {
+		pos++
+	}
+	return pos
+}
+
+// isWordRune reports whether r belongs to a word; combining marks do, so
+// that word motions stay on cluster boundaries.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r) || r == '_'
+}
+
+// visibleLines returns the part of the edited text that fits a width x
+// height box, scrolled so that the cursor stays inside, and the cursor
+// position within that box.
+func (e *LineEditor) visibleLines(width, height int) (lines []string, cx, cy int) {
+	line, col := e.Cursor()
+	all := strings.Split(e.String(), "\n")
+	top := maxInt(0, line-height+1)
+	// the scroll is in screen cells; the character under the cursor must
+	// fit whole
+	before, after := string([]rune(all[line])[:col]), string([]rune(all[line])[col:])
+	x, w := textWidth(before), 1
+	for _, cw := range graphemes(after) {
+		w = maxInt(w, cw)
+		break
+	}
+	left := maxInt(0, x+w-width)
+	for i := top; i < len(all) && i < top+height; i++ {
+		lines = append(lines, cutText(skipText(all[i], left), width))
+	}
+	return lines, x - left, line - top
+}
@@ -0,0 +1,348 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"sheet/internal/calc"
+	"sheet/internal/grid"
+)
+
+// nameSeries are the lists :fill continues by name, full names before
+// abbreviations so that May continues as a month.
+var nameSeries = [][]string{
+	{"Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday", "Sunday"},
+	{"Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"},
+	{"January", "February", "March", "April", "May", "June", "July",
+		"August", "September", "October", "November", "December"},
+	{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"},
+	{"понедельник", "вторник", "среда", "четверг", "пятница", "суббота", "воскресенье"},
+	{"пн", "вт", "ср", "чт", "пт", "сб", "вс"},
+	{"январь", "февраль", "март", "апрель", "май", "июнь", "июль",
+		"август", "сентябрь", "октябрь", "ноябрь", "декабрь"},
+	{"янв", "фев", "мар", "апр", "май", "июн", "июл", "авг", "сен", "окт", "ноя", "дек"},
+}
+
+// trailingNumber splits text like Item12 into Item and 12.
+var trailingNumber = regexp.MustCompile(`^(.*?)(\d+)$`)
+
+// constantStep returns the common difference of xs, or ok false when
+// there is none; a single value steps by one.
+func constantStep(xs []float64) (step float64, ok bool) {
+	if len(xs) == 1 {
+		return 1, true
+	}
+	step = xs[1] - xs[0]
+	for i := 2; i < len(xs); i++ {
+		if math.Abs(xs[i]-xs[i-1]-step) > 1e-9*math.Max(1, math.Abs(step)) {
+			return 0, false
+		}
+	}
+	return step, true
+}
+
+// decimals is the number of digits after the decimal point in a number
+// as typed.
+func decimals(s string) int {
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		return len(s) - i - 1
+	}
+	return 0
+}
+
+// series continues seeds by n values when they form a series: numbers
+// with a common difference (at least two of them), dates, day and month
+// names, or text ending in a number. It returns ok false otherwise, and
+// the seeds are then repeated.
+func series(seeds []string, n int) ([]string, bool) {
+	for _, s := range seeds {
+		if s == "" || strings.HasPrefix(s, "=") {
+			return nil, false
+		}
+	}
+	for _, next := range []func([]string, int) ([]string, bool){numberSeries, dateSeries, nameSeriesOf, textSeries} {
+		if out, ok := next(seeds, n); ok {
+			return out, true
+		}
+	}
+	return nil, false
+}
+
+func numberSeries(seeds []string, n int) ([]string, bool) {
+	if len(seeds) < 2 {
+		return nil, false
+	}
+	xs := make([]float64, len(seeds))
+	prec := 0
+	for i, s := range seeds {
+		x, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return nil, false
+		}
+		xs[i], prec = x, maxInt(prec, decimals(strings.TrimSpace(s)))
+	}
+	step, ok := constantStep(xs)
+	if !ok {
+		return nil, false
+	}
+	out := make([]string, n)
+	last := xs[len(xs)-1]
+	for i := range out {
+		out[i] = strconv.FormatFloat(last+float64(i+1)*step, 'f', prec, 64)
+	}
+	return out, true
+}
+
+// dateSeries continues dates by a common number of days, or of months when
+// the dates fall on the same day of the month; one date steps by a day.
+func dateSeries(seeds []string, n int) ([]string, bool) {
+	first, layout, ok := parseDate(seeds[0])
+	if !ok {
+		return nil, false
+	}
+	days := make([]float64, len(seeds))
+	months := make([]float64, len(seeds))
+	sameDay := true
+	for i, s := range seeds {
+		t, l, ok := parseDate(s)
+		if !ok || l != layout {
+			return nil, false
+		}
+		days[i] = float64(t.Unix() / 86400)
+		months[i] = float64(t.Year()*12 + int(t.Month()))
+		sameDay = sameDay && t.Day() == first.Day()
+	}
+	last, _, _ := parseDate(seeds[len(seeds)-1])
+	out := make([]string, n)
+	if step, ok := constantStep(months); ok && sameDay && len(seeds) > 1 && step != 0 {
+		for i := range out {
+			out[i] = last.AddDate(0, (i+1)*int(step), 0).Format(layout)
+		}
+		return out, true
+	}
+	step, ok := constantStep(days)
+	if !ok {
+		return nil, false
+	}
+	for i := range out {
+		out[i] = last.AddDate(0, 0, (i+1)*int(step)).Format(layout)
+	}
+	return out, true
+}
+
+// nameSeriesOf continues day or month names in the case of the first seed.
+func nameSeriesOf(seeds []string, n int) ([]string, bool) {
+	for _, names := range nameSeries {
+		idx := make([]float64, len(seeds))
+		found := true
+		for i, s := range seeds {
+			j := indexFold(names, strings.TrimSpace(s))
+			if j < 0 {
+				found = false
+				break
+			}
+			idx[i] = float64(j)
+			if i > 0 {
+				// wrap around: Sunday, Monday steps forward
+				for idx[i] < idx[i-1] {
+					idx[i] += float64(len(names))
+				}
+			}
+		}
+		if !found {
+			continue
+		}
+		step, ok := constantStep(idx)
+		if !ok {
+			return nil, false
+		}
+		out := make([]string, n)
+		last := int(idx[len(idx)-1])
+		for i := range out {
+			out[i] = matchCase(names[(last+(i+1)*int(step))%len(names)], seeds[0])
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+func indexFold(names []string, s string) int {
+	for i, name := range names {
+		if strings.EqualFold(name, s) {
+			return i
+		}
+	}
+	return -1
+}
+
+// matchCase writes name in the case of like: UPPER, Title or lower.
+func matchCase(name, like string) string {
+	like = strings.TrimSpace(like)
+	first, _ := utf8.DecodeRuneInString(like)
+	switch {
+	case like == strings.ToUpper(like) && utf8.RuneCountInString(like) > 1:
+		return strings.ToUpper(name)
+	case unicode.IsUpper(first):
+		r, size := utf8.DecodeRuneInString(name)
+		return string(unicode.ToUpper(r)) + strings.ToLower(name[size:])
+	default:
+		return strings.ToLower(name)
+	}
+}
+
+// textSeries continues text ending in a number (Item1, Item2), keeping
+// leading zeros.
+func textSeries(seeds []string, n int) ([]string, bool) {
+	m := trailingNumber.FindStringSubmatch(seeds[0])
+	if _, err := strconv.ParseFloat(seeds[0], 64); m == nil || m[1] == "" || err == nil {
+		return nil, false
+	}
+	prefix, width := m[1], 0
+	if strings.HasPrefix(m[2], "0") {
+		width = len(m[2])
+	}
+	xs := make([]float64, len(seeds))
+	for i, s := range seeds {
+		m := trailingNumber.FindStringSubmatch(s)
+		if m == nil || m[1] != prefix {
+			return nil, false
+		}
+		x, err := strconv.Atoi(m[2])
+		if err != nil {
+			return nil, false
+		}
+		xs[i] = float64(x)
+	}
+	step, ok := constantStep(xs)
+	if !ok {
+		return nil, false
+	}
+	out := make([]string, n)
+	last := int(xs[len(xs)-1])
+	for i := range out {
+		out[i] = prefix + fmt.Sprintf("%0*d", width, maxInt(0, last+(i+1)*int(step)))
+	}
+	return out, true
+}
+
+// fillLine fills the cells of one column (or row) of a :fill. The seed is
+// the filled cells at its start, or only the first cell when all are
+// filled; the rest continue the seed as a series or repeat it, formulas
+// with their references moved. It returns the number of cells written.
+func (a *App) fillLine(cells [][2]int) int {
+	k := 0
+	for k < len(cells) && a.Grid[cells[k]].Text != "" {
+		k++
+	}
+	switch k {
+	case 0:
+		return 0
+	case len(cells):
+		k = 1
+	}
+	seeds := make([]string, k)
+	for i := range seeds {
+		seeds[i] = a.Grid[cells[i]].Text
+	}
+	values, isSeries := series(seeds, len(cells)-k)
+	for j := k; j < len(cells); j++ {
+		src := cells[(j-k)%k]
+		if isSeries {
+			src = cells[k-1]
+		}
+		text := a.Grid[src].Text
+		switch {
+		case isSeries:
+			text = values[j-k]
+		case strings.HasPrefix(text, "="):
+			text = calc.OffsetRefs(text, cells[j][0]-src[0], cells[j][1]-src[1])
+		}
+		cell := a.Grid[cells[j]]
+		cell.Text, cell.Format = text, a.Grid[src].Format
+		if bareCell(cell) {
+			delete(a.Grid, cells[j])
+		} else {
+			a.Grid[cells[j]] = cell
+		}
+	}
+	return len(cells) - k
+}
+
+// fillCommand handles :fill down and :fill right over the selection: each
+// column (or row) continues the values at its top (or left), as a series
+// when they form one (1, 2 -> 3, 4; Mon -> Tue; Item1 -> Item2; dates)
+// and as copies otherwise, formulas with their relative references moved.
+// Without a selection the current cell is filled from the cell above (or
+// to the left).
+func (a *App) fillCommand(args []string) {
+	const usage = "usage: :fill down|right"
+	if len(args) != 1 {
+		a.StatusMsg = usage
+		return
+	}
+	var down bool
+	switch args[0] {
+	case "down", "d":
+		down = true
+	case "right", "r":
+	default:
+		a.StatusMsg = usage
+		return
+	}
+	r1, c1, r2, c2, ok := a.selection()
+	if !ok {
+		r1, c1, r2, c2 = a.CurRow, a.CurCol, a.CurRow, a.CurCol
+		if down {
+			r1--
+		} else {
+			c1--
+		}
+		if r1 < 0 || c1 < 0 {
+			a.StatusMsg = "fill: nothing to fill from"
+			return
+		}
+	}
+	if (down && r1 == r2) || (!down && c1 == c2) {
+		a.StatusMsg = "fill: select the cells to fill, starting with the values to continue"
+		return
+	}
+	if a.mergedIn(r1, c1, r2, c2) {
+		a.StatusMsg = "fill: the range has merged cells"
+		return
+	}
+
+	a.pushUndo()
+	n := 0
+	if down {
+		for c := c1; c <= c2; c++ {
+			var cells [][2]int
+			for r := r1; r <= r2; r++ {
+				cells = append(cells, [2]int{r, c})
+			}
+			n += a.fillLine(cells)
+		}
+	} else {
+		for r := r1; r <= r2; r++ {
+			var cells [][2]int
+			for c := c1; c <= c2; c++ {
+				cells = append(cells, [2]int{r, c})
+			}
+			n += a.fillLine(cells)
+		}
+	}
+	if n == 0 {
+		a.dropUndo()
+		a.StatusMsg = "fill: nothing to fill from"
+		return
+	}
+	a.EnsureRowExists(r2)
+	a.EnsureColExists(c2)
+	a.Anchor = nil
+	a.StatusMsg = fmt.Sprintf("filled %d cell(s) in %s:%s", n,
+		grid.ColRowToName(c1, r1), grid.ColRowToName(c2, r2))
+}
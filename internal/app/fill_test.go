@@ -0,0 +1,78 @@
+package app
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSeries(t *testing.T) {
+	tests := []struct {
+		seeds string // comma separated
+		n     int
+		want  string // comma separated, empty when not a series
+	}{
+		// numbers
+		{"1,3", 2, "5,7"},
+		{"0.1,0.2", 1, "0.3"},
+		{"10,7", 2, "4,1"},
+		{"1,2,4", 1, ""},
+		{"5", 2, ""},
+		{"-3", 1, ""},
+
+		// text ending in a number, leading zeros kept
+		{"Item1", 2, "Item2,Item3"},
+		{"Item09", 1, "Item10"},
+		{"Item008,Item010", 1, "Item012"},
+		{"Item1,Row2", 1, ""},
+
+		// day and month names, wrapping around, in the case of the first seed
+		{"Sat,Sun", 1, "Mon"},
+		{"Sun", 1, "Mon"},
+		{"Friday,Sunday", 2, "Tuesday,Thursday"},
+		{"JANUARY", 1, "FEBRUARY"},
+		{"dec", 1, "jan"},
+		{"May", 1, "June"},
+		{"Mar", 1, "Apr"},
+		{"пн", 1, "вт"},
+		{"Декабрь", 1, "Январь"},
+
+		// dates: by months on the same day of the month, else by days
+		{"2024-01-15,2024-02-15", 2, "2024-03-15,2024-04-15"},
+		{"2024-01-31,2024-02-29", 1, "2024-03-29"},
+		{"2024-01-01,2024-01-08", 1, "2024-01-15"},
+		{"31.12.2024", 1, "01.01.2025"},
+		{"2024-01-15,15.02.2024", 1, ""},
+
+		// formulas and blanks are never a series
+		{"=A1,=A2", 1, ""},
+		{"1,", 1, ""},
+	}
+	for _, tt := range tests {
+		got, ok := series(strings.Split(tt.seeds, ","), tt.n)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("series(%s) = %v, want no series", tt.seeds, got)
+			}
+			continue
+		}
+		if want := strings.Split(tt.want, ","); !ok || !slices.Equal(got, want) {
+			t.Errorf("series(%s) = %v, %v, want %v", tt.seeds, got, ok, want)
+		}
+	}
+}
+
+func TestMatchCase(t *testing.T) {
+	tests := []struct{ name, like, want string }{
+		{"Tuesday", "MONDAY", "TUESDAY"},
+		{"Tuesday", "Monday", "Tuesday"},
+		{"Tuesday", "monday", "tuesday"},
+		{"june", "M", "June"},
+		{"вторник", "ПН", "ВТОРНИК"},
+	}
+	for _, tt := range tests {
+		if got := matchCase(tt.name, tt.like); got != tt.want {
+			t.Errorf("matchCase(%q, %q) = %q, want %q", tt.name, tt.like, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package app
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+
+	"sheet/internal/calc"
+	"sheet/internal/grid"
+)
+
+// filterState is the autofilter toggled with :filter: columns c1..c2 of a
+// header row get criteria, and data rows below it that fail any of them are
+// hidden. Like in desktop spreadsheets the rows are chosen when a filter is
+// applied; later edits do not hide or show rows until :filter apply.
+type filterState struct {
+	header int               // header row; the data starts below it
+	c1, c2 int               // filtered columns
+	end    int               // first row after the data at the last apply
+	cols   map[int]colFilter // criteria by column
+	hidden map[int]bool      // rows hidden by the last apply
+}
+
+// colFilter holds the criteria of one column; a row must pass all of them.
+type colFilter struct {
+	values map[string]bool // displayed values ticked in the checklist, nil for all
+	cond   *criterion      // :filter >10, :filter =ab*
+	top    int             // top N numbers, bottom N when negative, 0 for all
+}
+
+func (cf colFilter) empty() bool {
+	return cf.values == nil && cf.cond == nil && cf.top == 0
+}
+
+func (f *filterState) clone() *filterState {
+	if f == nil {
+		return nil
+	}
+	c := *f
+	c.cols = maps.Clone(f.cols)
+	c.hidden = maps.Clone(f.hidden)
+	return &c
+}
+
+// active reports whether any column has criteria.
+func (f *filterState) active() bool {
+	for _, cf := range f.cols {
+		if !cf.empty() {
+			return true
+		}
+	}
+	return false
+}
+
+// filteredOut reports whether row r is hidden by the filter.
+func (a *App) filteredOut(r int) bool {
+	return a.filter != nil && a.filter.hidden[r]
+}
+
+// filtered reports whether row r is a data row of an active filter; their
+// numbers are drawn in another colour.
+func (a *App) filtered(r int) bool {
+	f := a.filter
+	return f != nil && r > f.header && r < f.end && f.active()
+}
+
+// criterion is a condition like in COUNTIF: an optional operator (=, <>,
+// <, <=, >, >=; = by default) and a number or text. Text compares without
+// case, and = or <> with text accept the wildcards * and ?. "=" alone
+// matches empty cells, "<>" alone matches filled ones.
+type criterion struct {
+	op    string
+	text  string
+	num   float64
+	isNum bool
+	re    *regexp.Regexp
+}
+
+func parseCriterion(s string) *criterion {
+	c := &criterion{op: "="}
+	for _, op := range []string{"<=", ">=", "<>", "=", "<", ">"} {
+		if strings.HasPrefix(s, op) {
+			c.op, s = op, s[len(op):]
+			break
+		}
+	}
+	c.text = strings.TrimSpace(s)
+	if n, err := strconv.ParseFloat(c.text, 64); err == nil {
+		c.num, c.isNum = n, true
+		return c
+	}
+	if c.op == "=" || c.op == "<>" {
+		pat := regexp.QuoteMeta(c.text)
+		pat = strings.ReplaceAll(pat, `\*`, ".*")
+		pat = strings.ReplaceAll(pat, `\?`, ".")
+		c.re = regexp.MustCompile("(?is)^" + pat + "$")
+	}
+	return c
+}
+
+// match tests a cell value and its displayed text.
+func (c *criterion) match(v calc.Value, text string) bool {
+	if c.isNum {
+		if v.Kind != calc.KindNumber {
+			return c.op == "<>"
+		}
+		return compareOp(c.op, cmpFloat(v.Num, c.num))
+	}
+	switch {
+	case c.op == "=" && c.text == "":
+		return text == ""
+	case c.op == "<>" && c.text == "":
+		return text != ""
+	case c.re != nil:
+		return c.re.MatchString(text) == (c.op == "=")
+	case v.Kind != calc.KindText:
+		return false
+	}
+	return compareOp(c.op, strings.Compare(strings.ToLower(text), strings.ToLower(c.text)))
+}
+
+func cmpFloat(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// compareOp applies a comparison operator to the result of a compare.
+func compareOp(op string, c int) bool {
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	case "<>":
+		return c != 0
+	}
+	return c == 0
+}
+
+// filterCommand handles :filter and its forms:
+//
+//	:filter            turn the filter on for the header row at the cursor, or off
+//	:filter >10        keep rows whose value in the cursor column matches
+//	:filter top 5      keep the 5 largest numbers (bottom 5 for the smallest)
+//	:filter clear      drop the criteria of the cursor column (clear all: every column)
+//	:filter apply      filter again after the data changed
+func (a *App) filterCommand(args []string) {
+	if len(args) == 0 {
+		a.pushUndo()
+		if a.filter != nil {
+			a.filter = nil
+			a.StatusMsg = "filter off"
+			return
+		}
+		a.startFilter()
+		return
+	}
+	if a.filter == nil {
+		a.StatusMsg = "filter: no filter, turn it on with :filter on the header row"
+		return
+	}
+	f := a.filter
+	if args[0] == "apply" {
+		a.pushUndo()
+		a.applyFilter()
+		return
+	}
+	if args[0] == "clear" && len(args) == 2 && args[1] == "all" {
+		a.pushUndo()
+		f.cols = map[int]colFilter{}
+		a.applyFilter()
+		return
+	}
+	if a.CurCol < f.c1 || a.CurCol > f.c2 {
+		a.StatusMsg = fmt.Sprintf("filter: column %s is not filtered", grid.ColToName(a.CurCol))
+		return
+	}
+	cf := f.cols[a.CurCol]
+	switch args[0] {
+	case "clear":
+		cf = colFilter{}
+	case "top", "bottom":
+		n := 10
+		if len(args) > 1 {
+			var err error
+			if n, err = strconv.Atoi(args[1]); err != nil || n < 1 {
+				a.StatusMsg = "filter: bad count " + args[1]
+				return
+			}
+		}
+		if args[0] == "bottom" {
+			n = -n
+		}
+		cf.top = n
+	default:
+		cf.cond = parseCriterion(strings.Join(args, " "))
+	}
+	a.pushUndo()
+	f.cols[a.CurCol] = cf
+	a.applyFilter()
+}
+
+// startFilter puts filter buttons on the header row: the top row of the
+// selection, or the cursor row with the block of filled cells around the
+// cursor.
+func (a *App) startFilter() {
+	r1, c1, _, c2, ok := a.selection()
+	if !ok {
+		r1, c1, c2 = a.CurRow, a.CurCol, a.CurCol
+		for c1 > 0 && a.filled(r1, c1-1) {
+			c1--
+		}
+		for a.filled(r1, c2+1) {
+			c2++
+		}
+	}
+	a.filter = &filterState{header: r1, c1: c1, c2: c2, cols: map[int]colFilter{}}
+	a.Anchor = nil
+	a.applyFilter()
+	a.StatusMsg = fmt.Sprintf("filter on %s:%s, F6 picks values",
+		grid.ColRowToName(c1, r1), grid.ColRowToName(c2, r1))
+}
+
+// applyFilter hides the data rows that fail a criterion and moves the
+// cursor off hidden rows. The data ends at the first row that is empty in
+// all filtered columns, so totals below a blank row stay visible.
+func (a *App) applyFilter() {
+	f := a.filter
+	f.end = f.header + 1
+	for a.rowFilled(f.end, f.c1, f.c2) {
+		f.end++
+	}
+	f.hidden = map[int]bool{}
+	a.withEvalCache(func() {
+		for c, cf := range f.cols {
+			limit, hasLimit := a.topLimit(c, cf.top)
+			for r := f.header + 1; r < f.end; r++ {
+				v := a.cellValue(r, c, map[[2]int]bool{}).First()
+				text := formatValue(v)
+				keep := cf.values == nil || cf.values[text]
+				if keep && cf.cond != nil {
+					keep = cf.cond.match(v, text)
+				}
+				if keep && cf.top != 0 {
+					keep = v.Kind == calc.KindNumber && hasLimit &&
+						(cf.top > 0 && v.Num >= limit || cf.top < 0 && v.Num <= limit)
+				}
+				if !keep {
+					f.hidden[r] = true
+				}
+			}
+		}
+	})
+	a.CurRow = a.visibleRow(a.CurRow, 1)
+	a.StatusMsg = fmt.Sprintf("filter: %d of %d rows shown", f.end-f.header-1-len(f.hidden), f.end-f.header-1)
+}
+
+// rowFilled reports whether any cell of row r in columns c1..c2 has text.
+func (a *App) rowFilled(r, c1, c2 int) bool {
+	for c := c1; c <= c2; c++ {
+		if a.filled(r, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// topLimit returns the smallest number among the top n numbers of column c
+// in the filtered rows (the largest among the bottom -n when n < 0).
+func (a *App) topLimit(c, n int) (float64, bool) {
+	if n == 0 {
+		return 0, false
+	}
+	var nums []float64
+	for r := a.filter.header + 1; r < a.filter.end; r++ {
+		if v := a.cellValue(r, c, map[[2]int]bool{}).First(); v.Kind == calc.KindNumber {
+			nums = append(nums, v.Num)
+		}
+	}
+	if len(nums) == 0 {
+		return 0, false
+	}
+	sort.Float64s(nums)
+	if n > 0 {
+		return nums[maxInt(0, len(nums)-n)], true
+	}
+	return nums[minInt(len(nums), -n)-1], true
+}
+
+// filterValues shows the distinct values of the cursor column as a
+// checklist; rows with unticked values are hidden.
+func (a *App) filterValues(s tcell.Screen) {
+	f := a.filter
+	if f == nil || a.CurCol < f.c1 || a.CurCol > f.c2 {
+		a.StatusMsg = "filter: the cursor column is not filtered (see :filter)"
+		return
+	}
+	c := a.CurCol
+	seen := map[string]bool{}
+	var values []string
+	a.withEvalCache(func() {
+		for r := f.header + 1; r < f.end || a.rowFilled(r, f.c1, f.c2); r++ {
+			text := formatValue(a.cellValue(r, c, map[[2]int]bool{}))
+			if !seen[text] {
+				seen[text] = true
+				values = append(values, text)
+			}
+		}
+	})
+	// blanks go last, like in :sort
+	sort.Slice(values, func(i, j int) bool {
+		if values[i] == "" || values[j] == "" {
+			return values[j] == ""
+		}
+		return naturalCompare(values[i], values[j]) < 0
+	})
+	if len(values) == 0 {
+		a.StatusMsg = "filter: no data below the header"
+		return
+	}
+	cf := f.cols[c]
+	labels := make([]string, len(values))
+	checked := make([]bool, len(values))
+	for i, v := range values {
+		labels[i] = v
+		if v == "" {
+			labels[i] = "(blank)"
+		}
+		checked[i] = cf.values == nil || cf.values[v]
+	}
+	title := "Filter " + a.GetDisplayText(f.header, c)
+	if !a.PopupChecklist(s, title, labels, checked) {
+		return
+	}
+	cf.values = map[string]bool{}
+	for i, v := range values {
+		if checked[i] {
+			cf.values[v] = true
+		}
+	}
+	if len(cf.values) == len(values) {
+		cf.values = nil
+	}
+	a.pushUndo()
+	f.cols[c] = cf
+	a.applyFilter()
+	a.EnsureCursorVisible(s)
+}
+
+// shiftFilterRows keeps the filter on the same data when n rows are
+// inserted (n > 0) or deleted (n < 0) at idx.
+func (a *App) shiftFilterRows(idx, n int) {
+	f := a.filter
+	if f == nil {
+		return
+	}
+	if n < 0 && f.header == idx {
+		a.filter = nil
+		return
+	}
+	f.header = shiftIndex(f.header, idx, n)
+	f.end = shiftIndex(f.end, idx, n)
+	f.hidden = shiftKeys(f.hidden, idx, n)
+}
+
+// shiftFilterCols is shiftFilterRows for columns.
+func (a *App) shiftFilterCols(idx, n int) {
+	f := a.filter
+	if f == nil {
+		return
+	}
+	if n < 0 && f.c1 == f.c2 && f.c1 == idx {
+		a.filter = nil
+		return
+	}
+	switch {
+	case idx < f.c1 || (n > 0 && idx == f.c1):
+		f.c1, f.c2 = f.c1+n, f.c2+n
+	case idx <= f.c2:
+		f.c2 += n
+	}
+	f.cols = shiftKeys(f.cols, idx, n)
+}
+
+// shiftIndex moves a row or column index at or after idx by n.
+func shiftIndex(i, idx, n int) int {
+	if i > idx || (i == idx && n > 0) {
+		return i + n
+	}
+	return i
+}
+
+// filterButton returns the mark drawn in the last column of a filtered
+// header cell: an outlined triangle, or a filled one when the column has
+// criteria.
+func (a *App) filterButton(r, c int, base tcell.Style) (rune, tcell.Style, bool) {
+	f := a.filter
+	if f == nil || r != f.header || c < f.c1 || c > f.c2 {
+		return 0, base, false
+	}
+	if f.cols[c].empty() {
+		return '▽', base, true
+	}
+	return '▼', a.overlay(base, "filter-button"), true
+}
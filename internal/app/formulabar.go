@@ -0,0 +1,179 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+
+	"sheet/internal/calc"
+	"sheet/internal/grid"
+)
+
+// maxBarLines bounds the height of the expanded formula bar.
+const maxBarLines = 8
+
+// newlineMark stands for a line break in the one-line formula bar.
+const newlineMark = '↵'
+
+// barLayout is the formula bar laid out for a screen width: the name of the
+// current cell, its raw text split into rows of clusters and a description
+// of its content and format on the right.
+type barLayout struct {
+	name     string
+	info     string
+	buf      []rune
+	clusters []runeCluster
+	rows     [][2]int // cluster ranges [from, to) of the shown rows
+	cut      bool     // text left out after the last row
+	textX    int
+	textW    int
+}
+
+// gridTop is the screen row of the column headers, below the formula bar.
+func (a *App) gridTop() int {
+	if !a.FormulaBar {
+		return 0
+	}
+	if !a.barExpanded {
+		return 1
+	}
+	return len(a.formulaBar(a.barWidth).rows)
+}
+
+// shownText is the text drawn in cell r, c: its value, or with :set
+// showformulas the formula itself.
+func (a *App) shownText(r, c int) string {
+	if text := a.Grid[[2]int{r, c}].Text; a.ShowFormulas && strings.HasPrefix(text, "=") {
+		return text
+	}
+	return a.GetDisplayText(r, c)
+}
+
+// kindName describes the type of a value for the formula bar.
+func kindName(v calc.Value) string {
+	switch v.Kind {
+	case calc.KindNumber:
+		return "number"
+	case calc.KindText:
+		return "text"
+	case calc.KindError:
+		return "error"
+	case calc.KindArray:
+		return fmt.Sprintf("array %dx%d", v.Rows, v.Cols)
+	}
+	return "empty"
+}
+
+// cellInfo describes the content of cell r, c: its type, whether it is a
+// formula or spilled from one, its format and merged block.
+func (a *App) cellInfo(r, c int) string {
+	cell := a.Grid[[2]int{r, c}]
+	var parts []string
+	a.withEvalCache(func() {
+		switch {
+		case strings.HasPrefix(cell.Text, "="):
+			parts = append(parts, "formula: "+kindName(a.cellValue(r, c, map[[2]int]bool{})))
+		case cell.Text != "":
+			parts = append(parts, kindName(calc.LiteralValue(cell.Text)))
+		default:
+			if k, v, ok := a.spillSource(r, c, map[[2]int]bool{}); ok {
+				parts = append(parts, kindName(v)+" from "+grid.ColRowToName(k[1], k[0]))
+			} else {
+				parts = append(parts, "empty")
+			}
+		}
+	})
+	if len(cell.Format) > 0 {
+		var format []string
+		for key, value := range cell.Format {
+			format = append(format, key+"="+value)
+		}
+		sort.Strings(format)
+		parts = append(parts, strings.Join(format, " "))
+	}
+	if r1, c1, r2, c2, ok := a.mergeAt(r, c); ok {
+		parts = append(parts, "merged "+grid.ColRowToName(c1, r1)+":"+grid.ColRowToName(c2, r2))
+	}
+	return strings.Join(parts, " · ")
+}
+
+// formulaBar lays out the bar for a screen w cells wide. The text takes one
+// row, cut with an ellipsis, unless the bar is expanded: then it wraps, up
+// to maxBarLines rows.
+func (a *App) formulaBar(w int) barLayout {
+	r, c := a.blockStart(a.CurRow, a.CurCol)
+	l := barLayout{name: grid.ColRowToName(c, r), info: a.cellInfo(r, c)}
+	l.textX = maxInt(a.LeftGutter, textWidth(l.name)+1) + 1
+	l.textW = w - l.textX - textWidth(l.info) - 2
+	if l.textW < 10 {
+		l.info, l.textW = "", w-l.textX
+	}
+	l.textW = maxInt(1, l.textW)
+
+	text := a.Grid[[2]int{r, c}].Text
+	if !a.barExpanded {
+		text = strings.ReplaceAll(text, "\n", string(newlineMark))
+	}
+	l.buf = []rune(text)
+	l.clusters = runeClusters(l.buf)
+	from, used := 0, 0
+	for i, cl := range l.clusters {
+		newline := l.buf[cl.start] == '\n'
+		if !newline && used+cl.width <= l.textW {
+			used += cl.width
+			continue
+		}
+		if !a.barExpanded || len(l.rows) == maxBarLines-1 {
+			l.cut = true
+			break
+		}
+		l.rows = append(l.rows, [2]int{from, i})
+		from, used = i, cl.width
+		if newline {
+			from, used = i+1, 0
+		}
+	}
+	to := len(l.clusters)
+	if l.cut {
+		// the last row ends with an ellipsis
+		to, used = from, 0
+		for to < len(l.clusters) && l.buf[l.clusters[to].start] != '\n' && used+l.clusters[to].width < l.textW {
+			used += l.clusters[to].width
+			to++
+		}
+	}
+	l.rows = append(l.rows, [2]int{from, to})
+	return l
+}
+
+// drawFormulaBar draws the bar above the column headers: the name of the
+// current cell, its raw text (formulas highlighted) and what it holds.
+func (a *App) drawFormulaBar(s tcell.Screen, w int) {
+	a.barWidth = w
+	l := a.formulaBar(w)
+	base := a.style("formulabar")
+	for y := range l.rows {
+		for x := 0; x < w; x++ {
+			s.SetContent(x, y, ' ', nil, base)
+		}
+	}
+	a.printTextFixedWidth(s, 0, 0, l.name, a.style("header-active"), l.textX-1)
+	styles := a.formulaStyles(l.buf, base)
+	for y, row := range l.rows {
+		x := l.textX
+		for _, cl := range l.clusters[row[0]:row[1]] {
+			if cl.width > 0 {
+				s.SetContent(x, y, l.buf[cl.start], l.buf[cl.start+1:cl.end], styles[cl.start])
+			}
+			x += cl.width
+		}
+		if l.cut && y == len(l.rows)-1 {
+			s.SetContent(x, y, ellipsis, nil, base)
+		}
+	}
+	if l.info != "" {
+		putText(s, w-textWidth(l.info)-1, 0, l.info, a.overlay(base, "formulabar-info"), w)
+	}
+}
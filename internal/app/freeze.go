@@ -0,0 +1,126 @@
+package app
+
+import (
+	"fmt"
+	"iter"
+	"strconv"
+	"strings"
+
+	"sheet/internal/grid"
+)
+
+// displayRows yields the rows in the order they are drawn: the frozen rows,
+// then the scrolling rows from ViewRow on. Hidden rows are skipped.
+func (a *App) displayRows() iter.Seq[int] {
+	return func(yield func(int) bool) {
+		for r := 0; r < len(a.RowHeights); r++ {
+			if r == a.FrozenRows {
+				r = maxInt(r, a.ViewRow)
+			}
+			if r < len(a.RowHeights) && !a.rowHidden(r) && !yield(r) {
+				return
+			}
+		}
+	}
+}
+
+// displayCols yields the columns in the order they are drawn: the frozen
+// columns, then the scrolling columns from ViewCol on. Hidden columns are
+// skipped.
+func (a *App) displayCols() iter.Seq[int] {
+	return func(yield func(int) bool) {
+		for c := 0; c < len(a.ColWidths); c++ {
+			if c == a.FrozenCols {
+				c = maxInt(c, a.ViewCol)
+			}
+			if c < len(a.ColWidths) && !a.colHidden(c) && !yield(c) {
+				return
+			}
+		}
+	}
+}
+
+// frozenSize returns the height of the frozen rows and the width of the
+// frozen columns.
+func (a *App) frozenSize() (height, width int) {
+	for r := 0; r < a.FrozenRows && r < len(a.RowHeights); r++ {
+		if !a.rowHidden(r) {
+			height += a.rowSpan(r)
+		}
+	}
+	for c := 0; c < a.FrozenCols && c < len(a.ColWidths); c++ {
+		if !a.colHidden(c) {
+			width += a.colSpan(c)
+		}
+	}
+	return height, width
+}
+
+// cellOrigin returns the screen position of the top-left corner of cell
+// row, col, or ok false when it is not drawn.
+func (a *App) cellOrigin(row, col int) (x, y int, ok bool) {
+	x, y = a.LeftGutter, a.gridTop()+1
+	found := false
+	for c := range a.displayCols() {
+		if c == col {
+			found = true
+			break
+		}
+		x += a.colSpan(c)
+	}
+	if !found {
+		return 0, 0, false
+	}
+	for r := range a.displayRows() {
+		if r == row {
+			return x, y, true
+		}
+		y += a.rowSpan(r)
+	}
+	return 0, 0, false
+}
+
+// freezeCommand handles :freeze (rows above and columns left of the
+// cursor), :freeze rows=N cols=M (a missing count is 0) and :unfreeze.
+func (a *App) freezeCommand(cmd string, args []string) {
+	rows, cols := a.CurRow, a.CurCol
+	if cmd == "unfreeze" {
+		rows, cols = 0, 0
+	} else if len(args) > 0 {
+		rows, cols = 0, 0
+		for _, arg := range args {
+			key, value, _ := strings.Cut(arg, "=")
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				a.StatusMsg = "usage: :freeze [rows=N] [cols=N] | :unfreeze"
+				return
+			}
+			switch key {
+			case "rows":
+				rows = n
+			case "cols":
+				cols = n
+			default:
+				a.StatusMsg = "usage: :freeze [rows=N] [cols=N] | :unfreeze"
+				return
+			}
+		}
+	}
+	// freezing is limited to the used sheet, one row or column past it at
+	// most
+	if rows > len(a.RowHeights) || cols > len(a.ColWidths) {
+		a.StatusMsg = fmt.Sprintf("freeze: the sheet has %d row(s) and %d column(s)",
+			len(a.RowHeights), len(a.ColWidths))
+		return
+	}
+	a.FrozenRows, a.FrozenCols = rows, cols
+	a.EnsureRowExists(rows)
+	a.EnsureColExists(cols)
+	a.ViewRow, a.ViewCol = maxInt(a.ViewRow, rows), maxInt(a.ViewCol, cols)
+	if rows == 0 && cols == 0 {
+		a.StatusMsg = "panes unfrozen"
+		return
+	}
+	a.StatusMsg = fmt.Sprintf("frozen %d row(s) and %d column(s), scrolling from %s",
+		rows, cols, grid.ColRowToName(cols, rows))
+}
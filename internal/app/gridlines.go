@@ -0,0 +1,289 @@
+package app
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+
+	"sheet/internal/grid"
+)
+
+// Cell borders are kept in the cell format under these keys, with the
+// values single, double or thick.
+var borderSides = []string{"top", "bottom", "left", "right"}
+
+// borderLines are the horizontal and vertical runes of each border style;
+// the empty style is the gridline.
+var borderLines = map[string][2]rune{
+	"":       {'─', '│'},
+	"single": {'─', '│'},
+	"double": {'═', '║'},
+	"thick":  {'━', '┃'},
+}
+
+// borderJoins are the runes where lines meet, indexed by the arms present:
+// 1 up, 2 down, 4 left, 8 right.
+var borderJoins = map[string][16]rune{
+	"single": {' ', '│', '│', '│', '─', '┘', '┐', '┤', '─', '└', '┌', '├', '─', '┴', '┬', '┼'},
+	"double": {' ', '║', '║', '║', '═', '╝', '╗', '╣', '═', '╚', '╔', '╠', '═', '╩', '╦', '╬'},
+	"thick":  {' ', '┃', '┃', '┃', '━', '┛', '┓', '┫', '━', '┗', '┏', '┣', '━', '┻', '┳', '╋'},
+}
+
+// borderWeight orders the styles when two borders meet.
+var borderWeight = map[string]int{"": 0, "single": 1, "double": 2, "thick": 3}
+
+// sep is the room taken by the gridline after each column and below each
+// row: 1 with :set gridlines, else 0.
+func (a *App) sep() int {
+	if a.Gridlines {
+		return 1
+	}
+	return 0
+}
+
+// colSpan is the screen width of column c with its gridline.
+func (a *App) colSpan(c int) int { return a.ColWidths[c] + a.sep() }
+
+// rowSpan is the screen height of row r with its gridline.
+func (a *App) rowSpan(r int) int { return a.RowHeights[r] + a.sep() }
+
+// border returns the style of one side of cell r, c, "" if it has none.
+func (a *App) border(r, c int, side string) string {
+	if r < 0 || c < 0 {
+		return ""
+	}
+	return a.Grid[[2]int{r, c}].Format["border-"+side]
+}
+
+// heavier returns the heavier of two border styles.
+func heavier(x, y string) string {
+	if borderWeight[y] > borderWeight[x] {
+		return y
+	}
+	return x
+}
+
+// edgeRight is the border between cells r, c and r, c+1, edgeBelow the one
+// between r, c and r+1, c.
+func (a *App) edgeRight(r, c int) string {
+	return heavier(a.border(r, c, "right"), a.border(r, c+1, "left"))
+}
+
+func (a *App) edgeBelow(r, c int) string {
+	return heavier(a.border(r, c, "bottom"), a.border(r+1, c, "top"))
+}
+
+// lineStyle is the style of a line with border style b.
+func (a *App) lineStyle(b string) tcell.Style {
+	if b == "" {
+		return a.style("gridline")
+	}
+	return a.style("border")
+}
+
+// join returns the rune where the lines at the bottom-right corner of cell
+// r, c meet, and its style. There is no line between the cells of a merged
+// block.
+func (a *App) join(r, c int) (rune, tcell.Style) {
+	// arms: up, down, left, right
+	arms := [4]string{a.edgeRight(r, c), a.edgeRight(r+1, c), a.edgeBelow(r, c), a.edgeBelow(r, c+1)}
+	open := [4]bool{
+		!a.sameBlock(r, c, r, c+1), !a.sameBlock(r+1, c, r+1, c+1),
+		!a.sameBlock(r, c, r+1, c), !a.sameBlock(r, c+1, r+1, c+1),
+	}
+	style := ""
+	for i, b := range arms {
+		if open[i] {
+			style = heavier(style, b)
+		}
+	}
+	mask := 0
+	for i, b := range arms {
+		if open[i] && (style == "" || b != "") {
+			mask |= 1 << i
+		}
+	}
+	runes, ok := borderJoins[style]
+	if !ok {
+		runes = borderJoins["single"]
+	}
+	return runes[mask], a.lineStyle(style)
+}
+
+// drawEdges draws the lines around cell r, c at x, y of size wc x hh; for
+// a merged block r, c is its first shown cell and wc x hh the size of the
+// block.
+//
+// With gridlines the right and bottom lines go in the gridline space after
+// the cell, with its borders drawn over them. Without gridlines the borders
+// take the edge characters of the cell: the first and last column for left
+// and right, and an underline of the last line for bottom (and the top of
+// the cell below).
+func (a *App) drawEdges(s tcell.Screen, r, c, x, y, wc, hh int, base tcell.Style) {
+	w, h := s.Size()
+	put := func(x, y int, ch rune, st tcell.Style) {
+		if x >= 0 && y >= 0 && x < w && y < h {
+			s.SetContent(x, y, ch, nil, st)
+		}
+	}
+	// the shown rows and columns of the cell with their offsets in it
+	type part struct{ i, off, size int }
+	r2, c2 := a.blockEnd(r, c)
+	var rows, cols []part
+	for rr, off := r, 0; rr <= r2 && rr < len(a.RowHeights); rr++ {
+		if !a.rowHidden(rr) {
+			rows = append(rows, part{rr, off, a.RowHeights[rr]})
+			off += a.rowSpan(rr)
+		}
+	}
+	for cc, off := c, 0; cc <= c2 && cc < len(a.ColWidths); cc++ {
+		if !a.colHidden(cc) {
+			cols = append(cols, part{cc, off, a.ColWidths[cc]})
+			off += a.colSpan(cc)
+		}
+	}
+
+	if !a.Gridlines {
+		for _, p := range rows {
+			left, right := a.border(p.i, c, "left"), a.border(p.i, c2, "right")
+			for dy := p.off; dy < p.off+p.size; dy++ {
+				if left != "" {
+					put(x, y+dy, borderLines[left][1], a.overlay(base, "border"))
+				}
+				if right != "" {
+					put(x+wc-1, y+dy, borderLines[right][1], a.overlay(base, "border"))
+				}
+			}
+		}
+		for _, p := range cols {
+			b := a.edgeBelow(r2, p.i)
+			if b == "" {
+				continue
+			}
+			ul := tcell.UnderlineStyleSolid
+			if b != "single" {
+				ul = tcell.UnderlineStyleDouble
+			}
+			for dx := p.off; dx < p.off+p.size; dx++ {
+				if x+dx < w && y+hh-1 < h {
+					ch, comb, st, _ := s.GetContent(x+dx, y+hh-1)
+					s.SetContent(x+dx, y+hh-1, ch, comb, st.Underline(ul))
+				}
+			}
+		}
+		return
+	}
+
+	for i, p := range rows {
+		right := a.edgeRight(p.i, c2)
+		for dy := p.off; dy < p.off+p.size; dy++ {
+			put(x+wc, y+dy, borderLines[right][1], a.lineStyle(right))
+		}
+		if i < len(rows)-1 {
+			ch, st := a.join(p.i, c2)
+			put(x+wc, y+p.off+p.size, ch, st)
+		}
+	}
+	for i, p := range cols {
+		below := a.edgeBelow(r2, p.i)
+		for dx := p.off; dx < p.off+p.size; dx++ {
+			put(x+dx, y+hh, borderLines[below][0], a.lineStyle(below))
+		}
+		if i < len(cols)-1 {
+			ch, st := a.join(r2, p.i)
+			put(x+p.off+p.size, y+hh, ch, st)
+		}
+	}
+	ch, st := a.join(r2, c2)
+	put(x+wc, y+hh, ch, st)
+}
+
+// borderCommand handles :border SIDES [single|double|thick] for the
+// selection or the current cell. SIDES are top, bottom, left, right,
+// outline (around the whole range), all (every cell edge) or none.
+func (a *App) borderCommand(args []string) {
+	style := "single"
+	var sides []string
+	for _, arg := range args {
+		switch arg {
+		case "single", "double", "thick":
+			style = arg
+		case "top", "bottom", "left", "right", "outline", "all", "none":
+			sides = append(sides, arg)
+		default:
+			a.StatusMsg = "usage: :border top|bottom|left|right|outline|all|none [single|double|thick]"
+			return
+		}
+	}
+	if len(sides) == 0 {
+		a.StatusMsg = "usage: :border top|bottom|left|right|outline|all|none [single|double|thick]"
+		return
+	}
+	r1, c1, r2, c2 := a.CurRow, a.CurCol, a.CurRow, a.CurCol
+	if sr1, sc1, sr2, sc2, ok := a.selection(); ok {
+		r1, c1, r2, c2 = sr1, sc1, sr2, sc2
+	}
+
+	a.pushUndo()
+	for r := r1; r <= r2; r++ {
+		for c := c1; c <= c2; c++ {
+			edges := map[string]bool{
+				"top": r == r1, "bottom": r == r2, "left": c == c1, "right": c == c2,
+			}
+			for _, side := range sides {
+				switch side {
+				case "none":
+					for _, sd := range borderSides {
+						a.setFormat(r, c, "border-"+sd, "")
+					}
+				case "all":
+					for _, sd := range borderSides {
+						a.setFormat(r, c, "border-"+sd, style)
+					}
+				case "outline":
+					for _, sd := range borderSides {
+						if edges[sd] {
+							a.setFormat(r, c, "border-"+sd, style)
+						}
+					}
+				default:
+					if edges[side] {
+						a.setFormat(r, c, "border-"+side, style)
+					}
+				}
+			}
+		}
+	}
+	a.Anchor = nil
+	a.StatusMsg = fmt.Sprintf("border %s %s on %s", strings.Join(sides, " "), style,
+		grid.ColRowToName(c1, r1)+":"+grid.ColRowToName(c2, r2))
+}
+
+// setFormat sets (or with value "" removes) a format key of cell r, c. The
+// format map is copied, since undo snapshots share it.
+func (a *App) setFormat(r, c int, key, value string) {
+	k := [2]int{r, c}
+	cell := a.Grid[k]
+	format := maps.Clone(cell.Format)
+	if format == nil {
+		format = map[string]string{}
+	}
+	if value == "" {
+		delete(format, key)
+	} else {
+		format[key] = value
+	}
+	cell.Format = format
+	if len(format) == 0 {
+		cell.Format = nil
+	}
+	if bareCell(cell) {
+		delete(a.Grid, k)
+		return
+	}
+	a.EnsureRowExists(r)
+	a.EnsureColExists(c)
+	a.Grid[k] = cell
+}
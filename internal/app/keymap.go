@@ -0,0 +1,443 @@
+package app
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// action is a named normal-mode command that keys are bound to. count is
+// the numeric prefix typed before the key (0 when there was none).
+type action struct {
+	run    func(a *App, s tcell.Screen, count int, arg rune)
+	change bool // modifies the sheet; repeated by '.'
+	arg    bool // takes the next key as an argument, like the mark name in ma
+}
+
+// change is the last modification, for '.'.
+type change struct {
+	act   action
+	count int
+	arg   rune
+}
+
+// times turns a count prefix into a repeat count.
+func times(count int) int {
+	return maxInt(count, 1)
+}
+
+// move returns an action moving the cursor by dr, dc per count.
+func move(dr, dc int) action {
+	return action{run: func(a *App, s tcell.Screen, count int, _ rune) {
+		n := times(count)
+		r, c := a.blockEdge(a.CurRow, a.CurCol, dr, dc)
+		a.moveTo(s, a.stepRows(r, dr*n), a.stepCols(c, dc*n))
+	}}
+}
+
+// repeatMove calls step count times, stopping once the cursor stays put.
+// Steps that wrap around (next cell, next match) come back to the start
+// after a cycle; the rest of the count is then taken modulo its length.
+func (a *App) repeatMove(count int, step func()) {
+	start := [2]int{a.CurRow, a.CurCol}
+	for i := 0; i < count; i++ {
+		prev := [2]int{a.CurRow, a.CurCol}
+		step()
+		cur := [2]int{a.CurRow, a.CurCol}
+		if cur == prev {
+			return
+		}
+		if cur == start {
+			count = i + 1 + (count-i-1)%(i+1)
+		}
+	}
+}
+
+// edge returns an action jumping to the edge of a data block.
+func edge(dr, dc int) action {
+	return action{run: func(a *App, s tcell.Screen, count int, _ rune) {
+		a.repeatMove(times(count), func() {
+			r, c := a.dataEdge(dr, dc)
+			a.moveTo(s, r, c)
+		})
+	}}
+}
+
+// resize returns an action changing the current row height or column width.
+func resize(drow, dcol int) action {
+	return action{run: func(a *App, s tcell.Screen, count int, _ rune) {
+		n := times(count)
+		if drow != 0 && a.CurRow < len(a.RowHeights) {
+			a.RowHeights[a.CurRow] = maxInt(1, a.RowHeights[a.CurRow]+drow*n)
+		}
+		if dcol != 0 && a.CurCol < len(a.ColWidths) {
+			a.ColWidths[a.CurCol] = maxInt(4, a.ColWidths[a.CurCol]+dcol*n)
+		}
+	}}
+}
+
+// repeated returns a change action calling fn count times, or until it
+// reports that it changed nothing.
+func repeated(fn func(a *App) bool) action {
+	return action{change: true, run: func(a *App, s tcell.Screen, count int, _ rune) {
+		for i := 0; i < times(count); i++ {
+			if !fn(a) {
+				break
+			}
+		}
+	}}
+}
+
+// outline returns an action running an outline command (see
+// outlineCommand) on rows.
+func outline(cmd string, args ...string) action {
+	return action{run: func(a *App, s tcell.Screen, _ int, _ rune) {
+		a.outlineCommand(cmd, args)
+		a.EnsureCursorVisible(s)
+	}}
+}
+
+// actions lists every command keys can be bound to, by name. It is filled
+// in init because some actions (:map via "command") refer back to it.
+var actions map[string]action
+
+func init() {
+	actions = map[string]action{
+		"left":       move(0, -1),
+		"right":      move(0, 1),
+		"up":         move(-1, 0),
+		"down":       move(1, 0),
+		"edge-left":  edge(0, -1),
+		"edge-right": edge(0, 1),
+		"edge-up":    edge(-1, 0),
+		"edge-down":  edge(1, 0),
+		"first-row": {run: func(a *App, s tcell.Screen, count int, _ rune) {
+			a.moveTo(s, count-1, a.CurCol)
+		}},
+		"last-row": {run: func(a *App, s tcell.Screen, count int, _ rune) {
+			if count > 0 {
+				a.moveTo(s, count-1, a.CurCol)
+				return
+			}
+			rows, _ := a.usedExtent()
+			a.moveTo(s, rows-1, a.CurCol)
+		}},
+		"first-col": {run: func(a *App, s tcell.Screen, _ int, _ rune) {
+			a.moveTo(s, a.CurRow, a.rowEdge(false))
+		}},
+		"last-col": {run: func(a *App, s tcell.Screen, _ int, _ rune) {
+			a.moveTo(s, a.CurRow, a.rowEdge(true))
+		}},
+		"next-cell": {run: func(a *App, s tcell.Screen, count int, _ rune) {
+			a.repeatMove(times(count), func() {
+				if r, c, ok := a.nextFilled(1); ok {
+					a.moveTo(s, r, c)
+				}
+			})
+		}},
+		"prev-cell": {run: func(a *App, s tcell.Screen, count int, _ rune) {
+			a.repeatMove(times(count), func() {
+				if r, c, ok := a.nextFilled(-1); ok {
+					a.moveTo(s, r, c)
+				}
+			})
+		}},
+		"page-up": {run: func(a *App, s tcell.Screen, _ int, _ rune) {
+			vr, _ := a.ComputeVisible(s)
+			a.ViewRow = maxInt(a.FrozenRows, a.stepRows(a.ViewRow, -vr))
+		}},
+		"page-down": {run: func(a *App, s tcell.Screen, _ int, _ rune) {
+			vr, _ := a.ComputeVisible(s)
+			a.ViewRow = minInt(a.stepRows(a.ViewRow, vr), maxInt(0, len(a.RowHeights)-1))
+		}},
+		"view-home": {run: func(a *App, s tcell.Screen, _ int, _ rune) {
+			a.ViewCol = a.FrozenCols
+			a.ViewRow = a.FrozenRows
+		}},
+		"view-end": {run: func(a *App, s tcell.Screen, _ int, _ rune) {
+			a.ViewCol = maxInt(0, len(a.ColWidths)-1)
+			a.ViewRow = maxInt(0, len(a.RowHeights)-1)
+		}},
+		"row-taller":   resize(1, 0),
+		"row-shorter":  resize(-1, 0),
+		"col-wider":    resize(0, 1),
+		"col-narrower": resize(0, -1),
+		"insert-row": {change: true, run: func(a *App, s tcell.Screen, count int, _ rune) {
+			a.InsertRows(a.CurRow+1, minInt(times(count), maxRows-len(a.RowHeights)))
+		}},
+		"insert-col": {change: true, run: func(a *App, s tcell.Screen, count int, _ rune) {
+			a.InsertCols(a.CurCol+1, minInt(times(count), maxCols-len(a.ColWidths)))
+		}},
+		"delete-row": repeated(func(a *App) bool {
+			n := len(a.RowHeights)
+			a.DeleteRow(a.CurRow)
+			return len(a.RowHeights) < n
+		}),
+		"delete-col": repeated(func(a *App) bool {
+			n := len(a.ColWidths)
+			a.DeleteCol(a.CurCol)
+			return len(a.ColWidths) < n
+		}),
+		"edit": {run: func(a *App, s tcell.Screen, _ int, _ rune) {
+			a.startEdit()
+		}},
+		"enter": {run: func(a *App, s tcell.Screen, _ int, _ rune) {
+			if a.EnterStartsEdit {
+				a.startEdit()
+			}
+		}},
+		"command": {run: func(a *App, s tcell.Screen, _ int, _ rune) {
+			if command, ok := a.PopupInput(s, ":", ""); ok {
+				if !a.popupCommand(s, command) {
+					a.ExecuteCommand(command)
+				}
+				a.EnsureCursorVisible(s)
+			}
+		}},
+		"formula": {run: func(a *App, s tcell.Screen, _ int, _ rune) {
+			if value, ok := a.PopupInput(s, "", "="); ok {
+				a.commitEdit(value)
+			}
+		}},
+		"help": {run: func(a *App, s tcell.Screen, _ int, _ rune) {
+			a.HelpVisible = true
+		}},
+		"set-mark": {arg: true, run: func(a *App, s tcell.Screen, _ int, name rune) {
+			a.setMark(name)
+		}},
+		"goto-mark": {arg: true, run: func(a *App, s tcell.Screen, _ int, name rune) {
+			a.gotoMark(s, name)
+		}},
+		"repeat": {run: func(a *App, s tcell.Screen, count int, _ rune) {
+			c := a.lastChange
+			if c == nil {
+				return
+			}
+			if count == 0 {
+				count = c.count
+			}
+			a.pushUndo()
+			c.act.run(a, s, count, c.arg)
+		}},
+		"undo": {run: func(a *App, s tcell.Screen, count int, _ rune) {
+			for i := 0; i < times(count); i++ {
+				if !a.Undo() {
+					a.StatusMsg = "already at oldest change"
+					break
+				}
+			}
+			a.EnsureCursorVisible(s)
+		}},
+		"redo": {run: func(a *App, s tcell.Screen, count int, _ rune) {
+			for i := 0; i < times(count); i++ {
+				if !a.Redo() {
+					a.StatusMsg = "already at newest change"
+					break
+				}
+			}
+			a.EnsureCursorVisible(s)
+		}},
+		"visual": {run: func(a *App, s tcell.Screen, _ int, _ rune) {
+			a.toggleVisual()
+		}},
+		"select-left":  extend(0, -1),
+		"select-right": extend(0, 1),
+		"select-up":    extend(-1, 0),
+		"select-down":  extend(1, 0),
+		"search-forward": {run: func(a *App, s tcell.Screen, _ int, _ rune) {
+			a.startSearch(s, false)
+		}},
+		"search-backward": {run: func(a *App, s tcell.Screen, _ int, _ rune) {
+			a.startSearch(s, true)
+		}},
+		"search-next": {run: func(a *App, s tcell.Screen, count int, _ rune) {
+			a.repeatMove(times(count), func() { a.searchNext(s, false) })
+		}},
+		"search-prev": {run: func(a *App, s tcell.Screen, count int, _ rune) {
+			a.repeatMove(times(count), func() { a.searchNext(s, true) })
+		}},
+		"collapse-group": outline("collapse", "row"),
+		"expand-group":   outline("expand", "row"),
+		"collapse-all":   outline("collapse", "row", "all"),
+		"expand-all":     outline("expand", "row", "all"),
+		"filter-values": {run: func(a *App, s tcell.Screen, _ int, _ rune) {
+			a.filterValues(s)
+		}},
+		"pick-value": {run: func(a *App, s tcell.Screen, _ int, _ rune) {
+			a.pickValue(s)
+		}},
+		"expand-bar": {run: func(a *App, s tcell.Screen, _ int, _ rune) {
+			a.FormulaBar, a.barExpanded = true, !a.barExpanded
+			a.EnsureCursorVisible(s)
+		}},
+		"quit": {run: func(a *App, s tcell.Screen, _ int, _ rune) {
+			a.Quit = true
+		}},
+		"cancel": {run: func(a *App, s tcell.Screen, _ int, _ rune) {
+			a.Anchor = nil
+		}},
+	}
+}
+
+// defaultKeymap binds normal-mode keys (see keyName) to actions.
+func defaultKeymap() map[string]string {
+	return map[string]string{
+		"h": "left", "<Left>": "left",
+		"l": "right", "<Right>": "right",
+		"k": "up", "<Up>": "up",
+		"j": "down", "<Down>": "down",
+		"<A-Left>": "edge-left", "<A-Right>": "edge-right",
+		"<A-Up>": "edge-up", "<A-Down>": "edge-down",
+		"{": "edge-up", "}": "edge-down",
+		"gg": "first-row", "G": "last-row",
+		"0": "first-col", "$": "last-col",
+		"w": "next-cell", "b": "prev-cell",
+		"<PgUp>": "page-up", "<PgDn>": "page-down",
+		"<Home>": "view-home", "<End>": "view-end",
+		"<C-Down>": "row-taller", "<C-Up>": "row-shorter",
+		"<C-Right>": "col-wider", "<C-Left>": "col-narrower",
+		"<F2>": "insert-row", "<F3>": "insert-col",
+		"<F4>": "delete-row", "<F5>": "delete-col",
+		"i": "edit", "<Enter>": "enter",
+		":": "command", "=": "formula", "<F1>": "help",
+		"/": "search-forward", "?": "search-backward",
+		"n": "search-next", "N": "search-prev",
+		"v":        "visual",
+		"<S-Left>": "select-left", "<S-Right>": "select-right",
+		"<S-Up>": "select-up", "<S-Down>": "select-down",
+		"u": "undo", "<C-r>": "redo",
+		"m": "set-mark", "'": "goto-mark", "`": "goto-mark",
+		".": "repeat", "<F6>": "filter-values",
+		"<F7>": "pick-value", "<F8>": "expand-bar",
+		"zc": "collapse-group", "zo": "expand-group",
+		"zM": "collapse-all", "zR": "expand-all",
+		"q": "quit", "<C-c>": "quit",
+		"<Esc>": "cancel",
+	}
+}
+
+// specialKeys names non-rune keys for keymaps.
+var specialKeys = map[tcell.Key]string{
+	tcell.KeyUp: "Up", tcell.KeyDown: "Down", tcell.KeyLeft: "Left", tcell.KeyRight: "Right",
+	tcell.KeyPgUp: "PgUp", tcell.KeyPgDn: "PgDn", tcell.KeyHome: "Home", tcell.KeyEnd: "End",
+	tcell.KeyInsert: "Ins", tcell.KeyDelete: "Del", tcell.KeyEnter: "Enter", tcell.KeyEsc: "Esc",
+	tcell.KeyTab: "Tab", tcell.KeyBacktab: "S-Tab", tcell.KeyBackspace: "BS", tcell.KeyBackspace2: "BS",
+}
+
+// keyName formats a key the way keymaps spell it: runes as themselves
+// ("<lt>" for '<', "<Space>" for ' '), other keys in angle brackets with
+// C-, S- and A- modifier prefixes, e.g. "<C-Up>", "<F2>", "<C-c>".
+func keyName(ev *tcell.EventKey) string {
+	mods := ev.Modifiers()
+	var base string
+	switch k := ev.Key(); {
+	case k == tcell.KeyRune:
+		switch r := ev.Rune(); r {
+		case '<':
+			base = "lt"
+		case ' ':
+			base = "Space"
+		default:
+			if mods&tcell.ModAlt == 0 {
+				return string(r)
+			}
+			base = string(r)
+		}
+		mods &= tcell.ModAlt
+	case specialKeys[k] != "":
+		base = specialKeys[k]
+	case k >= tcell.KeyF1 && k <= tcell.KeyF64:
+		base = "F" + strconv.Itoa(int(k-tcell.KeyF1)+1)
+	case k >= tcell.KeyCtrlA && k <= tcell.KeyCtrlZ:
+		base = "C-" + string(rune('a'+k-tcell.KeyCtrlA))
+		mods &^= tcell.ModCtrl
+	default:
+		base = strings.ReplaceAll(tcell.KeyNames[k], "+", "-")
+	}
+	prefix := ""
+	if mods&tcell.ModCtrl != 0 {
+		prefix += "C-"
+	}
+	if mods&tcell.ModShift != 0 {
+		prefix += "S-"
+	}
+	if mods&tcell.ModAlt != 0 {
+		prefix += "A-"
+	}
+	return "<" + prefix + base + ">"
+}
+
+// dispatchKey runs the normal-mode action bound to a key, collecting count
+// prefixes (5j), multi-key sequences (gg) and action arguments (ma) on the
+// way.
+func (a *App) dispatchKey(s tcell.Screen, ev *tcell.EventKey) {
+	if a.pendingArg != "" {
+		name, count := a.pendingArg, a.count
+		a.resetKeys()
+		if ev.Key() == tcell.KeyRune {
+			a.runAction(s, actions[name], count, ev.Rune())
+		}
+		return
+	}
+	if ev.Key() == tcell.KeyRune && a.keySeq == "" && ev.Modifiers() == 0 {
+		if d := ev.Rune(); (d >= '1' && d <= '9') || (d == '0' && a.count > 0) {
+			a.count = minInt(a.count*10+int(d-'0'), maxRows)
+			return
+		}
+	}
+
+	seq := a.keySeq + keyName(ev)
+	if name, ok := a.keymap[seq]; ok {
+		count := a.count
+		a.resetKeys()
+		act, ok := actions[name]
+		if !ok {
+			a.StatusMsg = "unknown action " + name
+			return
+		}
+		if act.arg {
+			a.keySeq, a.pendingArg, a.count = seq, name, count
+			return
+		}
+		a.runAction(s, act, count, 0)
+		return
+	}
+	for k := range a.keymap {
+		if strings.HasPrefix(k, seq) {
+			a.keySeq = seq
+			return
+		}
+	}
+	a.resetKeys()
+
+	// other printable character
+	if r := ev.Rune(); ev.Key() == tcell.KeyRune && a.PrintableStartsEdit {
+		a.Mode = "insert"
+		// start editing with this rune (replace)
+		a.Input.SetText(string(r))
+		a.ReplaceOnNextRune = false
+	}
+}
+
+func (a *App) runAction(s tcell.Screen, act action, count int, arg rune) {
+	if act.change {
+		a.lastChange = &change{act: act, count: count, arg: arg}
+		a.pushUndo()
+	}
+	act.run(a, s, count, arg)
+}
+
+// resetKeys drops a pending count or key sequence.
+func (a *App) resetKeys() {
+	a.keySeq, a.pendingArg, a.count = "", "", 0
+}
+
+// pendingKeys is shown in the status line while a count or a key sequence
+// is being typed.
+func (a *App) pendingKeys() string {
+	if a.count > 0 {
+		return strconv.Itoa(a.count) + a.keySeq
+	}
+	return a.keySeq
+}
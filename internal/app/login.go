@@ -6,18 +6,21 @@ import (
 	"github.com/gdamore/tcell/v2"
 )
 
-func LoginScreen(s tcell.Screen) {
+// LoginScreen shows the animated logo in the colours of the theme and
+// waits for a key.
+func (a *App) LoginScreen(s tcell.Screen) {
+	a.useColors(s.Colors())
 	text := []struct {
-		char  rune
-		color tcell.Color
+		char rune
+		role string
 	}{
-		{'G', tcell.ColorWhite},
-		{'R', tcell.ColorWhite},
-		{'I', tcell.ColorYellow},
-		{':', tcell.ColorYellow},
-		{'D', tcell.ColorYellow},
-		{'E', tcell.ColorWhite},
-		{'R', tcell.ColorWhite},
+		{'G', "logo"},
+		{'R', "logo"},
+		{'I', "logo-accent"},
+		{':', "logo-accent"},
+		{'D', "logo-accent"},
+		{'E', "logo"},
+		{'R', "logo"},
 	}
 
 	width, height := s.Size()
@@ -30,14 +33,14 @@ func LoginScreen(s tcell.Screen) {
 		y := height / 2
 
 		for i := 0; i < reveal; i++ {
-			style := tcell.StyleDefault.Foreground(text[i].color).Bold(true)
+			style := a.style(text[i].role)
 			s.SetContent(startX+i, y, text[i].char, nil, style)
 		}
 
 		// Подсказка
 		hint := "Press any key to enter the application"
 		startHintX := (width - len(hint)) / 2
-		style := tcell.StyleDefault.Foreground(tcell.ColorYellow)
+		style := a.style("header")
 		for i, ch := range hint {
 			s.SetContent(startHintX+i, y+2, ch, nil, style)
 		}
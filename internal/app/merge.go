@@ -0,0 +1,196 @@
+package app
+
+import (
+	"fmt"
+
+	"sheet/internal/grid"
+)
+
+// mergeAt returns the merged block that cell r, c belongs to, or ok false
+// when it is not merged.
+func (a *App) mergeAt(r, c int) (r1, c1, r2, c2 int, ok bool) {
+	for k, end := range a.Merges {
+		if r >= k[0] && r <= end[0] && c >= k[1] && c <= end[1] {
+			return k[0], k[1], end[0], end[1], true
+		}
+	}
+	return r, c, r, c, false
+}
+
+// blockStart returns the top-left cell of the block of r, c: the cell
+// itself unless it is merged.
+func (a *App) blockStart(r, c int) (int, int) {
+	r1, c1, _, _, _ := a.mergeAt(r, c)
+	return r1, c1
+}
+
+// blockEnd returns the bottom-right cell of the block of r, c.
+func (a *App) blockEnd(r, c int) (int, int) {
+	_, _, r2, c2, _ := a.mergeAt(r, c)
+	return r2, c2
+}
+
+// blockEdge returns the cell of the block of r, c that a step by dr, dc
+// leaves from: its bottom row when moving down, its right column when
+// moving right.
+func (a *App) blockEdge(r, c, dr, dc int) (int, int) {
+	r2, c2 := a.blockEnd(r, c)
+	if dr > 0 {
+		r = r2
+	}
+	if dc > 0 {
+		c = c2
+	}
+	return r, c
+}
+
+// sameBlock reports whether two different cells are in one merged block,
+// so that no line is drawn between them.
+func (a *App) sameBlock(r1, c1, r2, c2 int) bool {
+	b1, b2, _, _, ok := a.mergeAt(r1, c1)
+	if !ok {
+		return false
+	}
+	s1, s2, _, _, _ := a.mergeAt(r2, c2)
+	return b1 == s1 && b2 == s2
+}
+
+// mergedIn reports whether any merged block overlaps the range.
+func (a *App) mergedIn(r1, c1, r2, c2 int) bool {
+	for k, end := range a.Merges {
+		if k[0] <= r2 && end[0] >= r1 && k[1] <= c2 && end[1] >= c1 {
+			return true
+		}
+	}
+	return false
+}
+
+// spanSize is the screen size of the shown rows r1..r2 and columns c1..c2
+// drawn as one cell, with the gridlines between them.
+func (a *App) spanSize(r1, c1, r2, c2 int) (width, height int) {
+	for c := c1; c <= c2 && c < len(a.ColWidths); c++ {
+		if !a.colHidden(c) {
+			width += a.colSpan(c)
+		}
+	}
+	for r := r1; r <= r2 && r < len(a.RowHeights); r++ {
+		if !a.rowHidden(r) {
+			height += a.rowSpan(r)
+		}
+	}
+	return maxInt(0, width-a.sep()), maxInt(0, height-a.sep())
+}
+
+// cellSize is the screen size of the cell at r, c, the whole block if it
+// is merged.
+func (a *App) cellSize(r, c int) (width, height int) {
+	r1, c1, r2, c2, _ := a.mergeAt(r, c)
+	return a.spanSize(r1, c1, r2, c2)
+}
+
+// shiftMerges moves and resizes the merged blocks when rows (rows true) or
+// columns are inserted (n > 0) or deleted (n < 0) at idx. A block that
+// shrinks to one cell is dropped.
+func (a *App) shiftMerges(rows bool, idx, n int) {
+	out := make(map[[2]int][2]int, len(a.Merges))
+	for k, end := range a.Merges {
+		r1, c1, r2, c2 := k[0], k[1], end[0], end[1]
+		lo, hi := &c1, &c2
+		if rows {
+			lo, hi = &r1, &r2
+		}
+		switch {
+		case n < 0 && *lo == idx && *hi == idx:
+			continue
+		case n < 0 && *hi >= idx:
+			*hi += n
+			if *lo > idx {
+				*lo += n
+			}
+		case n > 0 && *hi >= idx:
+			*hi += n
+			if *lo >= idx {
+				*lo += n
+			}
+		}
+		if r1 != r2 || c1 != c2 {
+			out[[2]int{r1, c1}] = [2]int{r2, c2}
+		}
+	}
+	a.Merges = out
+}
+
+// mergeCommand handles :merge, which makes the selection one cell, and
+// :unmerge, which splits the blocks in the selection or at the cursor.
+// Merging keeps the text of the top-left cell only: formulas refer to the
+// block by it.
+func (a *App) mergeCommand(cmd string, args []string) {
+	if len(args) > 0 {
+		a.StatusMsg = "usage: :" + cmd
+		return
+	}
+	r1, c1, r2, c2, sel := a.selection()
+	if cmd == "unmerge" {
+		if !sel {
+			r1, c1, r2, c2 = a.CurRow, a.CurCol, a.CurRow, a.CurCol
+		}
+		if !a.mergedIn(r1, c1, r2, c2) {
+			a.StatusMsg = "no merged cells here"
+			return
+		}
+		a.pushUndo()
+		n := 0
+		for k, end := range a.Merges {
+			if k[0] <= r2 && end[0] >= r1 && k[1] <= c2 && end[1] >= c1 {
+				delete(a.Merges, k)
+				n++
+			}
+		}
+		a.Anchor = nil
+		a.StatusMsg = fmt.Sprintf("unmerged %d block(s)", n)
+		return
+	}
+
+	if !sel || (r1 == r2 && c1 == c2) {
+		a.StatusMsg = "merge: select the cells to merge"
+		return
+	}
+	for k, end := range a.Merges {
+		inside := k[0] >= r1 && end[0] <= r2 && k[1] >= c1 && end[1] <= c2
+		overlaps := k[0] <= r2 && end[0] >= r1 && k[1] <= c2 && end[1] >= c1
+		if overlaps && !inside {
+			a.StatusMsg = "merge: the selection cuts the merged cells " +
+				grid.ColRowToName(k[1], k[0]) + ":" + grid.ColRowToName(end[1], end[0])
+			return
+		}
+	}
+	a.pushUndo()
+	cleared := 0
+	for r := r1; r <= r2; r++ {
+		for c := c1; c <= c2; c++ {
+			k := [2]int{r, c}
+			if k == [2]int{r1, c1} {
+				continue
+			}
+			delete(a.Merges, k)
+			cell, ok := a.Grid[k]
+			if !ok || cell.Text == "" {
+				continue
+			}
+			cleared++
+			cell.Text = ""
+			if bareCell(cell) {
+				delete(a.Grid, k)
+			} else {
+				a.Grid[k] = cell
+			}
+		}
+	}
+	a.Merges[[2]int{r1, c1}] = [2]int{r2, c2}
+	a.Anchor = nil
+	a.CurRow, a.CurCol = r1, c1
+	a.StatusMsg = "merged " + grid.ColRowToName(c1, r1) + ":" + grid.ColRowToName(c2, r2)
+	if cleared > 0 {
+		a.StatusMsg += fmt.Sprintf(", cleared %d cell(s)", cleared)
+	}
+}
@@ -0,0 +1,211 @@
+package app
+
+import (
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// doubleClick is the longest time between the clicks of a double-click.
+const doubleClick = 400 * time.Millisecond
+
+// wheelStep is how many rows or columns one wheel notch scrolls.
+const wheelStep = 3
+
+// mouseDrag is what the left button is dragging since it was pressed.
+type mouseDrag struct {
+	kind     string // select | col | row (resizing index), empty for a plain click
+	index    int
+	from     int // screen x or y of the press
+	size     int // the width or height at the press
+	moved    bool
+	row, col int // the cell where a selection started
+}
+
+// colAt returns the column drawn at screen x and the x where it starts. The
+// columns are laid out as in Draw and ComputeVisible: frozen first, then
+// from ViewCol on, hidden ones skipped.
+func (a *App) colAt(x int) (col, left int, ok bool) {
+	left = a.LeftGutter
+	if x < left {
+		return 0, 0, false
+	}
+	for c := range a.displayCols() {
+		if x < left+a.colSpan(c) {
+			return c, left, true
+		}
+		left += a.colSpan(c)
+	}
+	return 0, 0, false
+}
+
+// rowAt returns the row drawn at screen y and the y where it starts.
+func (a *App) rowAt(s tcell.Screen, y int) (row, top int, ok bool) {
+	_, usableH := a.viewSize(s)
+	top = a.gridTop() + 1
+	if y < top || y >= top+usableH {
+		return 0, 0, false
+	}
+	for r := range a.displayRows() {
+		if y < top+a.rowSpan(r) {
+			return r, top, true
+		}
+		top += a.rowSpan(r)
+	}
+	return 0, 0, false
+}
+
+// HandleMouseEvent handles a mouse event in normal and insert mode. A click
+// moves the cursor (committing an edit in progress), a drag selects, a
+// double-click starts editing. The wheel scrolls the view, with Shift
+// sideways. Dragging the right edge of a column header or the bottom edge
+// of a row number resizes the column or row.
+func (a *App) HandleMouseEvent(s tcell.Screen, ev *tcell.EventMouse) {
+	if a.InfoText != "" || a.HelpVisible {
+		return
+	}
+	x, y := ev.Position()
+	buttons := ev.Buttons()
+	switch {
+	case buttons&tcell.WheelUp != 0 && ev.Modifiers()&tcell.ModShift != 0, buttons&tcell.WheelLeft != 0:
+		a.scrollView(0, -wheelStep)
+	case buttons&tcell.WheelDown != 0 && ev.Modifiers()&tcell.ModShift != 0, buttons&tcell.WheelRight != 0:
+		a.scrollView(0, wheelStep)
+	case buttons&tcell.WheelUp != 0:
+		a.scrollView(-wheelStep, 0)
+	case buttons&tcell.WheelDown != 0:
+		a.scrollView(wheelStep, 0)
+	case buttons&tcell.Button1 != 0 && a.drag == nil:
+		a.mousePress(s, x, y)
+	case buttons&tcell.Button1 != 0:
+		a.mouseMove(s, x, y)
+	case buttons == tcell.ButtonNone && a.drag != nil:
+		d := a.drag
+		a.drag = nil
+		if !d.moved && d.kind == "col" {
+			a.moveTo(s, a.CurRow, d.index)
+		} else if !d.moved && d.kind == "row" {
+			a.moveTo(s, d.index, a.CurCol)
+		}
+	}
+}
+
+// finishEdit commits an edit in progress before a click moves the cursor.
+// It reports false when validation rejects the text and editing goes on.
+func (a *App) finishEdit() bool {
+	if a.Mode != "insert" {
+		return true
+	}
+	if !a.commitEdit(a.Input.String()) {
+		return false
+	}
+	a.Mode = "normal"
+	a.Input.SetText("")
+	a.ReplaceOnNextRune = false
+	return true
+}
+
+// mousePress starts a click or a drag at x, y.
+func (a *App) mousePress(s tcell.Screen, x, y int) {
+	if y < a.gridTop() {
+		// a click on the formula bar expands or shrinks it
+		a.barExpanded = !a.barExpanded
+		a.drag = &mouseDrag{}
+		return
+	}
+	if y == a.gridTop() {
+		// a click on a header picks the column, on its last cell it grabs
+		// the border
+		if !a.finishEdit() {
+			return
+		}
+		if c, left, ok := a.colAt(x); ok {
+			a.drag = &mouseDrag{kind: "col", index: c, from: x, size: a.ColWidths[c]}
+			if x < left+a.colSpan(c)-1 {
+				a.drag = &mouseDrag{}
+				a.moveTo(s, a.CurRow, c)
+			}
+		}
+		return
+	}
+	r, top, ok := a.rowAt(s, y)
+	if !ok {
+		return
+	}
+	if x < a.LeftGutter {
+		if !a.finishEdit() {
+			return
+		}
+		a.drag = &mouseDrag{kind: "row", index: r, from: y, size: a.RowHeights[r]}
+		if y < top+a.rowSpan(r)-1 {
+			a.drag = &mouseDrag{}
+			a.moveTo(s, r, a.CurCol)
+		}
+		return
+	}
+	c, _, ok := a.colAt(x)
+	if !ok {
+		return
+	}
+	if a.Mode == "normal" && a.onDropdown(x, r, c) {
+		a.pickValue(s)
+		return
+	}
+	double := a.Mode == "normal" && r == a.CurRow && c == a.CurCol &&
+		time.Since(a.lastClick) < doubleClick
+	a.lastClick = time.Now()
+	if a.Mode == "insert" && r == a.CurRow && c == a.CurCol {
+		return
+	}
+	if !a.finishEdit() {
+		return
+	}
+	a.StatusMsg = ""
+	a.Anchor = nil
+	a.moveTo(s, r, c)
+	a.drag = &mouseDrag{kind: "select", row: r, col: c}
+	if double {
+		a.drag = nil
+		a.startEdit()
+	}
+}
+
+// mouseMove extends the selection or resizes while the button is held.
+func (a *App) mouseMove(s tcell.Screen, x, y int) {
+	d := a.drag
+	switch d.kind {
+	case "col":
+		if x != d.from {
+			d.moved = true
+			a.ColWidths[d.index] = maxInt(4, d.size+x-d.from)
+		}
+	case "row":
+		if y != d.from {
+			d.moved = true
+			a.RowHeights[d.index] = maxInt(1, d.size+y-d.from)
+		}
+	case "select":
+		r, _, rok := a.rowAt(s, y)
+		c, _, cok := a.colAt(x)
+		if !rok || !cok || (r == a.CurRow && c == a.CurCol) {
+			return
+		}
+		d.moved = true
+		a.Anchor = &[2]int{d.row, d.col}
+		a.CurRow, a.CurCol = r, c
+		if r == d.row && c == d.col {
+			a.Anchor = nil
+		}
+	}
+}
+
+// scrollView scrolls the view by drow shown rows and dcol shown columns
+// without moving the cursor.
+func (a *App) scrollView(drow, dcol int) {
+	if drow != 0 {
+		a.ViewRow = maxInt(a.FrozenRows, minInt(a.stepRows(a.ViewRow, drow), len(a.RowHeights)-1))
+	}
+	if dcol != 0 {
+		a.ViewCol = maxInt(a.FrozenCols, minInt(a.stepCols(a.ViewCol, dcol), len(a.ColWidths)-1))
+	}
+}
@@ -0,0 +1,136 @@
+package app
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"sheet/internal/calc"
+	"sheet/internal/grid"
+)
+
+// nameCommand handles ":name define NAME REF", ":name list" and
+// ":name delete NAME".
+func (a *App) nameCommand(args []string) {
+	if len(args) == 0 {
+		a.StatusMsg = "usage: :name define NAME REF | :name list | :name delete NAME"
+		return
+	}
+	switch args[0] {
+	case "define", "def":
+		if len(args) < 3 {
+			a.StatusMsg = "usage: :name define NAME REF"
+			return
+		}
+		if err := a.DefineName(args[1], strings.Join(args[2:], " ")); err != nil {
+			a.StatusMsg = err.Error()
+			return
+		}
+		a.StatusMsg = fmt.Sprintf("%s = %s", strings.ToUpper(args[1]), a.Names[strings.ToUpper(args[1])])
+	case "list", "ls":
+		if len(a.Names) == 0 {
+			a.StatusMsg = "no names defined"
+			return
+		}
+		a.InfoText = a.namesText()
+	case "delete", "del", "rm":
+		if len(args) < 2 {
+			a.StatusMsg = "usage: :name delete NAME"
+			return
+		}
+		if !a.DeleteName(args[1]) {
+			a.StatusMsg = "unknown name: " + args[1]
+		}
+	default:
+		a.StatusMsg = "unknown :name subcommand: " + args[0]
+	}
+}
+
+// DefineName adds or replaces a named range or constant. The definition is a
+// cell (H1), a range (B2:B200, A:A) or a constant expression (0.2).
+func (a *App) DefineName(name, def string) error {
+	if !validName(name) {
+		return fmt.Errorf("invalid name: %s", name)
+	}
+	def = strings.TrimPrefix(strings.TrimSpace(def), "=")
+	if def == "" {
+		return fmt.Errorf("empty definition for %s", name)
+	}
+	if err := calc.CheckSyntax(def); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if a.Names == nil {
+		a.Names = map[string]string{}
+	}
+	a.Names[strings.ToUpper(name)] = def
+	return nil
+}
+
+// DeleteName removes a name and reports whether it existed.
+func (a *App) DeleteName(name string) bool {
+	key := strings.ToUpper(name)
+	if _, ok := a.Names[key]; !ok {
+		return false
+	}
+	delete(a.Names, key)
+	return true
+}
+
+// lookupName is the calc.Env name resolver; names are case-insensitive.
+func (a *App) lookupName(name string) (string, bool) {
+	def, ok := a.Names[strings.ToUpper(name)]
+	return def, ok
+}
+
+// shiftNames rewrites every name definition, e.g. after rows or columns
+// were inserted or deleted.
+func (a *App) shiftNames(shift func(def string) string) {
+	for k, def := range a.Names {
+		a.Names[k] = shift(def)
+	}
+}
+
+func (a *App) namesText() string {
+	keys := make([]string, 0, len(a.Names))
+	width := 0
+	for k := range a.Names {
+		keys = append(keys, k)
+		width = maxInt(width, len(k))
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString("Names:\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%-*s  %s\n", width, k, a.Names[k])
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// r1c1Ref matches references in R1C1 notation, like R2C3, RC or R1C.
+var r1c1Ref = regexp.MustCompile(`^[Rr][0-9]*[Cc][0-9]*$`)
+
+// validName accepts identifiers like TAX_RATE or Sales.2024 that can not be
+// mistaken for a cell reference, a column (A to ZZZ, as in A:A), an R1C1
+// reference or a number.
+func validName(name string) bool {
+	if name == "" || r1c1Ref.MatchString(name) {
+		return false
+	}
+	if len(name) <= 3 && !strings.ContainsFunc(name, func(r rune) bool { return !unicode.IsLetter(r) }) {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		ch := name[i]
+		isAlpha := (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') || ch == '_'
+		if i == 0 && !isAlpha {
+			return false
+		}
+		if !isAlpha && !(ch >= '0' && ch <= '9') && ch != '.' {
+			return false
+		}
+	}
+	_, _, isRef := grid.ParseCellRef(name)
+	return !isRef
+}
@@ -0,0 +1,177 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+
+	"sheet/internal/grid"
+)
+
+// maxRows and maxCols bound the sheet (columns up to ZZZ, as references
+// allow), so that a far jump cannot grow it without limit.
+const (
+	maxRows = 1 << 20
+	maxCols = 26 + 26*26 + 26*26*26
+)
+
+// errNotCell is returned by gotoCommand for a target that is not a cell,
+// a range or a name.
+var errNotCell = errors.New("not a cell")
+
+// checkExtent reports an error when row, col lies beyond the sheet limits.
+func checkExtent(row, col int) error {
+	if row >= maxRows {
+		return fmt.Errorf("row %d is beyond the last row %d", row+1, maxRows)
+	}
+	if col >= maxCols {
+		return fmt.Errorf("column %s is beyond the last column %s", grid.ColToName(col), grid.ColToName(maxCols-1))
+	}
+	return nil
+}
+
+// moveTo puts the cursor on row, col as placeCursor does and scrolls the
+// view to it.
+func (a *App) moveTo(s tcell.Screen, row, col int) {
+	a.placeCursor(row, col)
+	a.EnsureCursorVisible(s)
+}
+
+// placeCursor puts the cursor on row, col (clamped to the sheet limits, on
+// the nearest shown row or column in the direction of the move when it is
+// hidden, and on the top-left cell of a merged block), growing the grid if
+// needed. The view is left as it is.
+func (a *App) placeCursor(row, col int) {
+	row, col = maxInt(row, 0), maxInt(col, 0)
+	row, col = minInt(row, maxRows-1), minInt(col, maxCols-1)
+	row, col = a.visibleRow(row, row-a.CurRow), a.visibleCol(col, col-a.CurCol)
+	row, col = a.blockStart(row, col)
+	a.EnsureRowExists(row)
+	a.EnsureColExists(col)
+	a.CurRow, a.CurCol = row, col
+}
+
+// filled reports whether cell r, c has any text.
+func (a *App) filled(r, c int) bool {
+	return a.Grid[[2]int{r, c}].Text != ""
+}
+
+// usedExtent returns the number of rows and columns up to the last filled
+// cell.
+func (a *App) usedExtent() (rows, cols int) {
+	for k, cell := range a.Grid {
+		if cell.Text == "" {
+			continue
+		}
+		rows = maxInt(rows, k[0]+1)
+		cols = maxInt(cols, k[1]+1)
+	}
+	return rows, cols
+}
+
+// rowEdge returns the first (last == false) or last filled column of the
+// current row, or column 0 when the row is empty.
+func (a *App) rowEdge(last bool) int {
+	col := -1
+	for k, cell := range a.Grid {
+		if k[0] != a.CurRow || cell.Text == "" {
+			continue
+		}
+		if col < 0 || (last && k[1] > col) || (!last && k[1] < col) {
+			col = k[1]
+		}
+	}
+	return maxInt(col, 0)
+}
+
+// nextFilled returns the nearest filled cell after (dir > 0) or before
+// (dir < 0) the cursor in row-major order.
+func (a *App) nextFilled(dir int) (row, col int, ok bool) {
+	before := func(r1, c1, r2, c2 int) bool { return r1 < r2 || (r1 == r2 && c1 < c2) }
+	for k, cell := range a.Grid {
+		if cell.Text == "" {
+			continue
+		}
+		r, c := k[0], k[1]
+		if dir > 0 && !before(a.CurRow, a.CurCol, r, c) || dir < 0 && !before(r, c, a.CurRow, a.CurCol) {
+			continue
+		}
+		if !ok || (dir > 0 && before(r, c, row, col)) || (dir < 0 && before(row, col, r, c)) {
+			row, col, ok = r, c, true
+		}
+	}
+	return row, col, ok
+}
+
+// dataEdge finds where a Ctrl+arrow jump in a desktop spreadsheet would
+// land: the end of the current block of filled cells, or the start of the
+// next block, or the edge of the grid when there is none.
+func (a *App) dataEdge(dr, dc int) (row, col int) {
+	rows, cols := a.usedExtent()
+	rows = maxInt(rows, len(a.RowHeights))
+	cols = maxInt(cols, len(a.ColWidths))
+	inside := func(r, c int) bool { return r >= 0 && c >= 0 && r < rows && c < cols }
+
+	r, c := a.CurRow, a.CurCol
+	if !inside(r+dr, c+dc) {
+		return r, c
+	}
+	if a.filled(r, c) && a.filled(r+dr, c+dc) {
+		for inside(r+dr, c+dc) && a.filled(r+dr, c+dc) {
+			r, c = r+dr, c+dc
+		}
+		return r, c
+	}
+	for inside(r+dr, c+dc) {
+		r, c = r+dr, c+dc
+		if a.filled(r, c) {
+			break
+		}
+	}
+	return r, c
+}
+
+// gotoCommand handles :goto REF and :REF, where REF is a cell, a range or
+// a name defined with :name. The caller scrolls the view to the cursor.
+func (a *App) gotoCommand(target string) error {
+	ref := target
+	if def, ok := a.lookupName(target); ok {
+		ref = def
+	}
+	if i := strings.Index(ref, ":"); i >= 0 {
+		ref = ref[:i]
+	}
+	row, col, ok := grid.ParseCellRef(ref)
+	if !ok {
+		return fmt.Errorf("%w: %s", errNotCell, target)
+	}
+	if err := checkExtent(row, col); err != nil {
+		return err
+	}
+	row, col = a.blockStart(row, col)
+	a.EnsureRowExists(row)
+	a.EnsureColExists(col)
+	a.CurRow, a.CurCol = row, col
+	return nil
+}
+
+// setMark remembers the cursor position under a letter.
+func (a *App) setMark(name rune) {
+	if !isLetterRune(name) {
+		a.StatusMsg = fmt.Sprintf("invalid mark %q", name)
+		return
+	}
+	a.Marks[name] = [2]int{a.CurRow, a.CurCol}
+}
+
+// gotoMark jumps to a mark set with setMark.
+func (a *App) gotoMark(s tcell.Screen, name rune) {
+	pos, ok := a.Marks[name]
+	if !ok {
+		a.StatusMsg = fmt.Sprintf("mark %c is not set", name)
+		return
+	}
+	a.moveTo(s, pos[0], pos[1])
+}
@@ -0,0 +1,169 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+
+	"sheet/internal/grid"
+)
+
+// noteMark is drawn in the top-right corner of cells with a note.
+const noteMark = '◥'
+
+// noteCommand handles :note TEXT (add a note to the current cell or
+// replace its note), :note (show it) and :note! (delete it). Without a
+// screen to edit in, :note only shows the note (see popupCommand).
+func (a *App) noteCommand(cmd string, args []string) {
+	r, c := a.blockStart(a.CurRow, a.CurCol)
+	note := a.Grid[[2]int{r, c}].Comment
+	switch {
+	case cmd == "note!":
+		if note == "" {
+			a.StatusMsg = "no note here"
+			return
+		}
+		a.setNote(r, c, "")
+		a.StatusMsg = "note deleted"
+	case len(args) == 0:
+		if note == "" {
+			a.StatusMsg = "no note here (:note TEXT adds one)"
+			return
+		}
+		a.StatusMsg = "note: " + oneLine(note)
+	default:
+		a.setNote(r, c, strings.Join(args, " "))
+	}
+}
+
+// setNote sets (or with text "" deletes) the note of cell r, c, keeping
+// its text and format.
+func (a *App) setNote(r, c int, text string) {
+	a.pushUndo()
+	k := [2]int{r, c}
+	cell := a.Grid[k]
+	cell.Comment = text
+	if bareCell(cell) {
+		delete(a.Grid, k)
+		return
+	}
+	a.EnsureRowExists(r)
+	a.EnsureColExists(c)
+	a.Grid[k] = cell
+}
+
+// cursorNote is the note of the cell under the cursor, shown in the status
+// line.
+func (a *App) cursorNote() string {
+	r, c := a.blockStart(a.CurRow, a.CurCol)
+	return a.Grid[[2]int{r, c}].Comment
+}
+
+// oneLine joins the lines of a note for the status line.
+func oneLine(text string) string {
+	return strings.Join(strings.Fields(strings.ReplaceAll(text, "\n", " / ")), " ")
+}
+
+// noteCells returns the cells with notes in row-major order.
+func (a *App) noteCells() [][2]int {
+	var cells [][2]int
+	for k, cell := range a.Grid {
+		if cell.Comment != "" {
+			cells = append(cells, k)
+		}
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i][0] != cells[j][0] {
+			return cells[i][0] < cells[j][0]
+		}
+		return cells[i][1] < cells[j][1]
+	})
+	return cells
+}
+
+// notesList formats the cells with notes as "A1  text" lines.
+func (a *App) notesList() []string {
+	cells := a.noteCells()
+	width := 0
+	for _, k := range cells {
+		width = maxInt(width, len(grid.ColRowToName(k[1], k[0])))
+	}
+	items := make([]string, len(cells))
+	for i, k := range cells {
+		items[i] = fmt.Sprintf("%-*s  %s", width, grid.ColRowToName(k[1], k[0]), oneLine(a.Grid[k].Comment))
+	}
+	return items
+}
+
+// notesCommand handles :notes without a screen: the notes are listed in an
+// info popup (see pickNote for the list to jump from).
+func (a *App) notesCommand() {
+	items := a.notesList()
+	if len(items) == 0 {
+		a.StatusMsg = "no notes"
+		return
+	}
+	a.InfoText = "Notes:\n" + strings.Join(items, "\n")
+}
+
+// editNote edits the note of the current cell in a popup; an empty note is
+// deleted. Line breaks are edited as \n (see escapeNote).
+func (a *App) editNote(s tcell.Screen) {
+	r, c := a.blockStart(a.CurRow, a.CurCol)
+	note := a.Grid[[2]int{r, c}].Comment
+	text, ok := a.PopupText(s, "Note "+grid.ColRowToName(c, r)+":", escapeNote(note))
+	if !ok || text == escapeNote(note) {
+		return
+	}
+	a.setNote(r, c, strings.TrimSpace(unescapeNote(text)))
+}
+
+// escapeNote writes a note on one line: line breaks become \n and
+// backslashes \\, so that unescapeNote gives the note back unchanged.
+func escapeNote(note string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(note)
+}
+
+// unescapeNote reverses escapeNote; a backslash before any other character
+// is kept as is.
+func unescapeNote(text string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' && i+1 < len(text) {
+			switch text[i+1] {
+			case 'n':
+				b.WriteByte('\n')
+				i++
+				continue
+			case '\\':
+				b.WriteByte('\\')
+				i++
+				continue
+			}
+		}
+		b.WriteByte(text[i])
+	}
+	return b.String()
+}
+
+// pickNote lists the notes in a popup and moves the cursor to the chosen
+// one.
+func (a *App) pickNote(s tcell.Screen) {
+	cells := a.noteCells()
+	if len(cells) == 0 {
+		a.StatusMsg = "no notes"
+		return
+	}
+	sel := 0
+	for i, k := range cells {
+		if k == [2]int{a.CurRow, a.CurCol} {
+			sel = i
+		}
+	}
+	if i, ok := a.PopupList(s, "Notes", a.notesList(), sel); ok {
+		a.Anchor = nil
+		a.moveTo(s, cells[i][0], cells[i][1])
+	}
+}
@@ -0,0 +1,165 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// option is a setting that :set and the config file can change.
+type option struct {
+	get func(a *App) string
+	set func(a *App, value string) error
+}
+
+func boolOption(field func(a *App) *bool) option {
+	return option{
+		get: func(a *App) string { return strconv.FormatBool(*field(a)) },
+		set: func(a *App, value string) error {
+			v, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("expected true or false, got %q", value)
+			}
+			*field(a) = v
+			return nil
+		},
+	}
+}
+
+func intOption(min int, field func(a *App) *int) option {
+	return option{
+		get: func(a *App) string { return strconv.Itoa(*field(a)) },
+		set: func(a *App, value string) error {
+			v, err := strconv.Atoi(value)
+			if err != nil || v < min {
+				return fmt.Errorf("expected a number >= %d, got %q", min, value)
+			}
+			*field(a) = v
+			return nil
+		},
+	}
+}
+
+// sizeOption is an intOption for a default column width or row height:
+// columns or rows that still have the old default follow the new one.
+func sizeOption(min int, field func(a *App) *int, sizes func(a *App) []int) option {
+	opt := intOption(min, field)
+	set := opt.set
+	opt.set = func(a *App, value string) error {
+		old := *field(a)
+		if err := set(a, value); err != nil {
+			return err
+		}
+		list := sizes(a)
+		for i, v := range list {
+			if v == old {
+				list[i] = *field(a)
+			}
+		}
+		return nil
+	}
+	return opt
+}
+
+// options lists the settings by name.
+var options = map[string]option{
+	"enterstartsedit":     boolOption(func(a *App) *bool { return &a.EnterStartsEdit }),
+	"printablestartsedit": boolOption(func(a *App) *bool { return &a.PrintableStartsEdit }),
+	"moveafterenter":      boolOption(func(a *App) *bool { return &a.MoveAfterEnter }),
+	"selectallonedit":     boolOption(func(a *App) *bool { return &a.SelectAllOnEdit }),
+	"autogrow":            boolOption(func(a *App) *bool { return &a.AutoGrow }),
+	"ignorecase":          boolOption(func(a *App) *bool { return &a.IgnoreCase }),
+	"searchregex":         boolOption(func(a *App) *bool { return &a.SearchRegex }),
+	"searchvalues":        boolOption(func(a *App) *bool { return &a.SearchValues }),
+	"defaultwidth": sizeOption(4, func(a *App) *int { return &a.DefaultWidth },
+		func(a *App) []int { return a.ColWidths }),
+	"defaultheight": sizeOption(1, func(a *App) *int { return &a.DefaultHeight },
+		func(a *App) []int { return a.RowHeights }),
+	"cellpadding":  intOption(0, func(a *App) *int { return &a.CellPadding }),
+	"gridlines":    boolOption(func(a *App) *bool { return &a.Gridlines }),
+	"formulabar":   boolOption(func(a *App) *bool { return &a.FormulaBar }),
+	"showformulas": boolOption(func(a *App) *bool { return &a.ShowFormulas }),
+	"theme": {
+		get: func(a *App) string { return a.Theme },
+		set: (*App).SetTheme,
+	},
+}
+
+// SetOption changes a setting by name (case-insensitive).
+func (a *App) SetOption(name, value string) error {
+	opt, ok := options[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown option %s", name)
+	}
+	if err := opt.set(a, value); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// setCommand handles :set. Besides name=value it accepts the vim forms
+// name (turn a flag on), noname (off), name! (toggle) and name? (show);
+// :set alone lists all options.
+func (a *App) setCommand(args []string) {
+	if len(args) == 0 {
+		a.InfoText = a.optionsText()
+		return
+	}
+	for _, arg := range args {
+		msg, err := a.setArg(arg)
+		if err != nil {
+			a.StatusMsg = err.Error()
+			return
+		}
+		if msg != "" {
+			a.StatusMsg = msg
+		}
+	}
+}
+
+func (a *App) setArg(arg string) (msg string, err error) {
+	if name, value, ok := strings.Cut(arg, "="); ok {
+		return "", a.SetOption(name, value)
+	}
+	name := strings.ToLower(arg)
+	switch {
+	case strings.HasSuffix(name, "?"):
+		name = strings.TrimSuffix(name, "?")
+		opt, ok := options[name]
+		if !ok {
+			return "", fmt.Errorf("unknown option %s", name)
+		}
+		return name + "=" + opt.get(a), nil
+	case strings.HasSuffix(name, "!"):
+		name = strings.TrimSuffix(name, "!")
+		opt, ok := options[name]
+		if !ok {
+			return "", fmt.Errorf("unknown option %s", name)
+		}
+		v, err := strconv.ParseBool(opt.get(a))
+		if err != nil {
+			return "", fmt.Errorf("%s is not a flag", name)
+		}
+		return "", a.SetOption(name, strconv.FormatBool(!v))
+	}
+	if _, ok := options[name]; !ok && strings.HasPrefix(name, "no") {
+		return "", a.SetOption(name[2:], "false")
+	}
+	return "", a.SetOption(name, "true")
+}
+
+// optionsText lists the current settings for :set.
+func (a *App) optionsText() string {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("Options:\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "%-20s  %s\n", name, options[name].get(a))
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
@@ -0,0 +1,218 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxOutline is the deepest outline level of grouped rows and columns.
+const maxOutline = 7
+
+// rowHidden reports whether row r is hidden from drawing and navigation, by
+// the filter or by hand (:hide, a collapsed group).
+func (a *App) rowHidden(r int) bool {
+	return a.HiddenRows[r] || a.filteredOut(r)
+}
+
+// hiddenBy tells SUBTOTAL whether row r is hidden by the filter or by hand.
+func (a *App) hiddenBy(r int) (filtered, manual bool) {
+	return a.filteredOut(r), a.HiddenRows[r]
+}
+
+// colHidden reports whether column c is hidden.
+func (a *App) colHidden(c int) bool {
+	return a.HiddenCols[c]
+}
+
+// nearestShown returns i if it is shown, else the nearest shown index below
+// n in direction dir (1 or -1), or in the other one if there is none.
+func nearestShown(i, dir, n int, hidden func(int) bool) int {
+	if dir == 0 {
+		dir = 1
+	}
+	for _, d := range []int{dir, -dir} {
+		for j := i; j >= 0 && j < n; j += d {
+			if !hidden(j) {
+				return j
+			}
+		}
+	}
+	return i
+}
+
+// stepShown moves n shown indexes forward from i (back when n < 0),
+// stopping at the first one.
+func stepShown(i, n int, hidden func(int) bool) int {
+	d := 1
+	if n < 0 {
+		d, n = -1, -n
+	}
+	for ; n > 0; n-- {
+		j := i + d
+		for j >= 0 && hidden(j) {
+			j += d
+		}
+		if j < 0 {
+			break
+		}
+		i = j
+	}
+	return i
+}
+
+func (a *App) visibleRow(row, dir int) int { return nearestShown(row, dir, maxRows, a.rowHidden) }
+func (a *App) visibleCol(col, dir int) int { return nearestShown(col, dir, maxCols, a.colHidden) }
+func (a *App) stepRows(row, n int) int     { return stepShown(row, n, a.rowHidden) }
+func (a *App) stepCols(col, n int) int     { return stepShown(col, n, a.colHidden) }
+
+// shiftKeys moves the entries of m at or after idx by n when rows or
+// columns are inserted (n > 0) or deleted (n < 0, the entry at idx is
+// dropped).
+func shiftKeys[V any](m map[int]V, idx, n int) map[int]V {
+	out := make(map[int]V, len(m))
+	for i, v := range m {
+		if n < 0 && i == idx {
+			continue
+		}
+		out[shiftIndex(i, idx, n)] = v
+	}
+	return out
+}
+
+// groupAt finds the group at i: the run of indexes around i with at least
+// its outline level. On a summary row right after a group (one with a lower
+// level) it finds the group before it, which is where the outline buttons
+// of desktop spreadsheets are.
+func groupAt(levels map[int]int, i int) (lo, hi int, ok bool) {
+	if i > 0 && levels[i-1] > levels[i] {
+		i--
+	}
+	level := levels[i]
+	if level == 0 {
+		return 0, 0, false
+	}
+	lo, hi = i, i
+	for lo > 0 && levels[lo-1] >= level {
+		lo--
+	}
+	for levels[hi+1] >= level {
+		hi++
+	}
+	return lo, hi, true
+}
+
+// outlineCommand handles
+//
+//	:hide row|col       hide the selected rows/columns, or the cursor's
+//	:unhide row|col     show the hidden ones in the selection or next to the cursor
+//	:unhide all         show every hidden row and column
+//	:group row|col      group the selected rows/columns one outline level deeper
+//	:ungroup row|col    take them one level out
+//	:collapse row|col   hide the group at the cursor (all: every group)
+//	:expand row|col     show it again (all: every group)
+func (a *App) outlineCommand(cmd string, args []string) {
+	if cmd == "unhide" && len(args) == 1 && args[0] == "all" {
+		a.pushUndo()
+		a.HiddenRows, a.HiddenCols = map[int]bool{}, map[int]bool{}
+		return
+	}
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[1] != "all") ||
+		!(strings.HasPrefix(args[0], "row") || strings.HasPrefix(args[0], "col")) {
+		a.StatusMsg = fmt.Sprintf("usage: :%s row|col", cmd)
+		return
+	}
+	rows := strings.HasPrefix(args[0], "row")
+	all := len(args) == 2
+	hidden, levels, cur := a.HiddenCols, a.ColLevels, a.CurCol
+	if rows {
+		hidden, levels, cur = a.HiddenRows, a.RowLevels, a.CurRow
+	}
+	lo, hi := cur, cur
+	if r1, c1, r2, c2, ok := a.selection(); ok {
+		lo, hi = c1, c2
+		if rows {
+			lo, hi = r1, r2
+		}
+	}
+	what := "column(s)"
+	if rows {
+		what = "row(s)"
+	}
+
+	switch cmd {
+	case "collapse", "expand":
+		if all {
+			lo, hi = 0, -1
+			for i := range levels {
+				hi = maxInt(hi, i)
+			}
+		} else {
+			var ok bool
+			if lo, hi, ok = groupAt(levels, cur); !ok {
+				a.StatusMsg = fmt.Sprintf("no group at the cursor (see :group %s)", args[0])
+				return
+			}
+		}
+		a.pushUndo()
+		for i := lo; i <= hi; i++ {
+			if levels[i] == 0 {
+				continue
+			}
+			if cmd == "collapse" {
+				hidden[i] = true
+			} else {
+				delete(hidden, i)
+			}
+		}
+	case "hide":
+		a.pushUndo()
+		for i := lo; i <= hi; i++ {
+			hidden[i] = true
+		}
+		a.StatusMsg = fmt.Sprintf("%d %s hidden", hi-lo+1, what)
+	case "unhide":
+		if a.Anchor == nil {
+			// the hidden runs just before and after the cursor
+			for lo > 0 && hidden[lo-1] {
+				lo--
+			}
+			for hidden[hi+1] {
+				hi++
+			}
+		}
+		a.pushUndo()
+		n := 0
+		for i := lo; i <= hi; i++ {
+			if hidden[i] {
+				delete(hidden, i)
+				n++
+			}
+		}
+		a.StatusMsg = fmt.Sprintf("%d %s shown", n, what)
+	case "group", "ungroup":
+		a.pushUndo()
+		for i := lo; i <= hi; i++ {
+			if cmd == "group" {
+				levels[i] = minInt(levels[i]+1, maxOutline)
+			} else if levels[i] > 1 {
+				levels[i]--
+			} else {
+				delete(levels, i)
+			}
+		}
+	}
+	a.Anchor = nil
+	a.placeCursor(a.CurRow, a.CurCol)
+}
+
+// outlineMark is drawn between the gutter and the first cell of row r: +
+// where hidden rows are just above, | beside grouped rows.
+func (a *App) outlineMark(r int) rune {
+	switch {
+	case r > 0 && a.HiddenRows[r-1]:
+		return '+'
+	case a.RowLevels[r] > 0:
+		return '│'
+	}
+	return ' '
+}
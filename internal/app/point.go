@@ -0,0 +1,108 @@
+package app
+
+import (
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+
+	"sheet/internal/grid"
+)
+
+// pointRef is the reference being picked with the arrow keys while a
+// formula is edited ("point mode"). The reference text occupies
+// buf[start:end] of the edited formula.
+type pointRef struct {
+	Row, Col   int // anchor
+	Row2, Col2 int // moving end; equals the anchor for a single cell
+	start, end int
+}
+
+// text formats the picked cell or range, e.g. B3 or A1:C4.
+func (p *pointRef) text() string {
+	r1, r2 := minInt(p.Row, p.Row2), maxInt(p.Row, p.Row2)
+	c1, c2 := minInt(p.Col, p.Col2), maxInt(p.Col, p.Col2)
+	ref := grid.ColRowToName(c1, r1)
+	if r1 != r2 || c1 != c2 {
+		ref += ":" + grid.ColRowToName(c2, r2)
+	}
+	return ref
+}
+
+// contains reports whether cell r, c is inside the picked range.
+func (p *pointRef) contains(r, c int) bool {
+	return r >= minInt(p.Row, p.Row2) && r <= maxInt(p.Row, p.Row2) &&
+		c >= minInt(p.Col, p.Col2) && c <= maxInt(p.Col, p.Col2)
+}
+
+// refExpected reports whether a reference may be inserted at pos of a
+// formula buffer: right after '=', '(', ',' or an operator, and not inside
+// a string literal.
+func refExpected(buf []rune, pos int) bool {
+	if len(buf) == 0 || buf[0] != '=' || pos > len(buf) {
+		return false
+	}
+	if strings.Count(string(buf[:pos]), `"`)%2 != 0 {
+		return false
+	}
+	rest := strings.TrimLeft(string(buf[pos:]), " ")
+	if rest != "" && rest[0] != ')' && rest[0] != ',' {
+		return false
+	}
+	for i := pos - 1; i >= 0; i-- {
+		if buf[i] == ' ' {
+			continue
+		}
+		return strings.ContainsRune("=(,+-*/^<>&:", buf[i])
+	}
+	return false
+}
+
+// pointKey handles an arrow key while a formula is edited. A plain arrow
+// moves the picked reference (starting from the current cell), a
+// shift-arrow extends it into a range; the reference text is written into
+// buf at pos. ok is false when the key is not for point mode, e.g. when
+// the cursor is not where a reference can go.
+func (a *App) pointKey(s tcell.Screen, ev *tcell.EventKey, buf []rune, pos int) ([]rune, int, bool) {
+	dr, dc := 0, 0
+	switch ev.Key() {
+	case tcell.KeyUp:
+		dr = -1
+	case tcell.KeyDown:
+		dr = 1
+	case tcell.KeyLeft:
+		dc = -1
+	case tcell.KeyRight:
+		dc = 1
+	default:
+		return buf, pos, false
+	}
+	// Ctrl/Alt+arrows keep their own meaning
+	if ev.Modifiers()&^tcell.ModShift != 0 {
+		return buf, pos, false
+	}
+	p := a.Point
+	if p == nil || p.end != pos || p.end > len(buf) {
+		if !refExpected(buf, pos) {
+			return buf, pos, false
+		}
+		p = &pointRef{Row: a.CurRow, Col: a.CurCol, Row2: a.CurRow, Col2: a.CurCol, start: pos, end: pos}
+	}
+	if ev.Modifiers()&tcell.ModShift != 0 {
+		p.Row2, p.Col2 = maxInt(0, p.Row2+dr), maxInt(0, p.Col2+dc)
+	} else {
+		// a merged block is picked as its top-left cell
+		r, c := a.blockEdge(p.Row2, p.Col2, dr, dc)
+		r, c = a.blockStart(maxInt(0, r+dr), maxInt(0, c+dc))
+		p.Row, p.Col, p.Row2, p.Col2 = r, c, r, c
+	}
+	r, c := p.Row2, p.Col2
+	a.EnsureRowExists(r)
+	a.EnsureColExists(c)
+
+	ref := []rune(p.text())
+	out := append(append(append([]rune{}, buf[:p.start]...), ref...), buf[p.end:]...)
+	p.end = p.start + len(ref)
+	a.Point = p
+	a.ensureVisible(s, p.Row2, p.Col2)
+	return out, p.end, true
+}
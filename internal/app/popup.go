@@ -1,166 +1,383 @@
 package app
 
-
 import (
-    "unicode/utf8"
-
-
-"github.com/gdamore/tcell/v2"
-
+	"github.com/gdamore/tcell/v2"
 )
 
-
 // PopupInput показывает модальное окно ввода с prompt и initial текстом.
 // Возвращает введённую строку и true если пользователь нажал Enter,
 // или пустую строку и false если пользователь отменил ввод (Esc).
 //
-// Теперь метод принимает экран s tcell.Screen и вызывает a.Draw(s).
-// Требование: a.Draw(s tcell.Screen) должен существовать в вашем App.
+// Если ввод начинается с '=', окно помогает набирать формулу: подсвечивает
+// синтаксис (ошибки вроде незакрытой скобки выделяются красным), показывает
+// сигнатуру функции, внутри которой стоит курсор, и список подходящих
+// функций и имён. Up/Down выбирают вариант, Tab подставляет его. Там, где
+// ожидается ссылка (после '=', '(', ',' или оператора), стрелки выбирают
+// ячейку на листе, а Shift+стрелки расширяют её до диапазона.
 func (a *App) PopupInput(s tcell.Screen, prompt, initial string) (string, bool) {
-    style := tcell.StyleDefault.Foreground(tcell.ColorWhite).Background(tcell.ColorReset)
+	return a.popupInput(s, prompt, initial, true)
+}
+
+// PopupText - то же окно ввода для простого текста: '=' в начале не
+// включает помощь с формулами.
+func (a *App) PopupText(s tcell.Screen, prompt, initial string) (string, bool) {
+	return a.popupInput(s, prompt, initial, false)
+}
+
+// popupInput - общая часть PopupInput и PopupText; formulas разрешает
+// помощь с формулами.
+func (a *App) popupInput(s tcell.Screen, prompt, initial string, formulas bool) (string, bool) {
+	a.useColors(s.Colors())
+	style := a.style("popup")
+	dim := a.overlay(style, "popup-dim")
+
+	promptW := textWidth(prompt)
+	var ed LineEditor
+	ed.SetText(initial)
+
+	var (
+		items   []suggestion
+		itemPos int // начало дополняемого идентификатора
+		sel     int
+	)
+	formula := func() bool { return formulas && ed.Len() > 0 && ed.Runes()[0] == '=' }
+	update := func() {
+		if !formula() {
+			items = nil
+			return
+		}
+		itemPos, items = a.suggestions(ed.Runes(), ed.Pos())
+		if sel >= len(items) {
+			sel = 0
+		}
+	}
 
+	var w, h, boxW, left, top int
+	layout := func() {
+		w, h = s.Size()
+		minContentW := 20
+		if formula() {
+			minContentW = 60
+		}
+		contentW := maxInt(minContentW, promptW+textWidth(ed.String())+2)
+		if contentW > w-4 {
+			contentW = w - 4
+		}
+		boxW = contentW + 4
+		left = (w - boxW) / 2
+		top = (h - 3) / 2
+	}
 
-promptRunes := []rune(prompt)
-buf := []rune(initial)
-pos := len(buf)
+	drawBox := func() {
+		buf, pos := ed.Runes(), ed.Pos()
+		var (
+			before, param, after string
+			sig                  bool
+		)
+		styles := make([]tcell.Style, len(buf))
+		if formula() {
+			before, param, after, sig = signatureHelp(buf, pos)
+			styles = a.formulaStyles(buf, style)
+		} else {
+			for i := range styles {
+				styles[i] = style
+			}
+		}
+		boxH := 3
+		if sig {
+			boxH++
+		}
+		// очистка области окна
+		for y := top; y < top+boxH; y++ {
+			for x := left; x < left+boxW; x++ {
+				s.SetContent(x, y, ' ', nil, style)
+			}
+		}
+		drawFrame(s, left, top, boxW, boxH, style)
 
-// локальный max, чтобы не конфликтовать с существующими символами
-max := func(a, b int) int {
-    if a > b {
-        return a
-    }
-    return b
+		// prompt и поле ввода
+		x := left + 2
+		y := top + 1
+		putText(s, x, y, prompt, style, left+boxW-2)
+		x += promptW + 1
+
+		// поле прокручивается по кластерам графем так, чтобы курсор был виден;
+		// ширина считается в экранных позициях
+		maxField := boxW - 4 - promptW
+		clusters := runeClusters(buf)
+		cursorCol := func(first int) int {
+			n := 0
+			for _, c := range clusters[first:] {
+				if c.start >= pos {
+					break
+				}
+				n += c.width
+			}
+			return n
+		}
+		first := 0
+		for first < len(clusters) && cursorCol(first) > maxField-1 {
+			first++
+		}
+		fx := x
+		for _, c := range clusters[first:] {
+			if fx+c.width > x+maxField {
+				break
+			}
+			if c.width > 0 {
+				s.SetContent(fx, y, buf[c.start], buf[c.start+1:c.end], styles[c.start])
+			}
+			fx += c.width
+		}
+		for ; fx < x+maxField; fx++ {
+			s.SetContent(fx, y, ' ', nil, style)
+		}
+		cursorX := x + cursorCol(first)
+		if cursorX < left+1 {
+			cursorX = left + 1
+		}
+		s.ShowCursor(cursorX, y)
+
+		// подсказка по аргументам: текущий параметр выделен
+		if sig {
+			x = left + 2
+			limit := left + boxW - 2
+			for _, part := range []struct {
+				text string
+				st   tcell.Style
+			}{
+				{before, dim},
+				{param, style.Bold(true).Underline(true)},
+				{after, dim},
+			} {
+				x = putText(s, x, y+1, part.text, part.st, limit)
+			}
+		}
+
+		// список вариантов под окном
+		for i, it := range items {
+			if i >= maxSuggestions || top+boxH+i >= h {
+				break
+			}
+			st := a.overlay(style, "popup-item")
+			if i == sel {
+				st = a.overlay(style, "popup-selected")
+			}
+			a.printTextFixedWidth(s, left, top+boxH+i, " "+it.Label, st, boxW)
+		}
+	}
+
+	redraw := func() {
+		update()
+		layout()
+		a.Draw(s)
+		drawBox()
+		s.Show()
+	}
+
+	// первоначальная отрисовка: основное UI + оверлей
+	redraw()
+
+	for {
+		ev := s.PollEvent()
+		switch ev := ev.(type) {
+		case *tcell.EventKey:
+			// стрелки в формуле выбирают ссылку на ячейку (point mode),
+			// если список вариантов не занимает Up/Down
+			if formula() && (len(items) == 0 || (ev.Key() != tcell.KeyUp && ev.Key() != tcell.KeyDown)) {
+				if buf, pos, ok := a.pointKey(s, ev, ed.Runes(), ed.Pos()); ok {
+					ed.Set(buf, pos)
+					redraw()
+					continue
+				}
+			}
+			a.Point = nil
+			switch ev.Key() {
+			case tcell.KeyEsc:
+				s.HideCursor()
+				a.Draw(s)
+				s.Show()
+				return "", false
+			case tcell.KeyEnter:
+				s.HideCursor()
+				a.Draw(s)
+				s.Show()
+				return ed.String(), true
+			case tcell.KeyTab:
+				if len(items) > 0 {
+					buf, pos := ed.Runes(), ed.Pos()
+					ins := []rune(items[sel].Insert)
+					tail := buf[pos:]
+					// не удваивать скобку, если она уже набрана
+					skip := len(ins) > 0 && ins[len(ins)-1] == '(' && len(tail) > 0 && tail[0] == '('
+					if skip {
+						ins = ins[:len(ins)-1]
+					}
+					out := append(append(append([]rune{}, buf[:itemPos]...), ins...), tail...)
+					pos = itemPos + len(ins)
+					if skip {
+						pos++
+					}
+					ed.Set(out, pos)
+					sel = 0
+				}
+			case tcell.KeyUp, tcell.KeyDown:
+				if n := minInt(len(items), maxSuggestions); n > 0 {
+					if ev.Key() == tcell.KeyUp {
+						sel = (sel + n - 1) % n
+					} else {
+						sel = (sel + 1) % n
+					}
+				}
+			default:
+				if ev.Key() != tcell.KeyRune || ed.Len() < 4096 {
+					ed.HandleKey(ev)
+				}
+			}
+			redraw()
+		case *tcell.EventResize:
+			s.Sync()
+			redraw()
+		}
+	}
 }
 
-// вычисление размеров окна
-w, h := s.Size()
-minContentW := 20
-contentW := max(minContentW, len(promptRunes)+len(buf)+2)
-if contentW > w-4 {
-    contentW = w - 4
+// drawFrame рисует рамку окна размером w x h с левым верхним углом в
+// left, top.
+func drawFrame(s tcell.Screen, left, top, w, h int, style tcell.Style) {
+	for x := left; x < left+w; x++ {
+		s.SetContent(x, top, tcell.RuneHLine, nil, style)
+		s.SetContent(x, top+h-1, tcell.RuneHLine, nil, style)
+	}
+	for y := top; y < top+h; y++ {
+		s.SetContent(left, y, tcell.RuneVLine, nil, style)
+		s.SetContent(left+w-1, y, tcell.RuneVLine, nil, style)
+	}
+	s.SetContent(left, top, tcell.RuneULCorner, nil, style)
+	s.SetContent(left+w-1, top, tcell.RuneURCorner, nil, style)
+	s.SetContent(left, top+h-1, tcell.RuneLLCorner, nil, style)
+	s.SetContent(left+w-1, top+h-1, tcell.RuneLRCorner, nil, style)
 }
-boxW := contentW + 4
-boxH := 3
-left := (w - boxW) / 2
-top := (h - boxH) / 2
-
-drawBox := func() {
-    // очистка области окна
-    for y := top; y < top+boxH; y++ {
-        for x := left; x < left+boxW; x++ {
-            s.SetContent(x, y, ' ', nil, style)
-        }
-    }
-    // рамка
-    for x := left; x < left+boxW; x++ {
-        s.SetContent(x, top, tcell.RuneHLine, nil, style)
-        s.SetContent(x, top+boxH-1, tcell.RuneHLine, nil, style)
-    }
-    for y := top; y < top+boxH; y++ {
-        s.SetContent(left, y, tcell.RuneVLine, nil, style)
-        s.SetContent(left+boxW-1, y, tcell.RuneVLine, nil, style)
-    }
-    s.SetContent(left, top, tcell.RuneULCorner, nil, style)
-    s.SetContent(left+boxW-1, top, tcell.RuneURCorner, nil, style)
-    s.SetContent(left, top+boxH-1, tcell.RuneLLCorner, nil, style)
-    s.SetContent(left+boxW-1, top+boxH-1, tcell.RuneLRCorner, nil, style)
-
-    // prompt и поле ввода
-    x := left + 2
-    y := top + 1
-    for i, r := range promptRunes {
-        s.SetContent(x+i, y, r, nil, style)
-    }
-    x += len(promptRunes) + 1
-
-    maxField := boxW - 4 - len(promptRunes)
-    displayRunes := buf
-    start := 0
-    if len(displayRunes) > maxField {
-        if pos > maxField {
-            start = pos - maxField
-        }
-        displayRunes = displayRunes[start : start+maxField]
-    }
-    for i, r := range displayRunes {
-        s.SetContent(x+i, y, r, nil, style)
-    }
-    for i := len(displayRunes); i < maxField; i++ {
-        s.SetContent(x+i, y, ' ', nil, style)
-    }
-
-    cursorX := x + (pos - start)
-    if cursorX < left+1 {
-        cursorX = left + 1
-    }
-    s.ShowCursor(cursorX, y)
+
+// PopupChecklist показывает модальный список с флажками. Up/Down (j/k),
+// PgUp/PgDn, Home/End перемещают выделение, Space переключает флажок, a
+// отмечает все пункты или снимает все отметки. Enter возвращает true и
+// оставляет изменения в checked, Esc возвращает false и восстанавливает
+// checked. Пустой список не показывается: сразу возвращается false.
+func (a *App) PopupChecklist(s tcell.Screen, title string, items []string, checked []bool) bool {
+	_, ok := a.popupList(s, title, " Space a Enter Esc ", items, 0, checked)
+	return ok
 }
 
-// первоначальная отрисовка: основное UI + оверлей
-a.Draw(s)
-drawBox()
-s.Show()
-
-for {
-    ev := s.PollEvent()
-    switch ev := ev.(type) {
-    case *tcell.EventKey:
-        switch ev.Key() {
-        case tcell.KeyEsc:
-            s.HideCursor()
-            a.Draw(s)
-            s.Show()
-            return "", false
-        case tcell.KeyEnter:
-            s.HideCursor()
-            a.Draw(s)
-            s.Show()
-            return string(buf), true
-        case tcell.KeyBackspace, tcell.KeyBackspace2:
-            if pos > 0 {
-                buf = append(buf[:pos-1], buf[pos:]...)
-                pos--
-            }
-        case tcell.KeyDelete:
-            if pos < len(buf) {
-                buf = append(buf[:pos], buf[pos+1:]...)
-            }
-        case tcell.KeyLeft:
-            if pos > 0 {
-                pos--
-            }
-        case tcell.KeyRight:
-            if pos < len(buf) {
-                pos++
-            }
-        case tcell.KeyHome:
-            pos = 0
-        case tcell.KeyEnd:
-            pos = len(buf)
-        default:
-            if r := ev.Rune(); r != 0 {
-                if utf8.RuneCountInString(string(buf)) < 4096 {
-                    buf = append(buf[:pos], append([]rune{r}, buf[pos:]...)...)
-                    pos++
-                }
-            }
-        }
-        // перерисовать
-        a.Draw(s)
-        drawBox()
-        s.Show()
-    case *tcell.EventResize:
-        s.Sync()
-        w, h = s.Size()
-        if boxW > w-4 {
-            boxW = w - 4
-        }
-        left = (w - boxW) / 2
-        top = (h - boxH) / 2
-        a.Draw(s)
-        drawBox()
-        s.Show()
-    }
+// PopupList показывает модальный список для выбора одного пункта. Up/Down
+// (j/k), PgUp/PgDn, Home/End перемещают выделение, начиная с пункта sel.
+// Enter возвращает номер выделенного пункта и true, Esc - false.
+func (a *App) PopupList(s tcell.Screen, title string, items []string, sel int) (int, bool) {
+	return a.popupList(s, title, " Enter Esc ", items, sel, nil)
 }
 
+// popupList - общая часть PopupList и PopupChecklist: модальный список с
+// подсказкой hint в нижней рамке и выделением на пункте sel. Если checked
+// не nil, перед пунктами рисуются флажки, которые переключают Space и a;
+// Esc тогда восстанавливает checked. Enter возвращает номер выделенного
+// пункта и true, Esc - false. Пустой список не показывается.
+func (a *App) popupList(s tcell.Screen, title, hint string, items []string, sel int, checked []bool) (int, bool) {
+	if len(items) == 0 {
+		return 0, false
+	}
+	a.useColors(s.Colors())
+	style := a.style("popup")
+	saved := append([]bool(nil), checked...)
+	sel = maxInt(0, minInt(sel, len(items)-1))
+	first := 0
+
+	redraw := func() {
+		a.Draw(s)
+		w, h := s.Size()
+		boxW := maxInt(textWidth(title), textWidth(hint)) + 4
+		for _, it := range items {
+			boxW = maxInt(boxW, textWidth(it)+4)
+		}
+		if checked != nil {
+			boxW += 4
+		}
+		boxW = minInt(boxW, w-2)
+		rows := maxInt(1, minInt(len(items), h-6))
+		boxH := rows + 2
+		left, top := (w-boxW)/2, (h-boxH)/2
+
+		// прокрутка, чтобы выделенный пункт был виден
+		if sel < first {
+			first = sel
+		} else if sel >= first+rows {
+			first = sel - rows + 1
+		}
+
+		for y := top; y < top+boxH; y++ {
+			for x := left; x < left+boxW; x++ {
+				s.SetContent(x, y, ' ', nil, style)
+			}
+		}
+		drawFrame(s, left, top, boxW, boxH, style)
+		a.printTextFixedWidth(s, left+2, top, " "+title+" ", style.Bold(true), minInt(textWidth(title)+2, boxW-4))
+		a.printTextFixedWidth(s, left+boxW-2-textWidth(hint), top+boxH-1, hint, a.overlay(style, "popup-dim"), textWidth(hint))
+		for i := 0; i < rows && first+i < len(items); i++ {
+			mark := ""
+			if checked != nil {
+				mark = "[ ] "
+				if checked[first+i] {
+					mark = "[x] "
+				}
+			}
+			st := style
+			if first+i == sel {
+				st = a.overlay(style, "popup-selected")
+			}
+			a.printTextFixedWidth(s, left+1, top+1+i, " "+mark+items[first+i], st, boxW-2)
+		}
+		s.Show()
+	}
+
+	redraw()
+	for {
+		switch ev := s.PollEvent().(type) {
+		case *tcell.EventKey:
+			page := maxInt(1, minInt(len(items), 10))
+			switch {
+			case ev.Key() == tcell.KeyEsc:
+				copy(checked, saved)
+				a.Draw(s)
+				return 0, false
+			case ev.Key() == tcell.KeyEnter:
+				a.Draw(s)
+				return sel, true
+			case ev.Key() == tcell.KeyUp || ev.Rune() == 'k':
+				sel = maxInt(0, sel-1)
+			case ev.Key() == tcell.KeyDown || ev.Rune() == 'j':
+				sel = minInt(len(items)-1, sel+1)
+			case ev.Key() == tcell.KeyPgUp:
+				sel = maxInt(0, sel-page)
+			case ev.Key() == tcell.KeyPgDn:
+				sel = minInt(len(items)-1, sel+page)
+			case ev.Key() == tcell.KeyHome:
+				sel = 0
+			case ev.Key() == tcell.KeyEnd:
+				sel = len(items) - 1
+			case checked != nil && ev.Rune() == ' ':
+				checked[sel] = !checked[sel]
+			case checked != nil && ev.Rune() == 'a':
+				all := true
+				for _, c := range checked {
+					all = all && c
+				}
+				for i := range checked {
+					checked[i] = !all
+				}
+			}
+			redraw()
+		case *tcell.EventResize:
+			s.Sync()
+			redraw()
+		}
+	}
 }
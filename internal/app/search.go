@@ -0,0 +1,280 @@
+package app
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// searchState is the last /pattern or ?pattern, reused by n and N and for
+// highlighting matches.
+type searchState struct {
+	pattern  string
+	re       *regexp.Regexp
+	values   bool // match displayed values (formula results) instead of raw text
+	backward bool
+}
+
+// compileSearch turns a pattern into a regexp. Flags override the
+// ignorecase, searchregex and searchvalues options: i/c ignore or respect
+// case, r/l treat the pattern as a regexp or literal text, v/t search
+// displayed values or raw text (formulas). Unknown flags are an error; g
+// is accepted for :s.
+func (a *App) compileSearch(pattern, flags string) (re *regexp.Regexp, values, literal bool, err error) {
+	ignoreCase, regex, values := a.IgnoreCase, a.SearchRegex, a.SearchValues
+	for _, f := range flags {
+		switch f {
+		case 'i':
+			ignoreCase = true
+		case 'c':
+			ignoreCase = false
+		case 'r':
+			regex = true
+		case 'l':
+			regex = false
+		case 'v':
+			values = true
+		case 't':
+			values = false
+		case 'g':
+		default:
+			return nil, false, false, fmt.Errorf("unknown flag %c", f)
+		}
+	}
+	if !regex {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err = regexp.Compile(pattern)
+	if err != nil {
+		return nil, false, false, err
+	}
+	return re, values, !regex, nil
+}
+
+// splitDelim splits s at unescaped delim characters; "\" + delim stands
+// for the delimiter itself, other backslashes are kept for the regexp.
+func splitDelim(s string, delim rune) []string {
+	var parts []string
+	var cur strings.Builder
+	rs := []rune(s)
+	for i := 0; i < len(rs); i++ {
+		switch {
+		case rs[i] == '\\' && i+1 < len(rs) && rs[i+1] == delim:
+			cur.WriteRune(delim)
+			i++
+		case rs[i] == delim:
+			parts = append(parts, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteRune(rs[i])
+		}
+	}
+	return append(parts, cur.String())
+}
+
+// startSearch asks for a pattern and jumps to the first match after
+// (or before, when backward) the cursor. An empty pattern repeats the last
+// search.
+func (a *App) startSearch(s tcell.Screen, backward bool) {
+	delim := '/'
+	if backward {
+		delim = '?'
+	}
+	input, ok := a.PopupInput(s, string(delim), "")
+	if !ok {
+		return
+	}
+	parts := splitDelim(input, delim)
+	if parts[0] == "" {
+		if a.search == nil {
+			a.StatusMsg = "no previous search"
+			return
+		}
+		a.search.backward = backward
+	} else {
+		flags := ""
+		if len(parts) > 1 {
+			flags = parts[1]
+		}
+		re, values, _, err := a.compileSearch(parts[0], flags)
+		if err != nil {
+			a.StatusMsg = "search: " + err.Error()
+			return
+		}
+		a.search = &searchState{pattern: parts[0], re: re, values: values, backward: backward}
+	}
+	a.searchHL = true
+	a.searchNext(s, false)
+}
+
+// searchText is what a search looks at in cell r, c.
+func (a *App) searchText(r, c int) string {
+	if a.search.values {
+		return a.GetDisplayText(r, c)
+	}
+	return a.Grid[[2]int{r, c}].Text
+}
+
+// matches reports whether cell r, c matches the highlighted search.
+func (a *App) matches(r, c int) bool {
+	if a.search == nil || !a.searchHL {
+		return false
+	}
+	if _, ok := a.Grid[[2]int{r, c}]; !ok {
+		return false
+	}
+	return a.search.re.MatchString(a.searchText(r, c))
+}
+
+// searchNext moves to the next match in the search direction (n), or the
+// opposite one when reverse (N), wrapping around the sheet.
+func (a *App) searchNext(s tcell.Screen, reverse bool) {
+	if a.search == nil {
+		a.StatusMsg = "no previous search"
+		return
+	}
+	a.searchHL = true
+	back := a.search.backward != reverse
+	before := func(r1, c1, r2, c2 int) bool { return r1 < r2 || (r1 == r2 && c1 < c2) }
+
+	var hits [][2]int
+	a.withEvalCache(func() {
+		for k, cell := range a.Grid {
+			if cell.Text != "" && a.search.re.MatchString(a.searchText(k[0], k[1])) {
+				hits = append(hits, k)
+			}
+		}
+	})
+	if len(hits) == 0 {
+		a.StatusMsg = "pattern not found: " + a.search.pattern
+		return
+	}
+	// the nearest hit after the cursor in the search direction, else the
+	// first one from the other end
+	sort.Slice(hits, func(i, j int) bool {
+		return before(hits[i][0], hits[i][1], hits[j][0], hits[j][1])
+	})
+	if back {
+		slices.Reverse(hits)
+	}
+	next, wrapped := hits[0], true
+	for _, h := range hits {
+		ahead := before(a.CurRow, a.CurCol, h[0], h[1])
+		if back {
+			ahead = before(h[0], h[1], a.CurRow, a.CurCol)
+		}
+		if ahead {
+			next, wrapped = h, false
+			break
+		}
+	}
+	delim := '/'
+	if a.search.backward {
+		delim = '?'
+	}
+	a.StatusMsg = fmt.Sprintf("%c%s  %d match(es)", delim, a.search.pattern, len(hits))
+	if wrapped {
+		if back {
+			a.StatusMsg += ", search hit TOP, continuing at BOTTOM"
+		} else {
+			a.StatusMsg += ", search hit BOTTOM, continuing at TOP"
+		}
+	}
+	a.moveTo(s, next[0], next[1])
+}
+
+// substitute handles :s/old/new/flags on the selection (or the whole sheet
+// without one) and :%s/old/new/flags on the whole sheet. Without the g
+// flag only the first match in each cell is replaced. Raw cell text is
+// changed, formulas included; the whole replacement is one undo step.
+func (a *App) substitute(cmd string) {
+	whole := strings.HasPrefix(cmd, "%")
+	body := []rune(strings.TrimPrefix(cmd, "%")[1:])
+	if len(body) == 0 {
+		a.StatusMsg = "usage: :s/old/new/[gicrl]"
+		return
+	}
+	parts := splitDelim(string(body[1:]), body[0])
+	if len(parts) < 2 || parts[0] == "" {
+		a.StatusMsg = "usage: :s/old/new/[gicrl]"
+		return
+	}
+	flags := ""
+	if len(parts) > 2 {
+		flags = parts[2]
+	}
+	re, _, literal, err := a.compileSearch(parts[0], flags)
+	if err != nil {
+		a.StatusMsg = "s: " + err.Error()
+		return
+	}
+	repl, global := parts[1], strings.ContainsRune(flags, 'g')
+	replace := func(text string) (string, int) {
+		if global {
+			n := len(re.FindAllStringIndex(text, -1))
+			if n == 0 {
+				return text, 0
+			}
+			if literal {
+				return re.ReplaceAllLiteralString(text, repl), n
+			}
+			return re.ReplaceAllString(text, repl), n
+		}
+		loc := re.FindStringSubmatchIndex(text)
+		if loc == nil {
+			return text, 0
+		}
+		with := repl
+		if !literal {
+			with = string(re.ExpandString(nil, repl, text, loc))
+		}
+		return text[:loc[0]] + with + text[loc[1]:], 1
+	}
+
+	r1, c1, r2, c2, sel := a.selection()
+	changed := map[[2]int]string{}
+	total := 0
+	for k, cell := range a.Grid {
+		if !whole && sel && (k[0] < r1 || k[0] > r2 || k[1] < c1 || k[1] > c2) {
+			continue
+		}
+		if text, n := replace(cell.Text); n > 0 {
+			changed[k] = text
+			total += n
+		}
+	}
+	if total == 0 {
+		a.StatusMsg = "pattern not found: " + parts[0]
+		return
+	}
+	a.pushUndo()
+	for k, text := range changed {
+		cell := a.Grid[k]
+		cell.Text = text
+		if bareCell(cell) {
+			delete(a.Grid, k)
+			continue
+		}
+		a.Grid[k] = cell
+	}
+	a.Anchor = nil
+	a.StatusMsg = fmt.Sprintf("%d substitution(s) in %d cell(s)", total, len(changed))
+}
+
+// isSubstitute recognises :s/…/…/ and :%s/…/…/ with any punctuation as the
+// delimiter.
+func isSubstitute(cmd string) bool {
+	cmd = strings.TrimPrefix(cmd, "%")
+	if len(cmd) < 2 || cmd[0] != 's' {
+		return false
+	}
+	d := cmd[1]
+	return d < 0x80 && d != ' ' && !isIdentRune(rune(d))
+}
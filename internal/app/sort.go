@@ -0,0 +1,262 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"sheet/internal/calc"
+	"sheet/internal/grid"
+)
+
+// sortKey is one column of a :sort specification.
+type sortKey struct {
+	col  int
+	desc bool
+}
+
+// parseSortSpec parses "B desc, A asc" (asc is the default). The word
+// header anywhere marks the first row of the range as a header.
+func parseSortSpec(args []string) (keys []sortKey, header bool, err error) {
+	for _, part := range strings.Split(strings.Join(args, " "), ",") {
+		var key *sortKey
+		for _, tok := range strings.Fields(part) {
+			switch t := strings.ToLower(tok); {
+			case t == "header":
+				header = true
+			case t == "asc" || t == "desc":
+				if key == nil {
+					return nil, false, fmt.Errorf("%s without a column", tok)
+				}
+				key.desc = t == "desc"
+			case key == nil:
+				_, c, ok := grid.ParseCellRef(tok + "1")
+				if !ok {
+					return nil, false, fmt.Errorf("not a column: %s", tok)
+				}
+				key = &sortKey{col: c}
+			default:
+				return nil, false, fmt.Errorf("unexpected %s", tok)
+			}
+		}
+		if key != nil {
+			keys = append(keys, *key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, false, fmt.Errorf("no sort column")
+	}
+	return keys, header, nil
+}
+
+// sortCommand handles :sort COL [asc|desc], ... [header]. It sorts the
+// selected rows, or without a selection all used rows (those below the
+// header when a filter is on). Blanks go last in
+// both directions. Formulas in moved rows keep pointing at the same
+// relative cells.
+func (a *App) sortCommand(args []string) {
+	keys, header, err := parseSortSpec(args)
+	if err != nil {
+		a.StatusMsg = "sort: " + err.Error()
+		return
+	}
+	rows, cols := a.usedExtent()
+	r1, c1, r2, c2, sel := a.selection()
+	if !sel {
+		r1, c1, r2, c2 = 0, 0, rows-1, cols-1
+		if a.filter != nil {
+			// the rows of the filter, below its header
+			r1, r2 = a.filter.header+1, a.filter.end-1
+		}
+	}
+	if header {
+		r1++
+	}
+	if r2 <= r1 {
+		a.StatusMsg = "sort: nothing to sort"
+		return
+	}
+	for _, k := range keys {
+		if k.col < c1 || k.col > c2 {
+			a.StatusMsg = fmt.Sprintf("sort: column %s is outside the range", grid.ColToName(k.col))
+			return
+		}
+	}
+	// whole rows move with their heights; a selection narrower than the
+	// used columns only moves its own cells
+	wholeRows := !sel || (c1 == 0 && c2 >= cols-1)
+	if wholeRows {
+		c1, c2 = 0, maxInt(c2, cols-1)
+	}
+	if a.mergedIn(r1, c1, r2, c2) || (wholeRows && a.mergedIn(r1, 0, r2, len(a.ColWidths))) {
+		a.StatusMsg = "sort: the range has merged cells"
+		return
+	}
+	if !wholeRows {
+		// hidden and grouped rows keep their place while part of their
+		// cells would move
+		for r := r1; r <= r2; r++ {
+			if a.HiddenRows[r] || a.RowLevels[r] > 0 {
+				a.StatusMsg = "sort: the range has hidden or grouped rows; sort whole rows"
+				return
+			}
+		}
+	}
+
+	order := make([]int, r2-r1+1)
+	values := make([][]calc.Value, len(order))
+	a.withEvalCache(func() {
+		for i := range order {
+			order[i] = r1 + i
+			for _, k := range keys {
+				v := a.cellValue(r1+i, k.col, map[[2]int]bool{})
+				if v.Kind == calc.KindArray && len(v.Arr) > 0 {
+					v = v.Arr[0] // a spill anchor sorts by its own element
+				}
+				values[i] = append(values[i], v)
+			}
+		}
+	})
+	idx := make([]int, len(order))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		for k, key := range keys {
+			c := compareSortValues(values[idx[i]][k], values[idx[j]][k], key.desc)
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+
+	a.pushUndo()
+	moved := map[[2]int]grid.Cell{}
+	for k, cell := range a.Grid {
+		if k[0] >= r1 && k[0] <= r2 && k[1] >= c1 && k[1] <= c2 {
+			moved[k] = cell
+			delete(a.Grid, k)
+		}
+	}
+	heights := make([]int, len(order))
+	hidden, levels := map[int]bool{}, map[int]int{}
+	for dst, i := range idx {
+		src := order[i]
+		if wholeRows && src < len(a.RowHeights) {
+			heights[dst] = a.RowHeights[src]
+		}
+		if wholeRows && a.HiddenRows[src] {
+			hidden[r1+dst] = true
+		}
+		if wholeRows && a.RowLevels[src] > 0 {
+			levels[r1+dst] = a.RowLevels[src]
+		}
+		for c := c1; c <= c2; c++ {
+			cell, ok := moved[[2]int{src, c}]
+			if !ok {
+				continue
+			}
+			if strings.HasPrefix(cell.Text, "=") {
+				cell.Text = calc.OffsetRefs(cell.Text, r1+dst-src, 0)
+			}
+			a.Grid[[2]int{r1 + dst, c}] = cell
+		}
+	}
+	if wholeRows {
+		a.EnsureRowExists(r2)
+		copy(a.RowHeights[r1:], heights)
+		// hidden rows and outline levels move with their rows
+		for r := r1; r <= r2; r++ {
+			delete(a.HiddenRows, r)
+			delete(a.RowLevels, r)
+		}
+		for r := range hidden {
+			a.HiddenRows[r] = true
+		}
+		for r, level := range levels {
+			a.RowLevels[r] = level
+		}
+	}
+	a.Anchor = nil
+	if a.filter != nil {
+		a.applyFilter()
+	}
+	a.StatusMsg = fmt.Sprintf("sorted %d rows", len(order))
+}
+
+// compareSortValues orders cell values for :sort: numbers before text,
+// text in natural order ("item2" before "item10"), errors after text and
+// blanks always last.
+func compareSortValues(x, y calc.Value, desc bool) int {
+	rank := func(v calc.Value) int {
+		switch v.Kind {
+		case calc.KindNumber:
+			return 0
+		case calc.KindText:
+			return 1
+		case calc.KindError:
+			return 2
+		}
+		return 3
+	}
+	rx, ry := rank(x), rank(y)
+	if rx == 3 || ry == 3 || rx != ry {
+		return rx - ry
+	}
+	c := 0
+	switch rx {
+	case 0:
+		switch {
+		case x.Num < y.Num:
+			c = -1
+		case x.Num > y.Num:
+			c = 1
+		}
+	case 1:
+		c = naturalCompare(x.Str, y.Str)
+	case 2:
+		c = strings.Compare(x.Err.String(), y.Err.String())
+	}
+	if desc {
+		c = -c
+	}
+	return c
+}
+
+// naturalCompare compares strings case-insensitively, treating runs of
+// digits as numbers.
+func naturalCompare(x, y string) int {
+	a, b := []rune(strings.ToLower(x)), []rune(strings.ToLower(y))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if unicode.IsDigit(a[i]) && unicode.IsDigit(b[j]) {
+			si, sj := i, j
+			for i < len(a) && unicode.IsDigit(a[i]) {
+				i++
+			}
+			for j < len(b) && unicode.IsDigit(b[j]) {
+				j++
+			}
+			na := strings.TrimLeft(string(a[si:i]), "0")
+			nb := strings.TrimLeft(string(b[sj:j]), "0")
+			if len(na) != len(nb) {
+				return len(na) - len(nb)
+			}
+			if c := strings.Compare(na, nb); c != 0 {
+				return c
+			}
+			continue
+		}
+		if a[i] != b[j] {
+			if a[i] < b[j] {
+				return -1
+			}
+			return 1
+		}
+		i++
+		j++
+	}
+	return (len(a) - i) - (len(b) - j)
+}
@@ -0,0 +1,168 @@
+package app
+
+import (
+	"sort"
+	"strings"
+
+	"sheet/internal/calc"
+	"sheet/internal/grid"
+)
+
+// evalCache memoizes cell values while the grid does not change, e.g. for
+// one redraw, so that every formula is calculated at most once and spill
+// lookups stay cheap.
+type evalCache struct {
+	values   map[[2]int]calc.Value
+	formulas [][2]int // formula cells in row-major order
+
+	// the spill index: spilled cells of the array formulas evaluated so
+	// far, and for each column with formulas how many of them (top down)
+	// spillSource has evaluated
+	spills  map[[2]int][2]int // spilled cell -> cell of the array formula
+	cols    []int             // columns with formulas, ascending
+	byCol   map[int][]int     // rows of the formulas in each column, ascending
+	checked map[int]int
+}
+
+// withEvalCache runs fn with a value cache, reusing the current one if a
+// caller already set it up. The grid must not change inside fn.
+func (a *App) withEvalCache(fn func()) {
+	if a.cache != nil {
+		fn()
+		return
+	}
+	a.cache = &evalCache{
+		values:  map[[2]int]calc.Value{},
+		spills:  map[[2]int][2]int{},
+		byCol:   map[int][]int{},
+		checked: map[int]int{},
+	}
+	for k, cell := range a.Grid {
+		if strings.HasPrefix(cell.Text, "=") {
+			a.cache.formulas = append(a.cache.formulas, k)
+		}
+	}
+	sort.Slice(a.cache.formulas, func(i, j int) bool {
+		ki, kj := a.cache.formulas[i], a.cache.formulas[j]
+		if ki[0] != kj[0] {
+			return ki[0] < kj[0]
+		}
+		return ki[1] < kj[1]
+	})
+	for _, k := range a.cache.formulas {
+		if len(a.cache.byCol[k[1]]) == 0 {
+			a.cache.cols = append(a.cache.cols, k[1])
+		}
+		a.cache.byCol[k[1]] = append(a.cache.byCol[k[1]], k[0])
+	}
+	sort.Ints(a.cache.cols)
+	defer func() { a.cache = nil }()
+	fn()
+}
+
+// spillArray checks whether an array result of the formula at r, c can
+// spill. Arrays are returned unchanged, 1x1 arrays become their element
+// and blocked or empty arrays become errors.
+func (a *App) spillArray(r, c int, v calc.Value, visited map[[2]int]bool) calc.Value {
+	if v.Kind != calc.KindArray {
+		return v
+	}
+	if len(v.Arr) == 0 {
+		return calc.Errorf(calc.ErrNA, "the array is empty")
+	}
+	if len(v.Arr) == 1 {
+		return v.Arr[0]
+	}
+	area := grid.ColRowToName(c, r) + ":" + grid.ColRowToName(c+v.Cols-1, r+v.Rows-1)
+	for rr := r; rr < r+v.Rows; rr++ {
+		for cc := c; cc < c+v.Cols; cc++ {
+			if rr == r && cc == c {
+				continue
+			}
+			if cell, ok := a.Grid[[2]int{rr, cc}]; ok && cell.Text != "" {
+				return calc.Errorf(calc.ErrSpill, "spill range %s is blocked by %s", area, grid.ColRowToName(cc, rr))
+			}
+		}
+	}
+	// an earlier array formula (in row-major order) already spilling into
+	// the area wins
+	for _, k := range a.cache.formulas {
+		if k[0] > r || (k[0] == r && k[1] >= c) {
+			break
+		}
+		if visited[k] || k[1] >= c+v.Cols {
+			continue
+		}
+		other := a.cellValue(k[0], k[1], visited)
+		if other.Kind != calc.KindArray {
+			continue
+		}
+		if k[0]+other.Rows > r && k[1]+other.Cols > c && k[1] < c+v.Cols {
+			return calc.Errorf(calc.ErrSpill, "spill range %s overlaps the spill of %s", area, grid.ColRowToName(k[1], k[0]))
+		}
+	}
+	return v
+}
+
+// spilledValue returns the value an array formula spills into the empty
+// cell r, c, if any.
+func (a *App) spilledValue(r, c int, visited map[[2]int]bool) (calc.Value, bool) {
+	_, v, ok := a.spillSource(r, c, visited)
+	return v, ok
+}
+
+// addSpill records the cells the array v of the formula at k spills into.
+// Where spills overlap, the earlier formula in row-major order keeps the
+// cell.
+func (c *evalCache) addSpill(k [2]int, v calc.Value) {
+	for r := k[0]; r < k[0]+v.Rows; r++ {
+		for cc := k[1]; cc < k[1]+v.Cols; cc++ {
+			cell := [2]int{r, cc}
+			if old, ok := c.spills[cell]; cell == k || (ok && (old[0] < k[0] || (old[0] == k[0] && old[1] < k[1]))) {
+				continue
+			}
+			c.spills[cell] = k
+		}
+	}
+}
+
+// spillSource is spilledValue that also returns the cell of the array
+// formula. Only formulas above and left of r, c can spill into it; those
+// not evaluated yet are evaluated first (each once per cache, except the
+// ones being evaluated now, which are added to the index when they are
+// done), then the cell is looked up in the spill index.
+func (a *App) spillSource(r, c int, visited map[[2]int]bool) ([2]int, calc.Value, bool) {
+	cache := a.cache
+	for _, col := range cache.cols {
+		if col > c {
+			break
+		}
+		rows := cache.byCol[col]
+		for cache.checked[col] < len(rows) && rows[cache.checked[col]] <= r {
+			k := [2]int{rows[cache.checked[col]], col}
+			cache.checked[col]++
+			if !visited[k] {
+				a.cellValue(k[0], k[1], visited)
+			}
+		}
+	}
+	k, ok := cache.spills[[2]int{r, c}]
+	if !ok {
+		return [2]int{}, calc.Value{}, false
+	}
+	return k, cache.values[k].At(r-k[0], c-k[1]), true
+}
+
+// spillSize is the calc.Env hook behind A1# references.
+func (a *App) spillSize(visited map[[2]int]bool) func(r, c int) (int, int, bool) {
+	return func(r, c int) (int, int, bool) {
+		if r < 0 || c < 0 {
+			return 0, 0, false
+		}
+		v := a.cellValue(r, c, visited)
+		if v.Kind != calc.KindArray {
+			return 0, 0, false
+		}
+		return v.Rows, v.Cols, true
+	}
+}
@@ -0,0 +1,124 @@
+package app
+
+import (
+	"iter"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/uniseg"
+)
+
+// ellipsis marks text cut to fit its space.
+const ellipsis = '…'
+
+// textWidth is the width of s in screen cells: East Asian wide characters
+// and emoji take two, combining marks none.
+func textWidth(s string) int {
+	return uniseg.StringWidth(s)
+}
+
+// graphemes yields the grapheme clusters of s (what is drawn as one
+// character, e.g. a letter with its combining marks or a flag) with their
+// widths.
+func graphemes(s string) iter.Seq2[string, int] {
+	return func(yield func(string, int) bool) {
+		state := -1
+		for s != "" {
+			var cluster string
+			var width int
+			cluster, s, width, state = uniseg.FirstGraphemeClusterInString(s, state)
+			if !yield(cluster, width) {
+				return
+			}
+		}
+	}
+}
+
+// cutText returns the leading clusters of s that fit in width cells.
+func cutText(s string, width int) string {
+	n, used := 0, 0
+	for g, w := range graphemes(s) {
+		if used+w > width {
+			break
+		}
+		n += len(g)
+		used += w
+	}
+	return s[:n]
+}
+
+// skipText drops leading clusters of s covering width cells. A wide
+// cluster cut in half leaves a space in place of its right half.
+func skipText(s string, width int) string {
+	n, used := 0, 0
+	for g, w := range graphemes(s) {
+		if used >= width {
+			break
+		}
+		n += len(g)
+		used += w
+	}
+	return strings.Repeat(" ", used-width) + s[n:]
+}
+
+// fitText cuts s to width cells, ending it with an ellipsis if anything was
+// cut.
+func fitText(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	if textWidth(s) <= width {
+		return s
+	}
+	return cutText(s, width-1) + string(ellipsis)
+}
+
+// putText draws s from x on row y cluster by cluster, stopping before
+// limit, and returns the x after the last drawn cluster.
+func putText(s tcell.Screen, x, y int, str string, style tcell.Style, limit int) int {
+	for g, w := range graphemes(str) {
+		if x+w > limit {
+			break
+		}
+		if w == 0 {
+			continue // a control character
+		}
+		runes := []rune(g)
+		if x >= 0 && y >= 0 {
+			s.SetContent(x, y, runes[0], runes[1:], style)
+		}
+		x += w
+	}
+	return x
+}
+
+// chunkText splits s into pieces at most width cells wide.
+func chunkText(s string, width int) []string {
+	var out []string
+	for s != "" {
+		piece := cutText(s, width)
+		if piece == "" {
+			piece, _, _, _ = uniseg.FirstGraphemeClusterInString(s, -1)
+		}
+		out = append(out, piece)
+		s = s[len(piece):]
+	}
+	return out
+}
+
+// runeCluster is a grapheme cluster of a rune slice: runes [start, end)
+// taking width cells.
+type runeCluster struct{ start, end, width int }
+
+// runeClusters splits buf into grapheme clusters.
+func runeClusters(buf []rune) []runeCluster {
+	var out []runeCluster
+	i := 0
+	for g, w := range graphemes(string(buf)) {
+		n := utf8.RuneCountInString(g)
+		out = append(out, runeCluster{i, i + n, w})
+		i += n
+	}
+	return out
+}
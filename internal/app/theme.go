@@ -0,0 +1,343 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// A theme maps style roles to style specs: a foreground colour, "on" and a
+// background colour, and attributes, each part optional, e.g. "yellow",
+// "black on lightgray", "on steelblue bold". Colours are W3C names or
+// #rrggbb.
+//
+// Roles drawn on top of another style (filter-button, note, invalid,
+// formulabar-info, border in a cell, popup-*, formula-*) change only what
+// their spec sets.
+var themes = map[string]map[string]string{
+	"dark": {
+		"header":          "yellow",
+		"header-active":   "black on yellow",
+		"gutter":          "yellow",
+		"gutter-filtered": "dodgerblue",
+		"cell":            "",
+		"cursor":          "black on lightgray",
+		"selection":       "white on darkblue",
+		"match":           "black on yellow",
+		"point":           "white on darkcyan",
+		"edit-cursor":     "white on red",
+		"filter-button":   "dodgerblue bold",
+		"note":            "red",
+		"invalid":         "on maroon",
+		"gridline":        "dimgray",
+		"border":          "white",
+		"status":          "white on gray",
+		"error":           "red on gray",
+		"formulabar":      "white on #303030",
+		"formulabar-info": "gray",
+		"popup":           "white on reset",
+		"popup-item":      "on darkslategray",
+		"popup-selected":  "on steelblue bold",
+		"popup-dim":       "gray",
+		"formula-number":  "lightgreen",
+		"formula-string":  "yellow",
+		"formula-ref":     "lightskyblue",
+		"formula-func":    "fuchsia bold",
+		"formula-name":    "aqua",
+		"formula-error":   "red",
+		"formula-bad":     "white on darkred",
+		"logo":            "white bold",
+		"logo-accent":     "yellow bold",
+	},
+	"light": {
+		"header":          "navy bold",
+		"header-active":   "white on navy bold",
+		"gutter":          "navy",
+		"gutter-filtered": "blue bold",
+		"cell":            "",
+		"cursor":          "black on lightsteelblue",
+		"selection":       "black on lightblue",
+		"match":           "black on gold",
+		"point":           "black on paleturquoise",
+		"edit-cursor":     "white on firebrick",
+		"filter-button":   "blue bold",
+		"note":            "red",
+		"invalid":         "on mistyrose",
+		"gridline":        "lightgray",
+		"border":          "black",
+		"status":          "black on lightgray",
+		"error":           "darkred on lightgray",
+		"formulabar":      "black on whitesmoke",
+		"formulabar-info": "dimgray",
+		"popup":           "black on reset",
+		"popup-item":      "on gainsboro",
+		"popup-selected":  "white on steelblue bold",
+		"popup-dim":       "dimgray",
+		"formula-number":  "darkgreen",
+		"formula-string":  "saddlebrown",
+		"formula-ref":     "blue",
+		"formula-func":    "purple bold",
+		"formula-name":    "teal",
+		"formula-error":   "red",
+		"formula-bad":     "white on darkred",
+		"logo":            "black bold",
+		"logo-accent":     "darkgoldenrod bold",
+	},
+	"high-contrast": {
+		"header":          "white bold",
+		"header-active":   "black on white bold",
+		"gutter":          "white bold",
+		"gutter-filtered": "aqua bold",
+		"cell":            "white on black",
+		"cursor":          "black on yellow bold",
+		"selection":       "white on blue bold",
+		"match":           "black on lime",
+		"point":           "black on fuchsia",
+		"edit-cursor":     "white on red bold",
+		"filter-button":   "aqua bold",
+		"note":            "red bold",
+		"invalid":         "white on red",
+		"gridline":        "gray",
+		"border":          "white bold",
+		"status":          "black on white",
+		"error":           "white on red bold",
+		"formulabar":      "white on black",
+		"formulabar-info": "yellow",
+		"popup":           "white on black",
+		"popup-item":      "white on navy",
+		"popup-selected":  "black on yellow bold",
+		"popup-dim":       "silver",
+		"formula-number":  "lime",
+		"formula-string":  "yellow",
+		"formula-ref":     "aqua",
+		"formula-func":    "fuchsia bold",
+		"formula-name":    "aqua underline",
+		"formula-error":   "red bold",
+		"formula-bad":     "white on red",
+		"logo":            "white bold",
+		"logo-accent":     "yellow bold",
+	},
+}
+
+var styleAttrs = map[string]tcell.AttrMask{
+	"bold":          tcell.AttrBold,
+	"dim":           tcell.AttrDim,
+	"italic":        tcell.AttrItalic,
+	"reverse":       tcell.AttrReverse,
+	"blink":         tcell.AttrBlink,
+	"strikethrough": tcell.AttrStrikeThrough,
+}
+
+// parseStyle parses a style spec (see themes).
+func parseStyle(spec string) (tcell.Style, error) {
+	st := tcell.StyleDefault
+	bg := false
+	for _, word := range strings.Fields(strings.ToLower(spec)) {
+		if word == "on" {
+			bg = true
+			continue
+		}
+		if word == "underline" {
+			st = st.Underline(true)
+			continue
+		}
+		if attr, ok := styleAttrs[word]; ok {
+			st = st.Attributes(attr | attrsOf(st))
+			continue
+		}
+		c := tcell.GetColor(word)
+		switch word {
+		case "default":
+			c = tcell.ColorDefault
+		case "reset":
+			c = tcell.ColorReset
+		default:
+			if c == tcell.ColorDefault {
+				return st, fmt.Errorf("unknown colour or attribute %q", word)
+			}
+		}
+		if bg {
+			st = st.Background(c)
+		} else {
+			st = st.Foreground(c)
+		}
+	}
+	return st, nil
+}
+
+func attrsOf(st tcell.Style) tcell.AttrMask {
+	_, _, attrs := st.Decompose()
+	return attrs
+}
+
+// degrade fits st to a terminal with the given number of colours: colours
+// become the nearest of the 8 or 16 basic ones (a foreground that ends up
+// the same as the background is replaced by black or white), and without
+// colours a style with a background is shown reversed.
+func degrade(st tcell.Style, colors int) tcell.Style {
+	fg, bg, attrs := st.Decompose()
+	switch {
+	case colors >= 256:
+		return st
+	case colors < 8:
+		out := tcell.StyleDefault.Attributes(attrs)
+		if bg != tcell.ColorDefault && bg != tcell.ColorReset {
+			out = out.Reverse(true)
+		}
+		return out
+	}
+	palette := make([]tcell.Color, minInt(colors, 16))
+	for i := range palette {
+		palette[i] = tcell.PaletteColor(i)
+	}
+	fit := func(c tcell.Color) tcell.Color {
+		if !c.Valid() || c == tcell.ColorReset {
+			return c
+		}
+		return tcell.FindColor(c, palette)
+	}
+	fg, bg = fit(fg), fit(bg)
+	if fg == bg && fg.Valid() {
+		fg = tcell.ColorWhite
+		if bg == tcell.ColorWhite || bg == tcell.ColorSilver {
+			fg = tcell.ColorBlack
+		}
+	}
+	return st.Foreground(fg).Background(bg)
+}
+
+// themeFile is a custom theme: the roles it changes in a built-in base
+// theme (dark by default).
+type themeFile struct {
+	Base   string            `json:"base"`
+	Styles map[string]string `json:"styles"`
+}
+
+// themeDir is where custom themes NAME.json are looked for.
+func themeDir() string {
+	if path := ConfigPath(); path != "" {
+		return filepath.Join(filepath.Dir(path), "themes")
+	}
+	return ""
+}
+
+// loadTheme returns the style specs of the built-in theme name or of a
+// custom theme: name.json in themeDir, or a path to a .json file.
+func loadTheme(name string) (map[string]string, error) {
+	if spec, ok := themes[name]; ok {
+		return spec, nil
+	}
+	path := name
+	if !strings.HasSuffix(name, ".json") {
+		path = filepath.Join(themeDir(), name+".json")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unknown theme %s", name)
+	}
+	var tf themeFile
+	if err := json.Unmarshal(data, &tf); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if tf.Base == "" {
+		tf.Base = "dark"
+	}
+	base, ok := themes[tf.Base]
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown base theme %s", path, tf.Base)
+	}
+	spec := maps.Clone(base)
+	var errs []error
+	for role, st := range tf.Styles {
+		if _, ok := base[role]; !ok {
+			errs = append(errs, fmt.Errorf("unknown role %s", role))
+			continue
+		}
+		if _, err := parseStyle(st); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", role, err))
+			continue
+		}
+		spec[role] = st
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return spec, nil
+}
+
+// SetTheme switches to the theme name (see loadTheme).
+func (a *App) SetTheme(name string) error {
+	spec, err := loadTheme(name)
+	if err != nil {
+		return err
+	}
+	a.Theme, a.themeSpec, a.styles = name, spec, nil
+	return nil
+}
+
+// useColors resolves the styles of the theme for a terminal with the given
+// number of colours. Draw calls it on every frame; it only works when the
+// theme or the terminal changed.
+func (a *App) useColors(colors int) {
+	if a.styles != nil && a.styleColors == colors {
+		return
+	}
+	a.styles = map[string]tcell.Style{}
+	a.styleColors = colors
+	for role, spec := range a.themeSpec {
+		st, _ := parseStyle(spec)
+		a.styles[role] = degrade(st, colors)
+	}
+}
+
+// style returns the style of a theme role.
+func (a *App) style(role string) tcell.Style {
+	return a.styles[role]
+}
+
+// overlay draws role on top of base: only the colours the role sets
+// replace those of base, and its attributes are added.
+func (a *App) overlay(base tcell.Style, role string) tcell.Style {
+	return overlayStyle(base, a.styles[role])
+}
+
+// overlayStyle draws st on top of base (see overlay).
+func overlayStyle(base, st tcell.Style) tcell.Style {
+	fg, bg, attrs := st.Decompose()
+	if fg != tcell.ColorDefault {
+		base = base.Foreground(fg)
+	}
+	if bg != tcell.ColorDefault {
+		base = base.Background(bg)
+	}
+	base = base.Attributes(attrsOf(base) | attrs)
+	if attrs&tcell.AttrUnderline != 0 {
+		base = base.Underline(true)
+	}
+	return base
+}
+
+// themeCommand handles :theme NAME and :theme (list the themes).
+func (a *App) themeCommand(args []string) {
+	if len(args) == 0 {
+		names := sortedKeys(themes)
+		if files, err := filepath.Glob(filepath.Join(themeDir(), "*.json")); err == nil {
+			for _, f := range files {
+				names = append(names, strings.TrimSuffix(filepath.Base(f), ".json"))
+			}
+		}
+		sort.Strings(names)
+		a.StatusMsg = fmt.Sprintf("theme %s; available: %s", a.Theme, strings.Join(names, ", "))
+		return
+	}
+	if err := a.SetTheme(strings.Join(args, " ")); err != nil {
+		a.StatusMsg = strings.ReplaceAll(err.Error(), "\n", "; ")
+	}
+}
@@ -0,0 +1,107 @@
+package app
+
+import (
+	"maps"
+	"slices"
+
+	"sheet/internal/grid"
+	"sheet/internal/storage"
+)
+
+// maxUndo bounds the undo history.
+const maxUndo = 100
+
+// snapshot is the sheet state before a change, for undo and redo.
+type snapshot struct {
+	grid       map[[2]int]grid.Cell
+	names      map[string]string
+	colWidths  []int
+	rowHeights []int
+	hiddenRows map[int]bool
+	hiddenCols map[int]bool
+	rowLevels  map[int]int
+	colLevels  map[int]int
+	merges     map[[2]int][2]int
+	rules      []storage.Rule
+	checks     []storage.Check
+	filter     *filterState
+	row, col   int
+}
+
+func (a *App) snapshot() snapshot {
+	return snapshot{
+		grid:       maps.Clone(a.Grid),
+		names:      maps.Clone(a.Names),
+		colWidths:  slices.Clone(a.ColWidths),
+		rowHeights: slices.Clone(a.RowHeights),
+		hiddenRows: maps.Clone(a.HiddenRows),
+		hiddenCols: maps.Clone(a.HiddenCols),
+		rowLevels:  maps.Clone(a.RowLevels),
+		colLevels:  maps.Clone(a.ColLevels),
+		merges:     maps.Clone(a.Merges),
+		rules:      slices.Clone(a.Rules),
+		checks:     slices.Clone(a.Checks),
+		filter:     a.filter.clone(),
+		row:        a.CurRow,
+		col:        a.CurCol,
+	}
+}
+
+func (a *App) restore(sn snapshot) {
+	a.Grid = sn.grid
+	a.Names = sn.names
+	a.ColWidths = sn.colWidths
+	a.RowHeights = sn.rowHeights
+	a.HiddenRows, a.HiddenCols = sn.hiddenRows, sn.hiddenCols
+	a.RowLevels, a.ColLevels = sn.rowLevels, sn.colLevels
+	a.Merges = sn.merges
+	a.Rules = sn.rules
+	a.Checks = sn.checks
+	a.filter = sn.filter
+	a.CurRow, a.CurCol = sn.row, sn.col
+}
+
+// pushUndo records the current state before a change. Everything changed
+// until the next pushUndo is undone as one step.
+func (a *App) pushUndo() {
+	a.undo = append(a.undo, a.snapshot())
+	if len(a.undo) > maxUndo {
+		a.undo = a.undo[1:]
+	}
+	a.redo = nil
+}
+
+// Undo reverts the last change; it returns false when there is none.
+func (a *App) Undo() bool {
+	if len(a.undo) == 0 {
+		return false
+	}
+	a.redo = append(a.redo, a.snapshot())
+	a.restore(a.undo[len(a.undo)-1])
+	a.undo = a.undo[:len(a.undo)-1]
+	return true
+}
+
+// Redo reapplies a change reverted by Undo.
+func (a *App) Redo() bool {
+	if len(a.redo) == 0 {
+		return false
+	}
+	a.undo = append(a.undo, a.snapshot())
+	a.restore(a.redo[len(a.redo)-1])
+	a.redo = a.redo[:len(a.redo)-1]
+	return true
+}
+
+// dropUndo forgets the last pushUndo when the change did not happen after
+// all.
+func (a *App) dropUndo() {
+	if len(a.undo) > 0 {
+		a.undo = a.undo[:len(a.undo)-1]
+	}
+}
+
+// clearUndo forgets the history, e.g. when another document is loaded.
+func (a *App) clearUndo() {
+	a.undo, a.redo = nil, nil
+}
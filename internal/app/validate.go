@@ -0,0 +1,353 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+
+	"sheet/internal/calc"
+	"sheet/internal/grid"
+	"sheet/internal/storage"
+)
+
+// checkKinds are the kinds of validation rules.
+var checkKinds = []string{"number", "list", "regex", "date", "formula"}
+
+// dateLayouts are the date formats :validate date reads, in cells and in
+// its bounds.
+var dateLayouts = []string{"2006-01-02", "02.01.2006", "2006/01/02"}
+
+// dropdownMark is drawn in the cursor cell when it has a list of values to
+// pick from.
+const dropdownMark = '▾'
+
+// parseDate parses a date in one of dateLayouts and returns the layout it
+// was written in.
+func parseDate(s string) (time.Time, string, bool) {
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, strings.TrimSpace(s)); err == nil {
+			return t, layout, true
+		}
+	}
+	return time.Time{}, "", false
+}
+
+// dateDays parses a date as days since 1970.
+func dateDays(s string) (float64, bool) {
+	t, _, ok := parseDate(s)
+	return float64(t.Unix() / 86400), ok
+}
+
+func parseNumber(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
+
+// parseBounds parses "MIN MAX" of a number or date rule; * leaves a side
+// open.
+func parseBounds(args string, parse func(string) (float64, bool)) (lo, hi float64, ok bool) {
+	f := strings.Fields(args)
+	if len(f) != 2 {
+		return 0, 0, false
+	}
+	lo, hi = math.Inf(-1), math.Inf(1)
+	if f[0] != "*" {
+		if lo, ok = parse(f[0]); !ok {
+			return 0, 0, false
+		}
+	}
+	if f[1] != "*" {
+		if hi, ok = parse(f[1]); !ok {
+			return 0, 0, false
+		}
+	}
+	return lo, hi, lo <= hi
+}
+
+// checkFor returns the validation rule of cell r, c (the last one whose
+// range holds it) and the top-left cell of its range.
+func (a *App) checkFor(r, c int) (ch storage.Check, r1, c1 int, ok bool) {
+	for i := len(a.Checks) - 1; i >= 0; i-- {
+		cr1, cc1, cr2, cc2, found := a.rangeBounds(a.Checks[i].Range)
+		if found && r >= cr1 && r <= cr2 && c >= cc1 && c <= cc2 {
+			return a.Checks[i], cr1, cc1, true
+		}
+	}
+	return storage.Check{}, 0, 0, false
+}
+
+// checkList returns the allowed values of a list rule: written out
+// (yes,no) or the values of a range (=H1:H5).
+func (a *App) checkList(ch storage.Check) []string {
+	ref, isRange := strings.CutPrefix(ch.Args, "=")
+	if !isRange {
+		var items []string
+		for _, item := range strings.Split(ch.Args, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items
+	}
+	r1, c1, r2, c2, ok := a.rangeBounds(ref)
+	if !ok {
+		return nil
+	}
+	var items []string
+	a.withEvalCache(func() {
+		for r := r1; r <= r2; r++ {
+			for c := c1; c <= c2; c++ {
+				text := formatValue(a.cellValue(r, c, map[[2]int]bool{}))
+				if text != "" && !slices.Contains(items, text) {
+					items = append(items, text)
+				}
+			}
+		}
+	})
+	return items
+}
+
+// invalid returns why the value of cell r, c breaks its validation rule,
+// or "" when it is valid, blank or not validated.
+func (a *App) invalid(r, c int) string {
+	ch, r1, c1, ok := a.checkFor(r, c)
+	if !ok {
+		return ""
+	}
+	reason := ""
+	a.withEvalCache(func() {
+		v := a.cellValue(r, c, map[[2]int]bool{}).First()
+		if v.Kind == calc.KindBlank {
+			return
+		}
+		text := formatValue(v)
+		switch ch.Kind {
+		case "number":
+			lo, hi, _ := parseBounds(ch.Args, parseNumber)
+			switch {
+			case v.Kind != calc.KindNumber:
+				reason = text + " is not a number"
+			case v.Num < lo:
+				reason = text + " is less than " + strings.Fields(ch.Args)[0]
+			case v.Num > hi:
+				reason = text + " is greater than " + strings.Fields(ch.Args)[1]
+			}
+		case "date":
+			lo, hi, _ := parseBounds(ch.Args, dateDays)
+			d, ok := dateDays(text)
+			switch {
+			case !ok:
+				reason = text + " is not a date"
+			case d < lo:
+				reason = text + " is before " + strings.Fields(ch.Args)[0]
+			case d > hi:
+				reason = text + " is after " + strings.Fields(ch.Args)[1]
+			}
+		case "list":
+			if !slices.ContainsFunc(a.checkList(ch), func(item string) bool { return strings.EqualFold(item, text) }) {
+				reason = text + " is not in the list " + ch.Args
+			}
+		case "regex":
+			re, err := regexp.Compile("^(?:" + ch.Args + ")$")
+			if err != nil || !re.MatchString(text) {
+				reason = text + " does not match " + ch.Args
+			}
+		case "formula":
+			expr := calc.OffsetRefs(ch.Args, r-r1, c-c1)
+			res := calc.EvalExprForCell(expr, a.formulaEnv(map[[2]int]bool{})).AsNumber()
+			if res.IsError() || res.Num == 0 {
+				reason = text + " fails =" + expr
+			}
+		}
+	})
+	return reason
+}
+
+// listCell reports whether cell r, c has a list of values to pick from.
+func (a *App) listCell(r, c int) bool {
+	ch, _, _, ok := a.checkFor(r, c)
+	return ok && ch.Kind == "list"
+}
+
+// onDropdown reports whether screen column x in cell r, c is the dropdown
+// mark of the cursor cell.
+func (a *App) onDropdown(x, r, c int) bool {
+	r, c = a.blockStart(r, c)
+	if r != a.CurRow || c != a.CurCol || !a.listCell(r, c) {
+		return false
+	}
+	cx, _, ok := a.cellOrigin(r, c)
+	w, _ := a.cellSize(r, c)
+	return ok && x == cx+w-1
+}
+
+// pickValue shows the allowed values of a list-validated cell in a popup
+// and enters the chosen one.
+func (a *App) pickValue(s tcell.Screen) {
+	r, c := a.blockStart(a.CurRow, a.CurCol)
+	ch, _, _, ok := a.checkFor(r, c)
+	if !ok || ch.Kind != "list" {
+		a.StatusMsg = "no list of values here (see :validate)"
+		return
+	}
+	items := a.checkList(ch)
+	if len(items) == 0 {
+		a.StatusMsg = "the list " + ch.Args + " is empty"
+		return
+	}
+	current := a.GetDisplayText(r, c)
+	sel := slices.IndexFunc(items, func(item string) bool { return strings.EqualFold(item, current) })
+	if i, ok := a.PopupList(s, grid.ColRowToName(c, r), items, sel); ok {
+		a.commitEdit(items[i])
+	}
+}
+
+// shiftChecks rewrites the ranges of the validation rules, and the
+// references of list ranges and formulas, after rows or columns were
+// inserted or deleted; rules whose range was deleted are dropped.
+func (a *App) shiftChecks(shift func(expr string) string) {
+	var out []storage.Check
+	for _, ch := range a.Checks {
+		ch.Range = shift(ch.Range)
+		if strings.Contains(ch.Range, "#REF!") {
+			continue
+		}
+		if ch.Kind == "formula" || (ch.Kind == "list" && strings.HasPrefix(ch.Args, "=")) {
+			ch.Args = shift(ch.Args)
+		}
+		out = append(out, ch)
+	}
+	a.Checks = out
+}
+
+// checkText formats a rule as the arguments of :validate that define it.
+func checkText(ch storage.Check) string {
+	words := []string{ch.Range}
+	if ch.Warn {
+		words = append(words, "warn")
+	}
+	return strings.Join(append(words, ch.Kind, ch.Args), " ")
+}
+
+func (a *App) checksText() string {
+	var b strings.Builder
+	b.WriteString("Validation:\n")
+	for i, ch := range a.Checks {
+		fmt.Fprintf(&b, "%2d  %s\n", i+1, checkText(ch))
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// validateCommand handles data validation:
+//
+//	:validate [RANGE] [warn] number MIN MAX   numbers from MIN to MAX (* for no bound)
+//	:validate [RANGE] [warn] list a,b,c       one of the values; list =H1:H5 takes them from a range
+//	:validate [RANGE] [warn] regex PATTERN    text matching PATTERN as a whole
+//	:validate [RANGE] [warn] date FROM TO     dates (2024-01-31 or 31.01.2024) from FROM to TO
+//	:validate [RANGE] [warn] formula EXPR     EXPR is true, e.g. formula C2<=B2
+//	:validate                                 list the rules
+//	:validate delete N                        delete rule N of the list
+//	:validate clear [all]                     delete the rules on the selection or the cursor
+//
+// RANGE defaults to the selection or the current cell. Invalid input is
+// rejected, or with warn entered and flagged; references in a formula are
+// written for the top-left cell of the range, as for :cf.
+func (a *App) validateCommand(args []string) {
+	const usage = "usage: :validate [RANGE] [warn] number MIN MAX | list VALUES | regex PATTERN | date FROM TO | formula EXPR"
+	if len(args) == 0 || args[0] == "list" && len(args) == 1 {
+		if len(a.Checks) == 0 {
+			a.StatusMsg = "no validation rules"
+			return
+		}
+		a.InfoText = a.checksText()
+		return
+	}
+	switch args[0] {
+	case "delete", "del":
+		n := 0
+		if len(args) == 2 {
+			n, _ = strconv.Atoi(args[1])
+		}
+		if n < 1 || n > len(a.Checks) {
+			a.StatusMsg = "usage: :validate delete N (see :validate for the numbers)"
+			return
+		}
+		a.pushUndo()
+		a.Checks = slices.Delete(a.Checks, n-1, n)
+		return
+	case "clear":
+		a.pushUndo()
+		n := len(a.Checks)
+		if len(args) == 2 && args[1] == "all" {
+			a.Checks = nil
+		} else {
+			a.Checks = slices.DeleteFunc(a.Checks, func(ch storage.Check) bool { return a.touchesSelection(ch.Range) })
+		}
+		a.StatusMsg = fmt.Sprintf("deleted %d validation rule(s)", n-len(a.Checks))
+		return
+	}
+
+	var ch storage.Check
+	switch {
+	case len(args) > 1 && a.isRangeRef(args[0]):
+		ch.Range, args = strings.ToUpper(args[0]), args[1:]
+	case a.Anchor != nil:
+		ch.Range = a.selectionText()
+	default:
+		ch.Range = grid.ColRowToName(a.CurCol, a.CurRow)
+	}
+	if args[0] == "warn" {
+		ch.Warn, args = true, args[1:]
+	}
+	if len(args) < 2 || !slices.Contains(checkKinds, args[0]) {
+		a.StatusMsg = usage
+		return
+	}
+	ch.Kind, ch.Args = args[0], strings.Join(args[1:], " ")
+	bad := ""
+	switch ch.Kind {
+	case "number":
+		if _, _, ok := parseBounds(ch.Args, parseNumber); !ok {
+			bad = "expected MIN MAX, e.g. 0 100 or 0 *"
+		}
+	case "date":
+		if _, _, ok := parseBounds(ch.Args, dateDays); !ok {
+			bad = "expected FROM TO, e.g. 2024-01-01 2024-12-31 or 2024-01-01 *"
+		}
+	case "list":
+		if ref := strings.TrimPrefix(ch.Args, "="); a.isRangeRef(ref) {
+			ch.Args = "=" + strings.ToUpper(ref)
+		}
+	case "regex":
+		if _, err := regexp.Compile(ch.Args); err != nil {
+			bad = err.Error()
+		}
+	case "formula":
+		ch.Args = strings.TrimPrefix(ch.Args, "=")
+	}
+	if bad != "" {
+		a.StatusMsg = "validate " + ch.Kind + ": " + bad
+		return
+	}
+	a.pushUndo()
+	a.Checks = append(a.Checks, ch)
+	a.Anchor = nil
+	a.StatusMsg = "validate " + checkText(ch)
+	if r1, c1, r2, c2, ok := a.rangeBounds(ch.Range); ok {
+		n := 0
+		for k := range a.Grid {
+			if k[0] >= r1 && k[0] <= r2 && k[1] >= c1 && k[1] <= c2 && a.invalid(k[0], k[1]) != "" {
+				n++
+			}
+		}
+		if n > 0 {
+			a.StatusMsg += fmt.Sprintf(" (%d invalid value(s) flagged)", n)
+		}
+	}
+}
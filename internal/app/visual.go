@@ -0,0 +1,54 @@
+package app
+
+import (
+	"github.com/gdamore/tcell/v2"
+
+	"sheet/internal/grid"
+)
+
+// selection returns the selected rectangle (anchor to cursor), or ok false
+// when nothing is selected.
+func (a *App) selection() (r1, c1, r2, c2 int, ok bool) {
+	if a.Anchor == nil {
+		return 0, 0, 0, 0, false
+	}
+	r1, r2 = minInt(a.Anchor[0], a.CurRow), maxInt(a.Anchor[0], a.CurRow)
+	c1, c2 = minInt(a.Anchor[1], a.CurCol), maxInt(a.Anchor[1], a.CurCol)
+	return r1, c1, r2, c2, true
+}
+
+// selected reports whether cell r, c is inside the selection.
+func (a *App) selected(r, c int) bool {
+	r1, c1, r2, c2, ok := a.selection()
+	return ok && r >= r1 && r <= r2 && c >= c1 && c <= c2
+}
+
+// selectionText formats the selection like A1:C4 for the status line.
+func (a *App) selectionText() string {
+	r1, c1, r2, c2, ok := a.selection()
+	if !ok {
+		return ""
+	}
+	return grid.ColRowToName(c1, r1) + ":" + grid.ColRowToName(c2, r2)
+}
+
+// toggleVisual starts a selection at the cursor or drops the current one.
+func (a *App) toggleVisual() {
+	if a.Anchor != nil {
+		a.Anchor = nil
+		return
+	}
+	a.Anchor = &[2]int{a.CurRow, a.CurCol}
+}
+
+// extend returns an action that moves the cursor like move(dr, dc) while
+// growing the selection, starting one at the cursor if needed (Shift+arrows).
+func extend(dr, dc int) action {
+	m := move(dr, dc)
+	return action{run: func(a *App, s tcell.Screen, count int, arg rune) {
+		if a.Anchor == nil {
+			a.Anchor = &[2]int{a.CurRow, a.CurCol}
+		}
+		m.run(a, s, count, arg)
+	}}
+}
@@ -0,0 +1,353 @@
+package calc
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// maxArrayCells bounds arrays built by SEQUENCE and friends.
+const maxArrayCells = 1 << 20
+
+// Array returns a rows x cols array value; vals is in row-major order.
+func Array(rows, cols int, vals []Value) Value {
+	return Value{Kind: KindArray, Rows: rows, Cols: cols, Arr: vals}
+}
+
+// Dims returns the size of v; scalars are 1x1.
+func (v Value) Dims() (rows, cols int) {
+	if v.Kind == KindArray {
+		return v.Rows, v.Cols
+	}
+	return 1, 1
+}
+
+// At returns element r, c of an array. Scalars and single rows/columns are
+// broadcast; positions outside a larger array are #N/A.
+func (v Value) At(r, c int) Value {
+	if v.Kind != KindArray {
+		return v
+	}
+	if v.Rows == 1 {
+		r = 0
+	}
+	if v.Cols == 1 {
+		c = 0
+	}
+	if r >= v.Rows || c >= v.Cols {
+		return Errorf(ErrNA, "no value at position %d,%d of a %dx%d array", r+1, c+1, v.Rows, v.Cols)
+	}
+	return v.Arr[r*v.Cols+c]
+}
+
+// First returns the top-left element of an array, or v itself. This is
+// what a plain reference to the anchor cell of a spill range sees.
+func (v Value) First() Value {
+	if v.Kind == KindArray {
+		if len(v.Arr) == 0 {
+			return Value{}
+		}
+		return v.Arr[0]
+	}
+	return v
+}
+
+// lift2 applies fn element-wise when either operand is an array, the way
+// range arithmetic (=A1:A10*2) works. The result has the larger of the two
+// sizes along each axis.
+func lift2(l, r Value, fn func(l, r Value) Value) Value {
+	if l.Kind != KindArray && r.Kind != KindArray {
+		return fn(l, r)
+	}
+	lr, lc := l.Dims()
+	rr, rc := r.Dims()
+	rows, cols := maxInt(lr, rr), maxInt(lc, rc)
+	if cols > 0 && rows > maxArrayCells/cols {
+		return Errorf(ErrNum, "array of %dx%d elements is too large", rows, cols)
+	}
+	out := make([]Value, 0, rows*cols)
+	for i := 0; i < rows; i++ {
+		for j := 0; j < cols; j++ {
+			out = append(out, fn(l.At(i, j), r.At(i, j)))
+		}
+	}
+	return Array(rows, cols, out)
+}
+
+// lift1 is lift2 for unary operations.
+func lift1(v Value, fn func(v Value) Value) Value {
+	if v.Kind != KindArray {
+		return fn(v)
+	}
+	out := make([]Value, len(v.Arr))
+	for i, e := range v.Arr {
+		out[i] = fn(e)
+	}
+	return Array(v.Rows, v.Cols, out)
+}
+
+// compareValues orders two scalars: numbers before text, text compared
+// case-insensitively. Blanks compare as 0 or "" depending on the other side.
+func compareValues(l, r Value) int {
+	if l.Kind == KindBlank {
+		if r.Kind == KindText {
+			l = Text("")
+		} else {
+			l = Number(0)
+		}
+	}
+	if r.Kind == KindBlank {
+		if l.Kind == KindText {
+			r = Text("")
+		} else {
+			r = Number(0)
+		}
+	}
+	switch {
+	case l.Kind == KindNumber && r.Kind == KindNumber:
+		switch {
+		case l.Num < r.Num:
+			return -1
+		case l.Num > r.Num:
+			return 1
+		}
+		return 0
+	case l.Kind == KindNumber:
+		return -1
+	case r.Kind == KindNumber:
+		return 1
+	}
+	return strings.Compare(strings.ToLower(l.Str), strings.ToLower(r.Str))
+}
+
+func compare(op string, l, r Value) Value {
+	return lift2(l, r, func(l, r Value) Value {
+		if l.IsError() {
+			return l
+		}
+		if r.IsError() {
+			return r
+		}
+		c := compareValues(l, r)
+		switch op {
+		case "=":
+			return boolValue(c == 0)
+		case "<>":
+			return boolValue(c != 0)
+		case "<":
+			return boolValue(c < 0)
+		case ">":
+			return boolValue(c > 0)
+		case "<=":
+			return boolValue(c <= 0)
+		default:
+			return boolValue(c >= 0)
+		}
+	})
+}
+
+// arrayArg evaluates a function argument that may be a range or array.
+func (p *parser) arrayArg(arg string) Value {
+	v := p.evalArg(arg)
+	if v.Kind == KindArray || v.IsError() {
+		return v
+	}
+	return Array(1, 1, []Value{v})
+}
+
+// intArg evaluates an optional integer argument. Huge values are clamped
+// to the int32 range so that callers can compare and multiply them safely.
+func (p *parser) intArg(args []string, i, def int) (int, Value) {
+	if i >= len(args) {
+		return def, Value{}
+	}
+	v := p.evalArg(args[i]).AsNumber()
+	if v.IsError() {
+		return 0, v
+	}
+	return int(math.Max(math.MinInt32, math.Min(math.MaxInt32, math.Trunc(v.Num)))), Value{}
+}
+
+// SEQUENCE(rows, [cols], [start], [step])
+func (p *parser) fnSequence(args []string) Value {
+	if len(args) < 1 || len(args) > 4 {
+		return argCountError("SEQUENCE", "1 to 4")
+	}
+	rows, errv := p.intArg(args, 0, 1)
+	if errv.IsError() {
+		return errv
+	}
+	cols, errv := p.intArg(args, 1, 1)
+	if errv.IsError() {
+		return errv
+	}
+	start, step := 1.0, 1.0
+	for i, dst := range []*float64{&start, &step} {
+		if 2+i < len(args) {
+			v := p.evalArg(args[2+i]).AsNumber()
+			if v.IsError() {
+				return v
+			}
+			*dst = v.Num
+		}
+	}
+	if rows < 1 || cols < 1 || rows > maxArrayCells/cols {
+		return Errorf(ErrNum, "SEQUENCE size %dx%d is out of range", rows, cols)
+	}
+	out := make([]Value, rows*cols)
+	for i := range out {
+		out[i] = Number(start + float64(i)*step)
+	}
+	return Array(rows, cols, out)
+}
+
+// TRANSPOSE(array)
+func (p *parser) fnTranspose(args []string) Value {
+	if len(args) != 1 {
+		return argCountError("TRANSPOSE", "1")
+	}
+	v := p.arrayArg(args[0])
+	if v.IsError() {
+		return v
+	}
+	return transpose(v)
+}
+
+// UNIQUE(array) keeps the first occurrence of every distinct row.
+func (p *parser) fnUnique(args []string) Value {
+	if len(args) != 1 {
+		return argCountError("UNIQUE", "1")
+	}
+	v := p.arrayArg(args[0])
+	if v.IsError() {
+		return v
+	}
+	var out []Value
+	rows := 0
+	for r := 0; r < v.Rows; r++ {
+		row := v.Arr[r*v.Cols : (r+1)*v.Cols]
+		dup := false
+		for k := 0; k < rows && !dup; k++ {
+			dup = sameRow(out[k*v.Cols:(k+1)*v.Cols], row)
+		}
+		if !dup {
+			out = append(out, row...)
+			rows++
+		}
+	}
+	return Array(rows, v.Cols, out)
+}
+
+func sameRow(a, b []Value) bool {
+	for i := range a {
+		if a[i].Kind != b[i].Kind || compareValues(a[i], b[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// SORT(array, [sort_index], [sort_order]) sorts rows by a column; order -1
+// is descending.
+func (p *parser) fnSort(args []string) Value {
+	if len(args) < 1 || len(args) > 3 {
+		return argCountError("SORT", "1 to 3")
+	}
+	v := p.arrayArg(args[0])
+	if v.IsError() {
+		return v
+	}
+	index, errv := p.intArg(args, 1, 1)
+	if errv.IsError() {
+		return errv
+	}
+	order, errv := p.intArg(args, 2, 1)
+	if errv.IsError() {
+		return errv
+	}
+	if index < 1 || index > v.Cols {
+		return Errorf(ErrValue, "SORT column %d is outside the array", index)
+	}
+	if order != 1 && order != -1 {
+		return Errorf(ErrValue, "SORT order must be 1 or -1")
+	}
+	rows := make([][]Value, v.Rows)
+	for r := range rows {
+		rows[r] = v.Arr[r*v.Cols : (r+1)*v.Cols]
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return compareValues(rows[i][index-1], rows[j][index-1])*order < 0
+	})
+	out := make([]Value, 0, len(v.Arr))
+	for _, row := range rows {
+		out = append(out, row...)
+	}
+	return Array(v.Rows, v.Cols, out)
+}
+
+// FILTER(array, include, [if_empty]) keeps the rows (or columns) where
+// include is true. include must be a column (or row) as long as array.
+func (p *parser) fnFilter(args []string) Value {
+	if len(args) < 2 || len(args) > 3 {
+		return argCountError("FILTER", "2 or 3")
+	}
+	v := p.arrayArg(args[0])
+	if v.IsError() {
+		return v
+	}
+	inc := p.arrayArg(args[1])
+	if inc.IsError() {
+		return inc
+	}
+	byRow := inc.Cols == 1 && inc.Rows == v.Rows
+	if !byRow && !(inc.Rows == 1 && inc.Cols == v.Cols) {
+		return Errorf(ErrValue, "FILTER condition is %dx%d, array is %dx%d", inc.Rows, inc.Cols, v.Rows, v.Cols)
+	}
+	var out []Value
+	n := 0
+	for i, cond := range inc.Arr {
+		t := truthy(cond)
+		if t.IsError() {
+			return t
+		}
+		if t.Num == 0 {
+			continue
+		}
+		n++
+		if byRow {
+			out = append(out, v.Arr[i*v.Cols:(i+1)*v.Cols]...)
+		} else {
+			for r := 0; r < v.Rows; r++ {
+				out = append(out, v.Arr[r*v.Cols+i])
+			}
+		}
+	}
+	if n == 0 {
+		if len(args) == 3 {
+			return p.evalArg(args[2])
+		}
+		return Errorf(ErrNA, "FILTER found nothing")
+	}
+	if byRow {
+		return Array(n, v.Cols, out)
+	}
+	// out was collected column by column
+	return transpose(Array(n, v.Rows, out))
+}
+
+func transpose(v Value) Value {
+	out := make([]Value, 0, len(v.Arr))
+	for c := 0; c < v.Cols; c++ {
+		for r := 0; r < v.Rows; r++ {
+			out = append(out, v.Arr[r*v.Cols+c])
+		}
+	}
+	return Array(v.Cols, v.Rows, out)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
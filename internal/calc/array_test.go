@@ -0,0 +1,45 @@
+package calc
+
+import "testing"
+
+// testEnv is a 100x26 grid of blank cells.
+func testEnv() Env {
+	return Env{Rows: 100, Cols: 26, Cell: func(row, col int) Value { return Value{} }}
+}
+
+func TestArraySizeLimits(t *testing.T) {
+	for _, expr := range []string{
+		"SEQUENCE(4294967296,4294967296)",
+		"SEQUENCE(4294967296,4294967296)+1",
+		"TRANSPOSE(SEQUENCE(4294967296,4294967296))",
+		"SORT(SEQUENCE(4294967296,4294967296))",
+		"SEQUENCE(1e300,1e300)",
+		"SEQUENCE(-1e300)",
+		"SEQUENCE(1048577)",
+		"SEQUENCE(1048576)+TRANSPOSE(SEQUENCE(1048576))",
+	} {
+		v := EvalExprForCell(expr, testEnv())
+		if v.Kind != KindError || v.Err != ErrNum {
+			t.Errorf("%s = %v, want #NUM!", expr, v)
+		}
+	}
+	if v := EvalExprForCell("SEQUENCE(1024,1024)", testEnv()); v.Kind != KindArray || len(v.Arr) != 1<<20 {
+		t.Errorf("SEQUENCE(1024,1024) = %v, want a 1024x1024 array", v.Kind)
+	}
+}
+
+func TestArrayFunctions(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"SEQUENCE(3)", "{1;2;3}"},
+		{"SEQUENCE(2,3,10,5)", "{10,15,20;25,30,35}"},
+		{"SEQUENCE(3)*2", "{2;4;6}"},
+		{"SUM(SEQUENCE(4))", "10"},
+		{"TRANSPOSE(A1:A3)", "{1,2,3}"},
+		{"SORT(A1:A3,1,-1)", "{3;2;1}"},
+		{"SORT(B1:B3)", "{\"x\";\"x\";\"y\"}"},
+		{"SORT(A1:A3,2)", "#VALUE!"},
+		{"UNIQUE(B1:B3)", "{\"x\";\"y\"}"},
+		{"FILTER(A1:A5,A1:A5>3)", "{4;5}"},
+		{"FILTER(A1:A5,A1:A5>9,0)", "0"},
+	})
+}
@@ -1,6 +1,7 @@
 package calc
 
 import (
+	"errors"
 	"math"
 	"strconv"
 	"strings"
@@ -8,35 +9,89 @@ import (
 	"sheet/internal/grid"
 )
 
-// EvalExprForCell evaluates expr with a resolver callback.
-// resolve(name) should return (value, errCode) where errCode is one of "", "#CYCLE", "#DIV/0", "#REF", "#ERR"
-func EvalExprForCell(expr string, baseR, baseC int, resolve func(name string) (float64, string), visited map[[2]int]bool) (float64, string) {
-	// The parser here is nearly identical to original, but uses the provided resolver
-	p := parser{
-		input:   expr,
-		pos:     0,
-		resolve: resolve,
+// Env describes the sheet a formula is evaluated against.
+type Env struct {
+	// Rows and Cols are the grid extent. Whole-row/column and open-ended
+	// ranges (A:A, 3:3, A2:A) are clipped to it.
+	Rows, Cols int
+	// Cell returns the value of the cell at 0-based row, col. Errors of
+	// referenced formulas should be passed through so they propagate.
+	Cell func(row, col int) Value
+	// Name returns the definition of a named range or constant (e.g. "H1",
+	// "B2:B200" or "0.2"). It may be nil when there are no names.
+	Name func(name string) (string, bool)
+	// Spill returns the size of the spill range anchored at row, col, for
+	// A1# references. It may be nil.
+	Spill func(row, col int) (rows, cols int, ok bool)
+	// Hidden reports whether a row is hidden by a filter or by hand (hidden
+	// rows and collapsed groups). SUBTOTAL skips the cells of filtered rows,
+	// and with function_num 101-111 also of rows hidden by hand. It may be
+	// nil.
+	Hidden func(row int) (filtered, manual bool)
+}
+
+// maxNameDepth limits how deep names may refer to other names, which also
+// stops names that refer to themselves.
+const maxNameDepth = 16
+
+// EvalExprForCell evaluates expr (a formula without the leading '=')
+// against env. Malformed formulas evaluate to #VALUE! with the position of
+// the problem in Msg. Ranges and array functions (SEQUENCE, FILTER, ...)
+// produce KindArray values that the caller spills into neighbouring cells.
+func EvalExprForCell(expr string, env Env) Value {
+	val, syntax := eval(expr, env)
+	if syntax != "" {
+		return Errorf(ErrValue, "syntax error: %s", syntax)
 	}
+	return val
+}
 
-	val, err := p.parseExpr()
-	if err != "" {
-		return 0, err
+// CheckSyntax reports the first syntax error of expr, evaluated against an
+// empty sheet, or nil when it parses.
+func CheckSyntax(expr string) error {
+	if _, syntax := eval(expr, Env{Cell: func(row, col int) Value { return Value{} }}); syntax != "" {
+		return errors.New("syntax error: " + syntax)
 	}
-	p.skipSpaces()
-	if p.pos < len(p.input) {
-		return 0, "#ERR"
+	return nil
+}
+
+// eval evaluates expr and returns the first syntax error separately.
+func eval(expr string, env Env) (Value, string) {
+	p := parser{
+		input: expr,
+		pos:   0,
+		env:   env,
 	}
-	// Some additional sanity checks (avoid NaN/Inf leaking)
-	if math.IsNaN(val) || math.IsInf(val, 0) {
-		return 0, "#ERR"
+	val := p.parseExpr()
+	if p.syntax == "" {
+		p.skipSpaces()
+		if p.pos < len(p.input) {
+			p.fail("unexpected %q", p.input[p.pos:])
+		}
 	}
-	return val, ""
+	return val, p.syntax
 }
 
 type parser struct {
-	input   string
-	pos     int
-	resolve func(name string) (float64, string)
+	input  string
+	pos    int
+	env    Env
+	depth  int    // nesting of name definitions being evaluated
+	syntax string // first syntax error; evaluation stops once set
+
+	subtotal int // function_num of the SUBTOTAL being evaluated, 0 outside
+}
+
+// fail records a syntax error; the returned value is never shown because
+// EvalExprForCell reports the syntax error instead.
+func (p *parser) fail(format string, args ...interface{}) Value {
+	if p.syntax == "" {
+		p.syntax = Errorf(ErrValue, format, args...).Msg
+		if p.pos < len(p.input) {
+			p.syntax += " at " + strconv.Itoa(p.pos+1)
+		}
+	}
+	return Errorf(ErrValue, "%s", p.syntax)
 }
 
 func (p *parser) skipSpaces() {
@@ -45,16 +100,38 @@ func (p *parser) skipSpaces() {
 	}
 }
 
-func (p *parser) parseExpr() (float64, string) {
-	return p.parseAddSub()
+func (p *parser) parseExpr() Value {
+	return p.parseCompare()
 }
 
-func (p *parser) parseAddSub() (float64, string) {
-	val, err := p.parseMulDiv()
-	if err != "" {
-		return 0, err
+// Binary operators propagate the first error operand (left to right) and
+// work element-wise on arrays. Both sides are always parsed so that syntax
+// errors are still reported.
+
+func (p *parser) parseCompare() Value {
+	val := p.parseAddSub()
+	for p.syntax == "" {
+		p.skipSpaces()
+		op := ""
+		for _, cand := range []string{"<=", ">=", "<>", "=", "<", ">"} {
+			if strings.HasPrefix(p.input[p.pos:], cand) {
+				op = cand
+				break
+			}
+		}
+		if op == "" {
+			break
+		}
+		p.pos += len(op)
+		right := p.parseAddSub()
+		val = compare(op, val, right)
 	}
-	for {
+	return val
+}
+
+func (p *parser) parseAddSub() Value {
+	val := p.parseMulDiv()
+	for p.syntax == "" {
 		p.skipSpaces()
 		if p.pos >= len(p.input) {
 			break
@@ -64,25 +141,15 @@ func (p *parser) parseAddSub() (float64, string) {
 			break
 		}
 		p.pos++
-		right, rerr := p.parseMulDiv()
-		if rerr != "" {
-			return 0, rerr
-		}
-		if op == '+' {
-			val = val + right
-		} else {
-			val = val - right
-		}
+		right := p.parseMulDiv()
+		val = arith(op, val, right)
 	}
-	return val, ""
+	return val
 }
 
-func (p *parser) parseMulDiv() (float64, string) {
-	val, err := p.parseFactor()
-	if err != "" {
-		return 0, err
-	}
-	for {
+func (p *parser) parseMulDiv() Value {
+	val := p.parseFactor()
+	for p.syntax == "" {
 		p.skipSpaces()
 		if p.pos >= len(p.input) {
 			break
@@ -92,23 +159,43 @@ func (p *parser) parseMulDiv() (float64, string) {
 			break
 		}
 		p.pos++
-		right, rerr := p.parseFactor()
-		if rerr != "" {
-			return 0, rerr
-		}
-		if op == '*' {
-			val = val * right
-		} else {
-			if math.Abs(right) < 1e-12 {
-				return 0, "#DIV/0"
-			}
-			val = val / right
+		right := p.parseFactor()
+		val = arith(op, val, right)
+	}
+	return val
+}
+
+func arith(op byte, left, right Value) Value {
+	return lift2(left, right, func(left, right Value) Value {
+		return arithScalar(op, left, right)
+	})
+}
+
+func arithScalar(op byte, left, right Value) Value {
+	l := left.AsNumber()
+	if l.IsError() {
+		return l
+	}
+	r := right.AsNumber()
+	if r.IsError() {
+		return r
+	}
+	switch op {
+	case '+':
+		return Number(l.Num + r.Num)
+	case '-':
+		return Number(l.Num - r.Num)
+	case '*':
+		return Number(l.Num * r.Num)
+	default:
+		if math.Abs(r.Num) < 1e-12 {
+			return Errorf(ErrDiv0, "division by zero")
 		}
+		return Number(l.Num / r.Num)
 	}
-	return val, ""
 }
 
-func (p *parser) parseFactor() (float64, string) {
+func (p *parser) parseFactor() Value {
 	p.skipSpaces()
 	if p.pos < len(p.input) {
 		ch := p.input[p.pos]
@@ -118,34 +205,70 @@ func (p *parser) parseFactor() (float64, string) {
 		}
 		if ch == '-' {
 			p.pos++
-			v, err := p.parseFactor()
-			if err != "" {
-				return 0, err
-			}
-			return -v, ""
+			return lift1(p.parseFactor(), func(v Value) Value {
+				v = v.AsNumber()
+				if v.IsError() {
+					return v
+				}
+				return Number(-v.Num)
+			})
 		}
 	}
 	return p.parsePrimary()
 }
 
-func (p *parser) parsePrimary() (float64, string) {
+func (p *parser) parsePrimary() Value {
 	p.skipSpaces()
 	if p.pos >= len(p.input) {
-		return 0, "#ERR"
+		return p.fail("unexpected end of formula")
 	}
 	ch := p.input[p.pos]
 	if ch == '(' {
 		p.pos++
-		v, err := p.parseExpr()
-		if err != "" {
-			return 0, err
+		v := p.parseExpr()
+		if p.syntax != "" {
+			return v
 		}
 		p.skipSpaces()
 		if p.pos >= len(p.input) || p.input[p.pos] != ')' {
-			return 0, "#ERR"
+			return p.fail("missing )")
 		}
 		p.pos++
-		return v, ""
+		return v
+	}
+	// string literal: "text", "" is an escaped quote
+	if ch == '"' {
+		var b strings.Builder
+		for i := p.pos + 1; i < len(p.input); i++ {
+			if p.input[i] != '"' {
+				b.WriteByte(p.input[i])
+				continue
+			}
+			if i+1 < len(p.input) && p.input[i+1] == '"' {
+				b.WriteByte('"')
+				i++
+				continue
+			}
+			p.pos = i + 1
+			return Text(b.String())
+		}
+		return p.fail("unterminated string")
+	}
+	// error literal: #N/A, #REF! ...
+	if ch == '#' {
+		j := p.pos + 1
+		for j < len(p.input) && (isLetter(p.input[j]) || isDigit(p.input[j]) || strings.IndexByte("/!?", p.input[j]) >= 0) {
+			j++
+		}
+		code, ok := ParseError(p.input[p.pos:j])
+		if !ok {
+			return p.fail("unknown error literal %q", p.input[p.pos:j])
+		}
+		p.pos = j
+		if code == ErrRef {
+			return Errorf(ErrRef, "reference was deleted")
+		}
+		return Errorf(code, "from a literal in the formula")
 	}
 	// number
 	if isDigit(ch) || ch == '.' {
@@ -180,1026 +303,202 @@ func (p *parser) parsePrimary() (float64, string) {
 			}
 			break
 		}
-		if j == start {
-			return 0, "#ERR"
-		}
 		numStr := p.input[start:j]
 		p.pos = j
+		if j < len(p.input) && p.input[j] == ':' {
+			// whole-row range: 3:5
+			p.pos = tokenEnd(p.input, j+1)
+			return p.rangeValue(p.input[start:p.pos])
+		}
 		v, err := strconv.ParseFloat(numStr, 64)
 		if err != nil {
-			return 0, "#ERR"
+			return p.fail("bad number %q", numStr)
 		}
-		return v, ""
+		return Number(v)
 	}
 
-	// identifier: letters then either '(' (function) or digits (cell ref)
-	if isLetter(ch) {
-		startLetters := p.pos
-		j := p.pos
-		for j < len(p.input) && isLetter(p.input[j]) {
-			j++
-		}
-		letters := p.input[startLetters:j]
+	// identifier: a function name followed by '(', a named range/constant
+	// or a cell reference (optionally with $ signs)
+	if isLetter(ch) || ch == '_' || ch == '$' {
+		start := p.pos
+		j := tokenEnd(p.input, p.pos)
+		ident := p.input[start:j]
 		p.pos = j
 		p.skipSpaces()
 
-		// function call: LETTERS(...)
+		// function call: NAME(...)
 		if p.pos < len(p.input) && p.input[p.pos] == '(' {
 			p.pos++
-			funcName := strings.ToUpper(letters)
-			switch funcName {
-			case "SUM":
-				sum := 0.0
-				p.skipSpaces()
-				// empty args -> SUM() == 0
-				if p.pos < len(p.input) && p.input[p.pos] == ')' {
-					p.pos++
-					return 0, ""
-				}
-				for {
-					// extract argument substring up to comma or closing paren at top nesting
-					start := p.pos
-					nest := 0
-					i := p.pos
-					for i < len(p.input) {
-						c := p.input[i]
-						if c == '(' {
-							nest++
-						} else if c == ')' {
-							if nest == 0 {
-								break
-							}
-							nest--
-						} else if c == ',' && nest == 0 {
-							break
-						}
-						i++
-					}
-					if i > len(p.input) {
-						return 0, "#ERR"
-					}
-					argStr := strings.TrimSpace(p.input[start:i])
-					if argStr == "" {
-						return 0, "#ERR"
-					}
-
-					// try range syntax LEFT:RIGHT (only top-level colon)
-					isRange := false
-					if strings.Contains(argStr, ":") {
-						parts := strings.SplitN(argStr, ":", 2)
-						left := strings.TrimSpace(parts[0])
-						right := strings.TrimSpace(parts[1])
-						r1, c1, ok1 := grid.ParseCellRef(left)
-						r2, c2, ok2 := grid.ParseCellRef(right)
-						if ok1 && ok2 {
-							rmin := minInt(r1, r2)
-							rmax := maxInt(r1, r2)
-							cmin := minInt(c1, c2)
-							cmax := maxInt(c1, c2)
-							for rr := rmin; rr <= rmax; rr++ {
-								for cc := cmin; cc <= cmax; cc++ {
-									name := grid.ColRowToName(cc, rr)
-									v, err := p.resolve(name)
-									if err != "" {
-										return 0, err
-									}
-									sum += v
-								}
-							}
-							isRange = true
-						}
-					}
-
-					if !isRange {
-						sub := parser{
-							input:   argStr,
-							pos:     0,
-							resolve: p.resolve,
-						}
-						v, err := sub.parseExpr()
-						if err != "" {
-							return 0, err
-						}
-						sub.skipSpaces()
-						if sub.pos < len(sub.input) {
-							return 0, "#ERR"
-						}
-						sum += v
-					}
-
-					if i >= len(p.input) {
-						return 0, "#ERR"
-					}
-					if p.input[i] == ',' {
-						p.pos = i + 1
-						p.skipSpaces()
-						continue
-					}
-					if p.input[i] == ')' {
-						p.pos = i + 1
-						break
-					}
-					return 0, "#ERR"
-				}
-				return sum, ""
-			case "AVERAGE":
-				sum := 0.0
-				count := 0.0
-				p.skipSpaces()
-				// empty args -> AVERAGE() == 0
-				if p.pos < len(p.input) && p.input[p.pos] == ')' {
-					p.pos++
-					return 0, ""
-				}
-				for {
-					// extract argument substring up to comma or closing paren at top nesting
-					start := p.pos
-					nest := 0
-					i := p.pos
-					for i < len(p.input) {
-						c := p.input[i]
-						if c == '(' {
-							nest++
-						} else if c == ')' {
-							if nest == 0 {
-								break
-							}
-							nest--
-						} else if c == ',' && nest == 0 {
-							break
-						}
-						i++
-					}
-					if i > len(p.input) {
-						return 0, "#ERR"
-					}
-					argStr := strings.TrimSpace(p.input[start:i])
-					if argStr == "" {
-						return 0, "#ERR"
-					}
-
-					// try range syntax LEFT:RIGHT (only top-level colon)
-					isRange := false
-					if strings.Contains(argStr, ":") {
-						parts := strings.SplitN(argStr, ":", 2)
-						left := strings.TrimSpace(parts[0])
-						right := strings.TrimSpace(parts[1])
-						r1, c1, ok1 := grid.ParseCellRef(left)
-						r2, c2, ok2 := grid.ParseCellRef(right)
-						if ok1 && ok2 {
-							rmin := minInt(r1, r2)
-							rmax := maxInt(r1, r2)
-							cmin := minInt(c1, c2)
-							cmax := maxInt(c1, c2)
-							for rr := rmin; rr <= rmax; rr++ {
-								for cc := cmin; cc <= cmax; cc++ {
-									name := grid.ColRowToName(cc, rr)
-									v, err := p.resolve(name)
-									if err != "" {
-										return 0, err
-									}
-									sum += v
-									count += 1.0
-								}
-							}
-							isRange = true
-						}
-					}
-
-					if !isRange {
-						sub := parser{
-							input:   argStr,
-							pos:     0,
-							resolve: p.resolve,
-						}
-						v, err := sub.parseExpr()
-						if err != "" {
-							return 0, err
-						}
-						sub.skipSpaces()
-						if sub.pos < len(sub.input) {
-							return 0, "#ERR"
-						}
-						sum += v
-						count += 1.0
-					}
-
-					if i >= len(p.input) {
-						return 0, "#ERR"
-					}
-					if p.input[i] == ',' {
-						p.pos = i + 1
-						p.skipSpaces()
-						continue
-					}
-					if p.input[i] == ')' {
-						p.pos = i + 1
-						break
-					}
-					return 0, "#ERR"
-				}
-				if count == 0 {
-					return 0, ""
-				}
-				return sum / count, ""
-			case "MIN":
-				values := []float64{}
-				p.skipSpaces()
-				// empty args -> MIN() == 0
-				if p.pos < len(p.input) && p.input[p.pos] == ')' {
-					p.pos++
-					return 0, ""
-				}
-				for {
-					// extract argument substring up to comma or closing paren at top nesting
-					start := p.pos
-					nest := 0
-					i := p.pos
-					for i < len(p.input) {
-						c := p.input[i]
-						if c == '(' {
-							nest++
-						} else if c == ')' {
-							if nest == 0 {
-								break
-							}
-							nest--
-						} else if c == ',' && nest == 0 {
-							break
-						}
-						i++
-					}
-					if i > len(p.input) {
-						return 0, "#ERR"
-					}
-					argStr := strings.TrimSpace(p.input[start:i])
-					if argStr == "" {
-						return 0, "#ERR"
-					}
-
-					// try range syntax LEFT:RIGHT (only top-level colon)
-					isRange := false
-					if strings.Contains(argStr, ":") {
-						parts := strings.SplitN(argStr, ":", 2)
-						left := strings.TrimSpace(parts[0])
-						right := strings.TrimSpace(parts[1])
-						r1, c1, ok1 := grid.ParseCellRef(left)
-						r2, c2, ok2 := grid.ParseCellRef(right)
-						if ok1 && ok2 {
-							rmin := minInt(r1, r2)
-							rmax := maxInt(r1, r2)
-							cmin := minInt(c1, c2)
-							cmax := maxInt(c1, c2)
-							for rr := rmin; rr <= rmax; rr++ {
-								for cc := cmin; cc <= cmax; cc++ {
-									name := grid.ColRowToName(cc, rr)
-									v, err := p.resolve(name)
-									if err != "" {
-										return 0, err
-									}
-									values = append(values, v)
-								}
-							}
-							isRange = true
-						}
-					}
-
-					if !isRange {
-						sub := parser{
-							input:   argStr,
-							pos:     0,
-							resolve: p.resolve,
-						}
-						v, err := sub.parseExpr()
-						if err != "" {
-							return 0, err
-						}
-						sub.skipSpaces()
-						if sub.pos < len(sub.input) {
-							return 0, "#ERR"
-						}
-						values = append(values, v)
-					}
-
-					if i >= len(p.input) {
-						return 0, "#ERR"
-					}
-					if p.input[i] == ',' {
-						p.pos = i + 1
-						p.skipSpaces()
-						continue
-					}
-					if p.input[i] == ')' {
-						p.pos = i + 1
-						break
-					}
-					return 0, "#ERR"
-				}
-				if len(values) == 0 {
-					return 0, ""
-				}
-				minVal := values[0]
-				for _, v := range values {
-					if v < minVal {
-						minVal = v
-					}
-				}
-				return minVal, ""
-			case "MAX":
-				values := []float64{}
-				p.skipSpaces()
-				// empty args -> MAX() == 0
-				if p.pos < len(p.input) && p.input[p.pos] == ')' {
-					p.pos++
-					return 0, ""
-				}
-				for {
-					// extract argument substring up to comma or closing paren at top nesting
-					start := p.pos
-					nest := 0
-					i := p.pos
-					for i < len(p.input) {
-						c := p.input[i]
-						if c == '(' {
-							nest++
-						} else if c == ')' {
-							if nest == 0 {
-								break
-							}
-							nest--
-						} else if c == ',' && nest == 0 {
-							break
-						}
-						i++
-					}
-					if i > len(p.input) {
-						return 0, "#ERR"
-					}
-					argStr := strings.TrimSpace(p.input[start:i])
-					if argStr == "" {
-						return 0, "#ERR"
-					}
-
-					// try range syntax LEFT:RIGHT (only top-level colon)
-					isRange := false
-					if strings.Contains(argStr, ":") {
-						parts := strings.SplitN(argStr, ":", 2)
-						left := strings.TrimSpace(parts[0])
-						right := strings.TrimSpace(parts[1])
-						r1, c1, ok1 := grid.ParseCellRef(left)
-						r2, c2, ok2 := grid.ParseCellRef(right)
-						if ok1 && ok2 {
-							rmin := minInt(r1, r2)
-							rmax := maxInt(r1, r2)
-							cmin := minInt(c1, c2)
-							cmax := maxInt(c1, c2)
-							for rr := rmin; rr <= rmax; rr++ {
-								for cc := cmin; cc <= cmax; cc++ {
-									name := grid.ColRowToName(cc, rr)
-									v, err := p.resolve(name)
-									if err != "" {
-										return 0, err
-									}
-									values = append(values, v)
-								}
-							}
-							isRange = true
-						}
-					}
-
-					if !isRange {
-						sub := parser{
-							input:   argStr,
-							pos:     0,
-							resolve: p.resolve,
-						}
-						v, err := sub.parseExpr()
-						if err != "" {
-							return 0, err
-						}
-						sub.skipSpaces()
-						if sub.pos < len(sub.input) {
-							return 0, "#ERR"
-						}
-						values = append(values, v)
-					}
-
-					if i >= len(p.input) {
-						return 0, "#ERR"
-					}
-					if p.input[i] == ',' {
-						p.pos = i + 1
-						p.skipSpaces()
-						continue
-					}
-					if p.input[i] == ')' {
-						p.pos = i + 1
-						break
-					}
-					return 0, "#ERR"
-				}
-				if len(values) == 0 {
-					return 0, ""
-				}
-				maxVal := values[0]
-				for _, v := range values {
-					if v > maxVal {
-						maxVal = v
-					}
-				}
-				return maxVal, ""
-			case "COUNT":
-				count := 0.0
-				p.skipSpaces()
-				// empty args -> COUNT() == 0
-				if p.pos < len(p.input) && p.input[p.pos] == ')' {
-					p.pos++
-					return 0, ""
-				}
-				for {
-					// extract argument substring up to comma or closing paren at top nesting
-					start := p.pos
-					nest := 0
-					i := p.pos
-					for i < len(p.input) {
-						c := p.input[i]
-						if c == '(' {
-							nest++
-						} else if c == ')' {
-							if nest == 0 {
-								break
-							}
-							nest--
-						} else if c == ',' && nest == 0 {
-							break
-						}
-						i++
-					}
-					if i > len(p.input) {
-						return 0, "#ERR"
-					}
-					argStr := strings.TrimSpace(p.input[start:i])
-					if argStr == "" {
-						return 0, "#ERR"
-					}
-
-					// try range syntax LEFT:RIGHT (only top-level colon)
-					isRange := false
-					if strings.Contains(argStr, ":") {
-						parts := strings.SplitN(argStr, ":", 2)
-						left := strings.TrimSpace(parts[0])
-						right := strings.TrimSpace(parts[1])
-						r1, c1, ok1 := grid.ParseCellRef(left)
-						r2, c2, ok2 := grid.ParseCellRef(right)
-						if ok1 && ok2 {
-							rmin := minInt(r1, r2)
-							rmax := maxInt(r1, r2)
-							cmin := minInt(c1, c2)
-							cmax := maxInt(c1, c2)
-							for rr := rmin; rr <= rmax; rr++ {
-								for cc := cmin; cc <= cmax; cc++ {
-									name := grid.ColRowToName(cc, rr)
-									_, err := p.resolve(name)
-									if err != "" && err != "#CYCLE" {
-										// Пропускаем ячейки с ошибками
-										continue
-									}
-									// Увеличиваем счетчик только для числовых значений
-									count += 1.0
-								}
-							}
-							isRange = true
-						}
-					}
-
-					if !isRange {
-						sub := parser{
-							input:   argStr,
-							pos:     0,
-							resolve: p.resolve,
-						}
-						_, err := sub.parseExpr()
-						if err != "" {
-							// Пропускаем аргументы с ошибками
-							// Просто пропускаем этот аргумент и продолжаем
-							if i >= len(p.input) {
-								return 0, "#ERR"
-							}
-							if p.input[i] == ',' {
-								p.pos = i + 1
-								p.skipSpaces()
-								continue
-							}
-							if p.input[i] == ')' {
-								p.pos = i + 1
-								break
-							}
-							return 0, "#ERR"
-						}
-						sub.skipSpaces()
-						if sub.pos < len(sub.input) {
-							return 0, "#ERR"
-						}
-						count += 1.0
-					}
-
-					if i >= len(p.input) {
-						return 0, "#ERR"
-					}
-					if p.input[i] == ',' {
-						p.pos = i + 1
-						p.skipSpaces()
-						continue
-					}
-					if p.input[i] == ')' {
-						p.pos = i + 1
-						break
-					}
-					return 0, "#ERR"
-				}
-				return count, ""
-			case "ROUND":
-				p.skipSpaces()
-				// ROUND requires at least one argument
-				if p.pos >= len(p.input) || p.input[p.pos] == ')' {
-					return 0, "#ERR"
-				}
-
-				// Parse the first argument (value to round)
-				start := p.pos
-				nest := 0
-				i := p.pos
-				for i < len(p.input) {
-					c := p.input[i]
-					if c == '(' {
-						nest++
-					} else if c == ')' {
-						if nest == 0 {
-							break
-						}
-						nest--
-					} else if c == ',' && nest == 0 {
-						break
-					}
-					i++
-				}
-				if i > len(p.input) {
-					return 0, "#ERR"
-				}
-				argStr := strings.TrimSpace(p.input[start:i])
-				if argStr == "" {
-					return 0, "#ERR"
-				}
-
-				sub := parser{
-					input:   argStr,
-					pos:     0,
-					resolve: p.resolve,
-				}
-				value, err := sub.parseExpr()
-				if err != "" {
-					return 0, err
-				}
-				sub.skipSpaces()
-				if sub.pos < len(sub.input) {
-					return 0, "#ERR"
-				}
-
-				// Check if there's a second argument (decimal places)
-				decimalPlaces := 0.0
-				if i < len(p.input) && p.input[i] == ',' {
-					p.pos = i + 1
-					p.skipSpaces()
-
-					// Parse the second argument (decimal places)
-					start = p.pos
-					nest = 0
-					i = p.pos
-					for i < len(p.input) {
-						c := p.input[i]
-						if c == '(' {
-							nest++
-						} else if c == ')' {
-							if nest == 0 {
-								break
-							}
-							nest--
-						} else if c == ',' && nest == 0 {
-							break
-						}
-						i++
-					}
-					if i > len(p.input) {
-						return 0, "#ERR"
-					}
-					argStr = strings.TrimSpace(p.input[start:i])
-					if argStr == "" {
-						return 0, "#ERR"
-					}
-
-					sub = parser{
-						input:   argStr,
-						pos:     0,
-						resolve: p.resolve,
-					}
-					dp, err := sub.parseExpr()
-					if err != "" {
-						return 0, err
-					}
-					sub.skipSpaces()
-					if sub.pos < len(sub.input) {
-						return 0, "#ERR"
-					}
-					decimalPlaces = dp
-				}
-
-				// Move parser position to the closing parenthesis
-				if i < len(p.input) && p.input[i] == ')' {
-					p.pos = i + 1
-				} else {
-					return 0, "#ERR"
-				}
-
-				// Round the value
-				multiplier := math.Pow(10, decimalPlaces)
-				return math.Round(value*multiplier) / multiplier, ""
-			case "IF":
-				p.skipSpaces()
-				// IF requires at least one argument
-				if p.pos >= len(p.input) || p.input[p.pos] == ')' {
-					return 0, "#ERR"
-				}
-
-				// Parse the first argument (condition)
-				start := p.pos
-				nest := 0
-				i := p.pos
-				for i < len(p.input) {
-					c := p.input[i]
-					if c == '(' {
-						nest++
-					} else if c == ')' {
-						if nest == 0 {
-							break
-						}
-						nest--
-					} else if c == ',' && nest == 0 {
-						break
-					}
-					i++
-				}
-				if i > len(p.input) {
-					return 0, "#ERR"
-				}
-				conditionStr := strings.TrimSpace(p.input[start:i])
-				if conditionStr == "" {
-					return 0, "#ERR"
-				}
-
-				sub := parser{
-					input:   conditionStr,
-					pos:     0,
-					resolve: p.resolve,
-				}
-				condition, err := sub.parseExpr()
-				if err != "" {
-					return 0, err
-				}
-				sub.skipSpaces()
-				if sub.pos < len(sub.input) {
-					return 0, "#ERR"
-				}
-
-				// Check if there's a second argument (value if true)
-				if i >= len(p.input) || p.input[i] != ',' {
-					return 0, "#ERR"
-				}
-
-				p.pos = i + 1
-				p.skipSpaces()
-
-				// Parse the second argument (value if true)
-				start = p.pos
-				nest = 0
-				i = p.pos
-				for i < len(p.input) {
-					c := p.input[i]
-					if c == '(' {
-						nest++
-					} else if c == ')' {
-						if nest == 0 {
-							break
-						}
-						nest--
-					} else if c == ',' && nest == 0 {
-						break
-					}
-					i++
-				}
-				if i > len(p.input) {
-					return 0, "#ERR"
-				}
-				trueValueStr := strings.TrimSpace(p.input[start:i])
-				if trueValueStr == "" {
-					return 0, "#ERR"
-				}
-
-				// Check if there's a third argument (value if false)
-				var falseValueStr string
-				if i < len(p.input) && p.input[i] == ',' {
-					p.pos = i + 1
-					p.skipSpaces()
-
-					// Parse the third argument (value if false)
-					start = p.pos
-					nest = 0
-					i = p.pos
-					for i < len(p.input) {
-						c := p.input[i]
-						if c == '(' {
-							nest++
-						} else if c == ')' {
-							if nest == 0 {
-								break
-							}
-							nest--
-						} else if c == ',' && nest == 0 {
-							break
-						}
-						i++
-					}
-					if i > len(p.input) {
-						return 0, "#ERR"
-					}
-					falseValueStr = strings.TrimSpace(p.input[start:i])
-				} else {
-					// Default false value is 0
-					falseValueStr = "0"
-				}
-
-				// Move parser position to the closing parenthesis
-				if i < len(p.input) && p.input[i] == ')' {
-					p.pos = i + 1
-				} else {
-					return 0, "#ERR"
-				}
-
-				// Evaluate the appropriate branch
-				var resultStr string
-				if math.Abs(condition) > 1e-12 { // condition is true if not close to zero
-					resultStr = trueValueStr
-				} else {
-					resultStr = falseValueStr
-				}
-
-				sub = parser{
-					input:   resultStr,
-					pos:     0,
-					resolve: p.resolve,
-				}
-				result, err := sub.parseExpr()
-				if err != "" {
-					return 0, err
-				}
-				sub.skipSpaces()
-				if sub.pos < len(sub.input) {
-					return 0, "#ERR"
-				}
-
-				return result, ""
-			case "AND":
-				p.skipSpaces()
-				// empty args -> AND() == 1 (true)
-				if p.pos < len(p.input) && p.input[p.pos] == ')' {
-					p.pos++
-					return 1, ""
-				}
-				for {
-					// extract argument substring up to comma or closing paren at top nesting
-					start := p.pos
-					nest := 0
-					i := p.pos
-					for i < len(p.input) {
-						c := p.input[i]
-						if c == '(' {
-							nest++
-						} else if c == ')' {
-							if nest == 0 {
-								break
-							}
-							nest--
-						} else if c == ',' && nest == 0 {
-							break
-						}
-						i++
-					}
-					if i > len(p.input) {
-						return 0, "#ERR"
-					}
-					argStr := strings.TrimSpace(p.input[start:i])
-					if argStr == "" {
-						return 0, "#ERR"
-					}
-
-					sub := parser{
-						input:   argStr,
-						pos:     0,
-						resolve: p.resolve,
-					}
-					value, err := sub.parseExpr()
-					if err != "" {
-						return 0, err
-					}
-					sub.skipSpaces()
-					if sub.pos < len(sub.input) {
-						return 0, "#ERR"
-					}
-
-					// If any argument is false (close to zero), return false
-					if math.Abs(value) < 1e-12 {
-						// Skip remaining arguments
-						for i < len(p.input) && p.input[i] != ')' {
-							i++
-						}
-						if i < len(p.input) && p.input[i] == ')' {
-							p.pos = i + 1
-						}
-						return 0, ""
-					}
-
-					if i >= len(p.input) {
-						return 0, "#ERR"
-					}
-					if p.input[i] == ',' {
-						p.pos = i + 1
-						p.skipSpaces()
-						continue
-					}
-					if p.input[i] == ')' {
-						p.pos = i + 1
-						break
-					}
-					return 0, "#ERR"
-				}
-				return 1, "" // All arguments are true
-			case "OR":
-				p.skipSpaces()
-				// empty args -> OR() == 0 (false)
-				if p.pos < len(p.input) && p.input[p.pos] == ')' {
-					p.pos++
-					return 0, ""
-				}
-				for {
-					// extract argument substring up to comma or closing paren at top nesting
-					start := p.pos
-					nest := 0
-					i := p.pos
-					for i < len(p.input) {
-						c := p.input[i]
-						if c == '(' {
-							nest++
-						} else if c == ')' {
-							if nest == 0 {
-								break
-							}
-							nest--
-						} else if c == ',' && nest == 0 {
-							break
-						}
-						i++
-					}
-					if i > len(p.input) {
-						return 0, "#ERR"
-					}
-					argStr := strings.TrimSpace(p.input[start:i])
-					if argStr == "" {
-						return 0, "#ERR"
-					}
-
-					sub := parser{
-						input:   argStr,
-						pos:     0,
-						resolve: p.resolve,
-					}
-					value, err := sub.parseExpr()
-					if err != "" {
-						return 0, err
-					}
-					sub.skipSpaces()
-					if sub.pos < len(sub.input) {
-						return 0, "#ERR"
-					}
-
-					// If any argument is true (not close to zero), return true
-					if math.Abs(value) > 1e-12 {
-						// Skip remaining arguments
-						for i < len(p.input) && p.input[i] != ')' {
-							i++
-						}
-						if i < len(p.input) && p.input[i] == ')' {
-							p.pos = i + 1
-						}
-						return 1, ""
-					}
-
-					if i >= len(p.input) {
-						return 0, "#ERR"
-					}
-					if p.input[i] == ',' {
-						p.pos = i + 1
-						p.skipSpaces()
-						continue
-					}
-					if p.input[i] == ')' {
-						p.pos = i + 1
-						break
-					}
-					return 0, "#ERR"
-				}
-				return 0, "" // All arguments are false
-			case "NOT":
-				p.skipSpaces()
-				// NOT requires exactly one argument
-				if p.pos >= len(p.input) || p.input[p.pos] == ')' {
-					return 0, "#ERR"
-				}
+			return p.callFunc(strings.ToUpper(ident))
+		}
 
-				// Parse the argument
-				start := p.pos
-				nest := 0
-				i := p.pos
-				for i < len(p.input) {
-					c := p.input[i]
-					if c == '(' {
-						nest++
-					} else if c == ')' {
-						if nest == 0 {
-							break
-						}
-						nest--
-					} else if c == ',' && nest == 0 {
-						break
-					}
-					i++
-				}
-				if i > len(p.input) {
-					return 0, "#ERR"
-				}
-				argStr := strings.TrimSpace(p.input[start:i])
-				if argStr == "" {
-					return 0, "#ERR"
-				}
+		// names are resolved before cell references
+		if target, ok := p.lookupName(ident); ok {
+			if p.depth >= maxNameDepth {
+				return Errorf(ErrCirc, "name %s refers to itself", strings.ToUpper(ident))
+			}
+			p.depth++
+			defer func() { p.depth-- }()
+			return p.evalArg(target)
+		}
 
-				sub := parser{
-					input:   argStr,
-					pos:     0,
-					resolve: p.resolve,
-				}
-				value, err := sub.parseExpr()
-				if err != "" {
-					return 0, err
-				}
-				sub.skipSpaces()
-				if sub.pos < len(sub.input) {
-					return 0, "#ERR"
-				}
+		p.pos = j
+		row, col, ok := grid.ParseCellRef(ident)
+		if !ok && p.pos < len(p.input) && p.input[p.pos] == ':' {
+			// whole-column range: A:C
+			p.pos = tokenEnd(p.input, p.pos+1)
+			return p.rangeValue(p.input[start:p.pos])
+		}
+		if !ok {
+			return Errorf(ErrName, "unknown name %s", ident)
+		}
+		if p.env.Cell == nil {
+			return Errorf(ErrRef, "no cells to refer to")
+		}
+		if p.pos < len(p.input) && p.input[p.pos] == ':' {
+			// range: A1:B5, A2:A ...
+			p.pos = tokenEnd(p.input, p.pos+1)
+			return p.rangeValue(p.input[start:p.pos])
+		}
+		if p.pos < len(p.input) && p.input[p.pos] == '#' {
+			// spill range reference: A1#
+			p.pos++
+			if p.env.Spill == nil {
+				return Errorf(ErrRef, "%s does not spill", ident)
+			}
+			rows, cols, ok := p.env.Spill(row, col)
+			if !ok {
+				return Errorf(ErrRef, "%s does not spill", ident)
+			}
+			return p.cells(row, col, row+rows-1, col+cols-1)
+		}
+		return p.cell(row, col)
+	}
 
-				// Move parser position to the closing parenthesis
-				if i < len(p.input) && p.input[i] == ')' {
-					p.pos = i + 1
-				} else {
-					return 0, "#ERR"
-				}
+	return p.fail("unexpected %q", string(ch))
+}
 
-				// Return 1 if value is close to zero (false), 0 otherwise (true)
-				if math.Abs(value) < 1e-12 {
-					return 1, ""
-				}
-				return 0, ""
-			default:
-				return 0, "#ERR"
+// splitArgs reads a comma separated argument list up to the matching ')'
+// and leaves pos right after it. Only top-level commas split arguments;
+// commas and parentheses inside string literals are ignored.
+func (p *parser) splitArgs() ([]string, bool) {
+	p.skipSpaces()
+	if p.pos < len(p.input) && p.input[p.pos] == ')' {
+		p.pos++
+		return nil, true
+	}
+	var args []string
+	start := p.pos
+	nest := 0
+	for i := p.pos; i < len(p.input); i++ {
+		switch p.input[i] {
+		case '"':
+			for i++; i < len(p.input) && p.input[i] != '"'; i++ {
+			}
+		case '(':
+			nest++
+		case ')':
+			if nest > 0 {
+				nest--
+				continue
+			}
+			arg := strings.TrimSpace(p.input[start:i])
+			if arg == "" {
+				p.fail("empty argument")
+				return nil, false
+			}
+			p.pos = i + 1
+			return append(args, arg), true
+		case ',':
+			if nest > 0 {
+				continue
 			}
+			arg := strings.TrimSpace(p.input[start:i])
+			if arg == "" {
+				p.fail("empty argument")
+				return nil, false
+			}
+			args = append(args, arg)
+			start = i + 1
+		}
+	}
+	p.fail("missing )")
+	return nil, false
+}
+
+// evalArg evaluates a single function argument as a complete expression.
+// Syntax errors inside it are reported on p.
+func (p *parser) evalArg(arg string) Value {
+	sub := parser{
+		input:    arg,
+		pos:      0,
+		env:      p.env,
+		depth:    p.depth,
+		subtotal: p.subtotal,
+	}
+	v := sub.parseExpr()
+	if sub.syntax == "" {
+		sub.skipSpaces()
+		if sub.pos < len(sub.input) {
+			sub.fail("unexpected %q", sub.input[sub.pos:])
 		}
+	}
+	if sub.syntax != "" {
+		return p.fail("%s in %q", sub.syntax, arg)
+	}
+	return v
+}
 
-		// otherwise treat as cell reference: need digits after letters
-		k := j
-		for k < len(p.input) && isDigit(p.input[k]) {
-			k++
+// rangeValue evaluates a range reference (A1:B5, A:A, 3:3, A2:A, ...) to
+// an array. Open sides are bounded by the grid extent, so whole-column
+// references only cover rows that exist. A range lying wholly past the
+// grid (A50:A on 10 rows) is an empty array.
+func (p *parser) rangeValue(ref string) Value {
+	r1, c1, r2, c2, ok := grid.ParseRangeRef(ref, p.env.Rows, p.env.Cols)
+	if !ok {
+		if _, _, _, _, valid := grid.ParseRangeRef(ref, math.MaxInt32, math.MaxInt32); valid {
+			return Array(0, 0, nil)
 		}
-		if k == j {
-			p.pos = k
-			return 0, "#REF"
+		return Errorf(ErrRef, "bad range %s", ref)
+	}
+	return p.cells(r1, c1, r2, c2)
+}
+
+// cells returns the values of a rectangular block of cells.
+func (p *parser) cells(r1, c1, r2, c2 int) Value {
+	rows, cols := r2-r1+1, c2-c1+1
+	if rows <= 0 || cols <= 0 {
+		return Array(0, 0, nil)
+	}
+	if rows > maxArrayCells/cols {
+		return Errorf(ErrNum, "range of %dx%d cells is too large", rows, cols)
+	}
+	out := make([]Value, 0, rows*cols)
+	for rr := r1; rr <= r2; rr++ {
+		for cc := c1; cc <= c2; cc++ {
+			out = append(out, p.cell(rr, cc))
 		}
-		name := p.input[startLetters:k]
-		p.pos = k
-		if p.resolve == nil {
-			return 0, "#ERR"
+	}
+	return Array(rows, cols, out)
+}
+
+// cell returns the value of one referenced cell.
+func (p *parser) cell(row, col int) Value {
+	if p.subtotal > 0 && p.env.Hidden != nil {
+		// SUBTOTAL reads the cells of rows it skips as blank
+		if filtered, manual := p.env.Hidden(row); filtered || (manual && p.subtotal > 100) {
+			return Value{}
 		}
-		val, err := p.resolve(name)
-		return val, err
 	}
+	return p.env.Cell(row, col)
+}
 
-	return 0, "#ERR"
+// lookupName returns the definition of a named range or constant.
+func (p *parser) lookupName(name string) (string, bool) {
+	if p.env.Name == nil {
+		return "", false
+	}
+	return p.env.Name(name)
 }
 
 func isLetter(b byte) bool {
@@ -1208,16 +507,3 @@ func isLetter(b byte) bool {
 func isDigit(b byte) bool {
 	return (b >= '0' && b <= '9')
 }
-
-func maxInt(a, b int) int {
-	if a > b {
-		return a
-	}
-	return b
-}
-func minInt(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
@@ -0,0 +1,132 @@
+package calc
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// sheetEnv is a 6x3 grid: A1:A5 hold 1 to 5, B1:B3 hold x, y, x and C4
+// holds #DIV/0!. RATE is the constant 0.2, DATA the range A1:A5 and SELF
+// refers to itself.
+func sheetEnv() Env {
+	cells := map[[2]int]Value{
+		{0, 1}: Text("x"),
+		{1, 1}: Text("y"),
+		{2, 1}: Text("x"),
+		{3, 2}: Errorf(ErrDiv0, "division by zero"),
+	}
+	for r := 0; r < 5; r++ {
+		cells[[2]int{r, 0}] = Number(float64(r + 1))
+	}
+	names := map[string]string{"RATE": "0.2", "DATA": "A1:A5", "SELF": "SELF"}
+	return Env{
+		Rows: 6,
+		Cols: 3,
+		Cell: func(row, col int) Value { return cells[[2]int{row, col}] },
+		Name: func(name string) (string, bool) {
+			def, ok := names[strings.ToUpper(name)]
+			return def, ok
+		},
+	}
+}
+
+// show writes v compactly: numbers as is, text quoted, errors by code and
+// arrays as {a,b;c,d}.
+func show(v Value) string {
+	switch v.Kind {
+	case KindNumber:
+		return strconv.FormatFloat(v.Num, 'g', -1, 64)
+	case KindText:
+		return strconv.Quote(v.Str)
+	case KindError:
+		return v.Err.String()
+	case KindArray:
+		rows := make([]string, v.Rows)
+		for r := range rows {
+			cols := make([]string, v.Cols)
+			for c := range cols {
+				cols[c] = show(v.At(r, c))
+			}
+			rows[r] = strings.Join(cols, ",")
+		}
+		return "{" + strings.Join(rows, ";") + "}"
+	}
+	return ""
+}
+
+type evalTest struct {
+	expr, want string
+}
+
+// checkEval evaluates each expression against sheetEnv.
+func checkEval(t *testing.T, tests []evalTest) {
+	t.Helper()
+	for _, tt := range tests {
+		if got := show(EvalExprForCell(tt.expr, sheetEnv())); got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"1+2*3", "7"},
+		{"(1+2)*3", "9"},
+		{"10-4-3", "3"},
+		{"12/3/2", "2"},
+		{"-2*3", "-6"},
+		{"2*-3", "-6"},
+		{"--2", "2"},
+		{"1+2=3", "1"},
+		{"2>1+1", "0"},
+		{"1<2=1", "1"},
+	})
+}
+
+func TestRanges(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"A1:A3", "{1;2;3}"},
+		{"A1:B2", "{1,\"x\";2,\"y\"}"},
+		{"A5:A1", "{1;2;3;4;5}"},
+		{"SUM(A1:A5)", "15"},
+		{"SUM(A:A)", "15"},
+		{"SUM(A2:A)", "14"},
+		{"SUM(1:2)", "3"},
+		{"COUNT(A:B)", "5"},
+		{"SUM(A2:B)", "14"},
+		{"COUNT(A2:ZZZ)", "4"},
+		{"SUM(A2:ZZZ3)", "5"},
+		{"SUM(A50:A)", "0"},
+		{"SUM(A3:1)", "6"},
+		{"SUM(AAAA1:B2)", "#REF!"},
+	})
+}
+
+func TestNames(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"RATE*10", "2"},
+		{"rate+1", "1.2"},
+		{"SUM(DATA)", "15"},
+		{"SELF", "#CIRC!"},
+		{"NOPE", "#NAME?"},
+	})
+}
+
+func TestErrors(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"1/0", "#DIV/0!"},
+		{"C4+1", "#DIV/0!"},
+		{"1/0+NA()", "#DIV/0!"},
+		{"NA()+1/0", "#N/A"},
+		{"B1*2", "#VALUE!"},
+		{"SUM(A1:C4)", "#DIV/0!"},
+		{"IFERROR(1/0,7)", "7"},
+		{"ISERROR(C4)", "1"},
+		{"#REF!+1", "#REF!"},
+		{"FOO(1)", "#NAME?"},
+		{"1+", "#VALUE!"},
+		{"(1", "#VALUE!"},
+		{"1 2", "#VALUE!"},
+	})
+}
@@ -0,0 +1,305 @@
+package calc
+
+import (
+	"math"
+)
+
+// callFunc evaluates the function name whose opening '(' has already been
+// consumed. Unless a function handles errors itself (IFERROR, IS*), the
+// first error among its arguments is its result.
+func (p *parser) callFunc(name string) Value {
+	args, ok := p.splitArgs()
+	if !ok {
+		return Errorf(ErrValue, "%s", p.syntax)
+	}
+	switch name {
+	case "SUM":
+		values, errv := p.numbers(args)
+		if errv.IsError() {
+			return errv
+		}
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return Number(sum)
+	case "AVERAGE":
+		values, errv := p.numbers(args)
+		if errv.IsError() {
+			return errv
+		}
+		if len(values) == 0 {
+			return Errorf(ErrDiv0, "AVERAGE of no numbers")
+		}
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return Number(sum / float64(len(values)))
+	case "MIN", "MAX":
+		values, errv := p.numbers(args)
+		if errv.IsError() {
+			return errv
+		}
+		if len(values) == 0 {
+			return Number(0)
+		}
+		res := values[0]
+		for _, v := range values {
+			if (name == "MIN" && v < res) || (name == "MAX" && v > res) {
+				res = v
+			}
+		}
+		return Number(res)
+	case "COUNT":
+		// numbers only; text, blanks and errors are not counted
+		count := 0.0
+		for _, arg := range args {
+			v := p.evalArg(arg)
+			if v.Kind != KindArray {
+				if !v.AsNumber().IsError() {
+					count++
+				}
+				continue
+			}
+			for _, e := range v.Arr {
+				if e.Kind == KindNumber {
+					count++
+				}
+			}
+		}
+		return Number(count)
+	case "ROUND":
+		if len(args) < 1 || len(args) > 2 {
+			return argCountError(name, "1 or 2")
+		}
+		value := p.evalArg(args[0]).AsNumber()
+		if value.IsError() {
+			return value
+		}
+		decimalPlaces := Number(0)
+		if len(args) == 2 {
+			if decimalPlaces = p.evalArg(args[1]).AsNumber(); decimalPlaces.IsError() {
+				return decimalPlaces
+			}
+		}
+		multiplier := math.Pow(10, decimalPlaces.Num)
+		return Number(math.Round(value.Num*multiplier) / multiplier)
+	case "IF":
+		if len(args) < 2 || len(args) > 3 {
+			return argCountError(name, "2 or 3")
+		}
+		condition := truthy(p.evalArg(args[0]))
+		if condition.IsError() {
+			return condition
+		}
+		// only the chosen branch is evaluated; the false value defaults to 0
+		if condition.Num != 0 {
+			return p.evalArg(args[1])
+		}
+		if len(args) == 3 {
+			return p.evalArg(args[2])
+		}
+		return Number(0)
+	case "AND", "OR":
+		// AND() == 1, OR() == 0; evaluation stops at the first decisive argument
+		want := name == "OR"
+		for _, arg := range args {
+			value := truthy(p.evalArg(arg))
+			if value.IsError() {
+				return value
+			}
+			if (value.Num != 0) == want {
+				return boolValue(want)
+			}
+		}
+		return boolValue(!want)
+	case "NOT":
+		if len(args) != 1 {
+			return argCountError(name, "1")
+		}
+		value := truthy(p.evalArg(args[0]))
+		if value.IsError() {
+			return value
+		}
+		return boolValue(value.Num == 0)
+	case "IFERROR":
+		if len(args) != 2 {
+			return argCountError(name, "2")
+		}
+		if value := p.evalArg(args[0]); !value.IsError() {
+			return value
+		}
+		return p.evalArg(args[1])
+	case "ISERROR", "ISNA", "ISBLANK", "ISNUMBER", "ISTEXT":
+		if len(args) != 1 {
+			return argCountError(name, "1")
+		}
+		value := p.evalArg(args[0])
+		if p.syntax != "" {
+			return value
+		}
+		switch name {
+		case "ISERROR":
+			return boolValue(value.IsError())
+		case "ISNA":
+			return boolValue(value.IsError() && value.Err == ErrNA)
+		case "ISBLANK":
+			return boolValue(value.Kind == KindBlank)
+		case "ISNUMBER":
+			return boolValue(value.Kind == KindNumber)
+		default:
+			return boolValue(value.Kind == KindText)
+		}
+	case "SEQUENCE":
+		return p.fnSequence(args)
+	case "FILTER":
+		return p.fnFilter(args)
+	case "SORT":
+		return p.fnSort(args)
+	case "UNIQUE":
+		return p.fnUnique(args)
+	case "TRANSPOSE":
+		return p.fnTranspose(args)
+	case "SUBTOTAL":
+		return p.fnSubtotal(args)
+	case "NA":
+		if len(args) != 0 {
+			return argCountError(name, "0")
+		}
+		return Errorf(ErrNA, "from NA()")
+	default:
+		return Errorf(ErrName, "unknown function %s", name)
+	}
+}
+
+func argCountError(name, want string) Value {
+	return Errorf(ErrValue, "%s expects %s argument(s)", name, want)
+}
+
+// numbers evaluates args for numeric aggregates. Elements of ranges and
+// arrays contribute only when they are numbers (text and blanks are
+// skipped); direct arguments must be numbers. The first error is returned
+// as errv.
+func (p *parser) numbers(args []string) (values []float64, errv Value) {
+	for _, arg := range args {
+		v := p.evalArg(arg)
+		if v.Kind != KindArray {
+			v = v.AsNumber()
+			if v.IsError() {
+				return nil, v
+			}
+			values = append(values, v.Num)
+			continue
+		}
+		for _, e := range v.Arr {
+			switch e.Kind {
+			case KindError:
+				return nil, e
+			case KindNumber:
+				values = append(values, e.Num)
+			}
+		}
+	}
+	return values, Value{}
+}
+
+// fnSubtotal is SUBTOTAL(function_num, ref1, ...): an aggregate that skips
+// rows hidden by a filter. function_num selects AVERAGE (1), COUNT (2),
+// COUNTA (3), MAX (4), MIN (5), PRODUCT (6), STDEV (7), STDEVP (8), SUM (9),
+// VAR (10) or VARP (11); 101-111 are the same functions that also skip
+// rows hidden by hand.
+func (p *parser) fnSubtotal(args []string) Value {
+	if len(args) < 2 {
+		return argCountError("SUBTOTAL", "at least 2")
+	}
+	fn := p.evalArg(args[0]).AsNumber()
+	if fn.IsError() {
+		return fn
+	}
+	code := int(fn.Num)
+	if code > 100 {
+		code -= 100
+	}
+	if code < 1 || code > 11 || float64(int(fn.Num)) != fn.Num {
+		return Errorf(ErrValue, "SUBTOTAL function_num %v is not 1-11 or 101-111", fn.Num)
+	}
+
+	prev := p.subtotal
+	p.subtotal = int(fn.Num)
+	defer func() { p.subtotal = prev }()
+	var values []float64
+	filled := 0
+	for _, arg := range args[1:] {
+		v := p.evalArg(arg)
+		if v.Kind != KindArray {
+			v = Array(1, 1, []Value{v})
+		}
+		for _, e := range v.Arr {
+			switch e.Kind {
+			case KindError:
+				return e
+			case KindNumber:
+				values = append(values, e.Num)
+				filled++
+			case KindText:
+				filled++
+			}
+		}
+	}
+
+	n := float64(len(values))
+	sum, product := 0.0, 1.0
+	for _, v := range values {
+		sum += v
+		product *= v
+	}
+	switch code {
+	case 1:
+		if n == 0 {
+			return Errorf(ErrDiv0, "SUBTOTAL average of no numbers")
+		}
+		return Number(sum / n)
+	case 2:
+		return Number(n)
+	case 3:
+		return Number(float64(filled))
+	case 4, 5:
+		if n == 0 {
+			return Number(0)
+		}
+		res := values[0]
+		for _, v := range values {
+			if (code == 4 && v > res) || (code == 5 && v < res) {
+				res = v
+			}
+		}
+		return Number(res)
+	case 6:
+		if n == 0 {
+			return Number(0)
+		}
+		return Number(product)
+	case 9:
+		return Number(sum)
+	}
+	// variance and standard deviation: 7 and 10 of a sample, 8 and 11 of
+	// the whole population
+	sample := code == 7 || code == 10
+	if n == 0 || (sample && n < 2) {
+		return Errorf(ErrDiv0, "SUBTOTAL needs more numbers for a variance")
+	}
+	mean := sum / n
+	ss := 0.0
+	for _, v := range values {
+		ss += (v - mean) * (v - mean)
+	}
+	variance := ss / n
+	if sample {
+		variance = ss / (n - 1)
+	}
+	if code == 7 || code == 8 {
+		return Number(math.Sqrt(variance))
+	}
+	return Number(variance)
+}
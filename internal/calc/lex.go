@@ -0,0 +1,241 @@
+package calc
+
+import (
+	"sort"
+	"strings"
+)
+
+// FuncInfo describes a spreadsheet function for completion and signature
+// help. A trailing "..." parameter may repeat.
+type FuncInfo struct {
+	Name   string
+	Params []string
+	Desc   string
+}
+
+// Signature formats the function like SUM(number1, [number2], ...).
+func (f FuncInfo) Signature() string {
+	return f.Name + "(" + strings.Join(f.Params, ", ") + ")"
+}
+
+// Param returns the index of the parameter that argument i fills, taking
+// a repeating "..." tail into account, or -1 when there are too many.
+func (f FuncInfo) Param(i int) int {
+	n := len(f.Params)
+	if n > 0 && f.Params[n-1] == "..." {
+		if i >= n-1 {
+			return n - 2
+		}
+		return i
+	}
+	if i < n {
+		return i
+	}
+	return -1
+}
+
+// Functions lists every function callFunc understands, sorted by name.
+var Functions = []FuncInfo{
+	{"AND", []string{"logical1", "[logical2]", "..."}, "1 if all arguments are true"},
+	{"AVERAGE", []string{"number1", "[number2]", "..."}, "arithmetic mean"},
+	{"COUNT", []string{"value1", "[value2]", "..."}, "number of numeric values"},
+	{"FILTER", []string{"array", "include", "[if_empty]"}, "rows of array where include is true"},
+	{"IF", []string{"condition", "value_if_true", "[value_if_false]"}, "choose a value by condition"},
+	{"IFERROR", []string{"value", "value_if_error"}, "value, or a fallback if it is an error"},
+	{"ISBLANK", []string{"value"}, "1 if the cell is empty"},
+	{"ISERROR", []string{"value"}, "1 if value is an error"},
+	{"ISNA", []string{"value"}, "1 if value is #N/A"},
+	{"ISNUMBER", []string{"value"}, "1 if value is a number"},
+	{"ISTEXT", []string{"value"}, "1 if value is text"},
+	{"MAX", []string{"number1", "[number2]", "..."}, "largest value"},
+	{"MIN", []string{"number1", "[number2]", "..."}, "smallest value"},
+	{"NA", nil, "the #N/A error"},
+	{"NOT", []string{"logical"}, "logical negation"},
+	{"OR", []string{"logical1", "[logical2]", "..."}, "1 if any argument is true"},
+	{"ROUND", []string{"number", "[digits]"}, "round to a number of digits"},
+	{"SEQUENCE", []string{"rows", "[cols]", "[start]", "[step]"}, "array of sequential numbers"},
+	{"SORT", []string{"array", "[sort_index]", "[sort_order]"}, "sort rows of an array"},
+	{"SUBTOTAL", []string{"function_num", "ref1", "[ref2]", "..."}, "aggregate of the rows a filter shows"},
+	{"SUM", []string{"number1", "[number2]", "..."}, "sum of values"},
+	{"TRANSPOSE", []string{"array"}, "swap rows and columns"},
+	{"UNIQUE", []string{"array"}, "distinct rows of an array"},
+}
+
+// LookupFunc finds a function by name (case-insensitive).
+func LookupFunc(name string) (FuncInfo, bool) {
+	name = strings.ToUpper(name)
+	i := sort.Search(len(Functions), func(i int) bool { return Functions[i].Name >= name })
+	if i < len(Functions) && Functions[i].Name == name {
+		return Functions[i], true
+	}
+	return FuncInfo{}, false
+}
+
+// FuncsWithPrefix returns the functions whose names start with prefix.
+func FuncsWithPrefix(prefix string) []FuncInfo {
+	prefix = strings.ToUpper(prefix)
+	var out []FuncInfo
+	for _, f := range Functions {
+		if strings.HasPrefix(f.Name, prefix) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// TokenKind classifies a piece of formula text for highlighting.
+type TokenKind int
+
+const (
+	TokOther  TokenKind = iota // operators, commas, spaces
+	TokNumber                  // 12.5
+	TokString                  // "text"
+	TokRef                     // A1, $B$2, A1:B5, A:A
+	TokFunc                    // function name before '('
+	TokName                    // named range or other identifier
+	TokParen                   // ( or )
+	TokError                   // error literal like #N/A
+)
+
+// Token is a span of formula text [Start, End) in bytes. Bad marks
+// problems such as unbalanced parentheses or an unterminated string.
+type Token struct {
+	Kind       TokenKind
+	Start, End int
+	Bad        bool
+}
+
+// Tokenize splits a formula (without the leading '=') into tokens for
+// syntax highlighting. It never fails: unknown characters become TokOther.
+func Tokenize(expr string) []Token {
+	var toks []Token
+	var open []int // indexes of unmatched '(' tokens
+	i := 0
+	for i < len(expr) {
+		ch := expr[i]
+		switch {
+		case ch == '"':
+			j := i + 1
+			closed := false
+			for j < len(expr) {
+				if expr[j] == '"' {
+					if j+1 < len(expr) && expr[j+1] == '"' {
+						j += 2
+						continue
+					}
+					closed = true
+					j++
+					break
+				}
+				j++
+			}
+			toks = append(toks, Token{Kind: TokString, Start: i, End: j, Bad: !closed})
+			i = j
+		case ch == '(':
+			open = append(open, len(toks))
+			toks = append(toks, Token{Kind: TokParen, Start: i, End: i + 1})
+			i++
+		case ch == ')':
+			t := Token{Kind: TokParen, Start: i, End: i + 1}
+			if len(open) == 0 {
+				t.Bad = true
+			} else {
+				open = open[:len(open)-1]
+			}
+			toks = append(toks, t)
+			i++
+		case ch == '#':
+			j := i + 1
+			for j < len(expr) && (isLetter(expr[j]) || isDigit(expr[j]) || strings.IndexByte("/!?", expr[j]) >= 0) {
+				j++
+			}
+			_, ok := ParseError(expr[i:j])
+			toks = append(toks, Token{Kind: TokError, Start: i, End: j, Bad: !ok})
+			i = j
+		case isRefStart(ch) || ch == '_' || ch == '.':
+			j := tokenEnd(expr, i)
+			if j == i {
+				j = i + 1
+			}
+			kind := TokName
+			if r, ok := parseRefToken(expr[i:j]); ok {
+				// bare columns and rows are references only inside a range
+				inRange := strings.HasPrefix(expr[j:], ":") || (i > 0 && expr[i-1] == ':')
+				switch {
+				case (r.Row >= 0 && r.Col >= 0) || inRange:
+					kind = TokRef
+				case r.Col < 0:
+					kind = TokNumber
+				}
+			} else if isDigit(ch) || ch == '.' {
+				kind = TokNumber
+			}
+			if nextNonSpace(expr, j) == '(' && kind != TokNumber {
+				kind = TokFunc
+			}
+			// A1:B5 and the A1# spill suffix are highlighted as one reference
+			if kind == TokRef {
+				if j+1 < len(expr) && expr[j] == ':' && isRefStart(expr[j+1]) {
+					j = tokenEnd(expr, j+1)
+				} else if j < len(expr) && expr[j] == '#' {
+					j++
+				}
+			}
+			toks = append(toks, Token{Kind: kind, Start: i, End: j})
+			i = j
+		default:
+			toks = append(toks, Token{Kind: TokOther, Start: i, End: i + 1})
+			i++
+		}
+	}
+	for _, idx := range open {
+		toks[idx].Bad = true
+	}
+	return toks
+}
+
+// CallContext finds the innermost function call around byte offset pos in
+// expr and which argument (0-based) pos is in. ok is false outside calls.
+func CallContext(expr string, pos int) (fn string, arg int, ok bool) {
+	type frame struct {
+		fn  string
+		arg int
+	}
+	var stack []frame
+	toks := Tokenize(expr)
+	for ti, t := range toks {
+		if t.Start >= pos {
+			break
+		}
+		switch {
+		case t.Kind == TokParen && expr[t.Start] == '(':
+			name := ""
+			// the function name is the previous non-space token
+			for k := ti - 1; k >= 0; k-- {
+				if toks[k].Kind == TokOther && strings.TrimSpace(expr[toks[k].Start:toks[k].End]) == "" {
+					continue
+				}
+				if toks[k].Kind == TokFunc {
+					name = strings.ToUpper(expr[toks[k].Start:toks[k].End])
+				}
+				break
+			}
+			stack = append(stack, frame{fn: name})
+		case t.Kind == TokParen:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case t.Kind == TokOther && expr[t.Start] == ',':
+			if len(stack) > 0 {
+				stack[len(stack)-1].arg++
+			}
+		}
+	}
+	for k := len(stack) - 1; k >= 0; k-- {
+		if stack[k].fn != "" {
+			return stack[k].fn, stack[k].arg, true
+		}
+		// plain parentheses: keep looking outwards
+	}
+	return "", 0, false
+}
@@ -0,0 +1,308 @@
+package calc
+
+import (
+	"strconv"
+	"strings"
+
+	"sheet/internal/grid"
+)
+
+// Ref is one side of a cell reference as written in a formula. Row or Col is
+// -1 for the open part of whole-column (A:A) and whole-row (3:3) ranges.
+type Ref struct {
+	Row, Col       int
+	RowAbs, ColAbs bool
+}
+
+// String formats r back into formula syntax (A1, $A$1, A, 3).
+func (r Ref) String() string {
+	var b strings.Builder
+	if r.Col >= 0 {
+		if r.ColAbs {
+			b.WriteByte('$')
+		}
+		b.WriteString(grid.ColToName(r.Col))
+	}
+	if r.Row >= 0 {
+		if r.RowAbs {
+			b.WriteByte('$')
+		}
+		b.WriteString(strconv.Itoa(r.Row + 1))
+	}
+	return b.String()
+}
+
+// refSpan is a cell or range reference found in a formula text.
+type refSpan struct {
+	start, end int // byte offsets in the formula
+	from, to   Ref // to is only meaningful for ranges
+	isRange    bool
+}
+
+// ShiftRows rewrites the references in expr after n rows were inserted
+// before row at (n > 0) or -n rows were deleted starting at row at (n < 0).
+// References into deleted rows become #REF!; ranges shrink instead.
+func ShiftRows(expr string, at, n int) string {
+	return shiftRefs(expr, at, n, func(r *Ref) *int { return &r.Row })
+}
+
+// ShiftCols is ShiftRows for columns.
+func ShiftCols(expr string, at, n int) string {
+	return shiftRefs(expr, at, n, func(r *Ref) *int { return &r.Col })
+}
+
+// OffsetRefs moves the relative parts of all references in expr by dr rows
+// and dc columns, as when a formula is copied to another cell. Absolute
+// parts ($A$1) stay put; references pushed off the grid become #REF!.
+func OffsetRefs(expr string, dr, dc int) string {
+	move := func(r Ref) (Ref, bool) {
+		if r.Row >= 0 && !r.RowAbs {
+			r.Row += dr
+			if r.Row < 0 {
+				return r, false
+			}
+		}
+		if r.Col >= 0 && !r.ColAbs {
+			r.Col += dc
+			if r.Col < 0 {
+				return r, false
+			}
+		}
+		return r, true
+	}
+	return rewriteRefs(expr, func(sp refSpan) string {
+		from, ok := move(sp.from)
+		if !ok {
+			return "#REF!"
+		}
+		if !sp.isRange {
+			return from.String()
+		}
+		to, ok := move(sp.to)
+		if !ok {
+			return "#REF!"
+		}
+		return from.String() + ":" + to.String()
+	})
+}
+
+func shiftRefs(expr string, at, n int, axis func(r *Ref) *int) string {
+	if n == 0 {
+		return expr
+	}
+	return rewriteRefs(expr, func(sp refSpan) string {
+		from, to := sp.from, sp.to
+		fp, tp := axis(&from), axis(&to)
+		if n > 0 {
+			if *fp >= at {
+				*fp += n
+			}
+			if sp.isRange && *tp >= at {
+				*tp += n
+			}
+		} else {
+			end := at - n // first index after the deleted band
+			if !sp.isRange {
+				if *fp >= at && *fp < end {
+					return "#REF!"
+				}
+				if *fp >= end {
+					*fp += n
+				}
+				return from.String()
+			}
+			if *fp < 0 {
+				// whole row/column range along this axis is unaffected
+				return from.String() + ":" + to.String()
+			}
+			switch {
+			case *fp >= end:
+				*fp += n
+			case *fp >= at:
+				*fp = at
+			}
+			switch {
+			case *tp >= end:
+				*tp += n
+			case *tp >= at:
+				*tp = at - 1
+			}
+			// an open end (A2:A) runs to the edge of the grid and never collapses
+			if *tp >= 0 && *tp < *fp {
+				return "#REF!"
+			}
+		}
+		if !sp.isRange {
+			return from.String()
+		}
+		return from.String() + ":" + to.String()
+	})
+}
+
+// rewriteRefs replaces every reference in expr with the text fn returns.
+func rewriteRefs(expr string, fn func(refSpan) string) string {
+	spans := scanRefs(expr)
+	if len(spans) == 0 {
+		return expr
+	}
+	var b strings.Builder
+	last := 0
+	for _, sp := range spans {
+		b.WriteString(expr[last:sp.start])
+		b.WriteString(fn(sp))
+		last = sp.end
+	}
+	b.WriteString(expr[last:])
+	return b.String()
+}
+
+// scanRefs finds cell references (A1, $B$2) and ranges (A1:B5, A:A, 3:5,
+// A2:A) in expr. Function names, named ranges and string literals are
+// skipped.
+func scanRefs(expr string) []refSpan {
+	var spans []refSpan
+	i := 0
+	for i < len(expr) {
+		ch := expr[i]
+		if ch == '"' {
+			// string literal, "" is an escaped quote
+			i++
+			for i < len(expr) {
+				if expr[i] == '"' {
+					if i+1 < len(expr) && expr[i+1] == '"' {
+						i += 2
+						continue
+					}
+					break
+				}
+				i++
+			}
+			i++
+			continue
+		}
+		if !isRefStart(ch) {
+			i++
+			continue
+		}
+		// a token glued to a preceding identifier char (e.g. the "1" in
+		// LOG10 or a name like TAX_2) is not a reference
+		if i > 0 && isIdentChar(expr[i-1]) {
+			i++
+			continue
+		}
+		j := tokenEnd(expr, i)
+		tok := expr[i:j]
+		from, ok := parseRefToken(tok)
+		if !ok || nextNonSpace(expr, j) == '(' {
+			i = j
+			continue
+		}
+		if j < len(expr) && expr[j] == ':' && j+1 < len(expr) && isRefStart(expr[j+1]) {
+			k := tokenEnd(expr, j+1)
+			if to, ok := parseRefToken(expr[j+1 : k]); ok && validRange(from, to) {
+				spans = append(spans, refSpan{start: i, end: k, from: from, to: to, isRange: true})
+				i = k
+				continue
+			}
+		}
+		if from.Row >= 0 && from.Col >= 0 {
+			spans = append(spans, refSpan{start: i, end: j, from: from})
+		}
+		i = j
+	}
+	return spans
+}
+
+// validRange reports whether two parts form a range we understand: cell to
+// cell, column to column, row to row, or an open-ended cell to column/row.
+func validRange(from, to Ref) bool {
+	switch {
+	case from.Row >= 0 && from.Col >= 0:
+		return to.Row >= 0 || to.Col >= 0
+	case from.Row < 0:
+		return to.Row < 0
+	default:
+		return to.Col < 0
+	}
+}
+
+func isRefStart(b byte) bool {
+	return b == '$' || isLetter(b) || isDigit(b)
+}
+
+func isIdentChar(b byte) bool {
+	return isLetter(b) || isDigit(b) || b == '_' || b == '.'
+}
+
+func tokenEnd(s string, i int) int {
+	for i < len(s) && (isIdentChar(s[i]) || s[i] == '$') {
+		i++
+	}
+	return i
+}
+
+func nextNonSpace(s string, i int) byte {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	if i < len(s) {
+		return s[i]
+	}
+	return 0
+}
+
+// parseRefToken parses A1, $A$1, A, $A, 3 or $3. Bare columns and rows are
+// only references as part of a range, which the caller checks.
+func parseRefToken(tok string) (Ref, bool) {
+	r := Ref{Row: -1, Col: -1}
+	i := 0
+	if i < len(tok) && tok[i] == '$' {
+		r.ColAbs = true
+		i++
+	}
+	start := i
+	for i < len(tok) && isLetter(tok[i]) {
+		i++
+	}
+	if i > start {
+		if i-start > 3 {
+			return r, false
+		}
+		col := 0
+		for _, ch := range strings.ToUpper(tok[start:i]) {
+			col = col*26 + int(ch-'A') + 1
+		}
+		r.Col = col - 1
+	} else if r.ColAbs {
+		// "$3": the $ belongs to the row
+		r.ColAbs = false
+		r.RowAbs = true
+	}
+	if i < len(tok) && tok[i] == '$' {
+		if r.RowAbs || r.Col < 0 {
+			return r, false
+		}
+		r.RowAbs = true
+		i++
+	}
+	start = i
+	for i < len(tok) && isDigit(tok[i]) {
+		i++
+	}
+	if i != len(tok) {
+		return r, false
+	}
+	if i > start {
+		n, err := strconv.Atoi(tok[start:i])
+		if err != nil || n < 1 {
+			return r, false
+		}
+		r.Row = n - 1
+	} else if r.RowAbs {
+		return r, false
+	}
+	if r.Row < 0 && r.Col < 0 {
+		return r, false
+	}
+	return r, true
+}
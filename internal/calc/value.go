@@ -0,0 +1,166 @@
+package calc
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ErrorCode is a spreadsheet error value such as #DIV/0!.
+type ErrorCode int
+
+const (
+	ErrNone  ErrorCode = iota
+	ErrDiv0            // #DIV/0!  division by zero
+	ErrValue           // #VALUE!  wrong type of operand, or a malformed formula
+	ErrRef             // #REF!    reference outside the grid or to a deleted cell
+	ErrName            // #NAME?   unknown function or name
+	ErrNA              // #N/A     value not available
+	ErrNum             // #NUM!    result is not a finite number
+	ErrCirc            // #CIRC!   circular reference
+	ErrSpill           // #SPILL!  array result can not spill into non-empty cells
+)
+
+var errorNames = map[ErrorCode]string{
+	ErrDiv0:  "#DIV/0!",
+	ErrValue: "#VALUE!",
+	ErrRef:   "#REF!",
+	ErrName:  "#NAME?",
+	ErrNA:    "#N/A",
+	ErrNum:   "#NUM!",
+	ErrCirc:  "#CIRC!",
+	ErrSpill: "#SPILL!",
+}
+
+// String returns the code as shown in a cell, e.g. "#DIV/0!".
+func (e ErrorCode) String() string {
+	if name, ok := errorNames[e]; ok {
+		return name
+	}
+	return ""
+}
+
+// ParseError recognises an error literal like #N/A or #REF! (case-insensitive).
+func ParseError(s string) (ErrorCode, bool) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	for code, name := range errorNames {
+		if s == name {
+			return code, true
+		}
+	}
+	return ErrNone, false
+}
+
+// Kind is the type of a Value.
+type Kind int
+
+const (
+	KindBlank Kind = iota
+	KindNumber
+	KindText
+	KindError
+	KindArray
+)
+
+// Value is the result of evaluating a formula or a cell. The zero Value is
+// a blank cell.
+type Value struct {
+	Kind Kind
+	Num  float64
+	Str  string
+	Err  ErrorCode
+	Msg  string // for errors: why it happened, shown in the status line
+
+	// arrays: Rows x Cols elements in row-major order
+	Rows, Cols int
+	Arr        []Value
+}
+
+// Number returns a numeric value; NaN and infinities become #NUM!.
+func Number(f float64) Value {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return Errorf(ErrNum, "result is not a finite number")
+	}
+	return Value{Kind: KindNumber, Num: f}
+}
+
+// Text returns a text value.
+func Text(s string) Value {
+	return Value{Kind: KindText, Str: s}
+}
+
+// Errorf returns an error value with an explanation.
+func Errorf(code ErrorCode, format string, args ...interface{}) Value {
+	return Value{Kind: KindError, Err: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+// IsError reports whether v is an error value.
+func (v Value) IsError() bool {
+	return v.Kind == KindError
+}
+
+// AsNumber converts v for use in arithmetic: blanks are 0, numeric text is
+// parsed, other text is #VALUE!. Errors are returned unchanged. A 1x1 array
+// is its only element; larger arrays can not be used as a single number.
+func (v Value) AsNumber() Value {
+	switch v.Kind {
+	case KindArray:
+		if len(v.Arr) == 1 {
+			return v.Arr[0].AsNumber()
+		}
+		return Errorf(ErrValue, "%dx%d array used as a single value", v.Rows, v.Cols)
+	case KindBlank:
+		return Value{Kind: KindNumber}
+	case KindNumber, KindError:
+		return v
+	default:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v.Str), 64)
+		if err != nil {
+			return Errorf(ErrValue, "text %q used as a number", v.Str)
+		}
+		return Number(f)
+	}
+}
+
+// Explain describes an error value for the status line, e.g.
+// "#DIV/0! division by zero". It is empty for other values.
+func (v Value) Explain() string {
+	if !v.IsError() {
+		return ""
+	}
+	if v.Msg == "" {
+		return v.Err.String()
+	}
+	return v.Err.String() + " " + v.Msg
+}
+
+// LiteralValue interprets the raw text of a non-formula cell: numbers,
+// error literals like #N/A, or plain text.
+func LiteralValue(text string) Value {
+	if text == "" {
+		return Value{}
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil {
+		return Number(f)
+	}
+	if code, ok := ParseError(text); ok {
+		return Errorf(code, "entered as a value")
+	}
+	return Text(text)
+}
+
+func truthy(v Value) Value {
+	n := v.AsNumber()
+	if n.IsError() {
+		return n
+	}
+	return boolValue(math.Abs(n.Num) > 1e-12)
+}
+
+func boolValue(b bool) Value {
+	if b {
+		return Number(1)
+	}
+	return Number(0)
+}
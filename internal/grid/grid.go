@@ -37,7 +37,7 @@ func ColRowToName(col, row int) string {
 	letters := ""
 	for n > 0 {
 		rem := (n - 1) % 26
-		letters = string('A'+rem) + letters
+		letters = string(rune('A'+rem)) + letters
 		n = (n - 1) / 26
 	}
 	return fmt.Sprintf("%s%d", letters, row+1)
@@ -82,6 +82,94 @@ func ParseCellRef(name string) (int, int, bool) {
 	return row, col, true
 }
 
+// ParseRangeRef parses a range reference and returns its 0-based inclusive
+// bounds. Besides A1:B5 it accepts whole columns (A:C), whole rows (3:5) and
+// open-ended ranges that run to the end of the grid (A2:A, A2:C, A2:5).
+// rows and cols give the grid extent: every range is clipped to it, so the
+// result never reaches past the last existing row/column. An empty range
+// (e.g. A50:A on a 10-row grid) is reported with ok false.
+func ParseRangeRef(ref string, rows, cols int) (r1, c1, r2, c2 int, ok bool) {
+	ref = strings.TrimSpace(ref)
+	if idx := strings.LastIndex(ref, "!"); idx != -1 {
+		ref = ref[idx+1:]
+	}
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, 0, 0, false
+	}
+	lr, lc, lHasRow, lHasCol, ok1 := parseRefPart(parts[0])
+	rr, rc, rHasRow, rHasCol, ok2 := parseRefPart(parts[1])
+	if !ok1 || !ok2 {
+		return 0, 0, 0, 0, false
+	}
+	switch {
+	case lHasRow && lHasCol && rHasRow && rHasCol: // A1:B5
+		r1, r2, c1, c2 = lr, rr, lc, rc
+	case !lHasRow && !rHasRow: // A:C
+		r1, r2, c1, c2 = 0, rows-1, lc, rc
+	case !lHasCol && !rHasCol: // 3:5
+		r1, r2, c1, c2 = lr, rr, 0, cols-1
+	case lHasRow && lHasCol && !rHasRow: // A2:C -> down to the last row
+		r1, r2, c1, c2 = lr, rows-1, lc, rc
+	case lHasRow && lHasCol && !rHasCol: // A2:5 -> right to the last column
+		r1, r2, c1, c2 = lr, rr, lc, cols-1
+	default:
+		return 0, 0, 0, 0, false
+	}
+	// sides given on both ends may come in either order; an open side
+	// always ends at the edge of the grid
+	if lHasRow && rHasRow && r1 > r2 {
+		r1, r2 = r2, r1
+	}
+	if lHasCol && rHasCol && c1 > c2 {
+		c1, c2 = c2, c1
+	}
+	r2, c2 = min(r2, rows-1), min(c2, cols-1)
+	if r1 > r2 || c1 > c2 {
+		return 0, 0, 0, 0, false
+	}
+	return r1, c1, r2, c2, true
+}
+
+// parseRefPart parses one side of a range: a cell (A1), a column (A) or a
+// row (3). $ signs are ignored.
+func parseRefPart(s string) (row, col int, hasRow, hasCol, ok bool) {
+	s = strings.ReplaceAll(strings.TrimSpace(s), "$", "")
+	if s == "" {
+		return 0, 0, false, false, false
+	}
+	i := 0
+	for i < len(s) && isLetter(s[i]) {
+		i++
+	}
+	if i > 3 {
+		// columns end at ZZZ
+		return 0, 0, false, false, false
+	}
+	if i > 0 {
+		colPart := strings.ToUpper(s[:i])
+		for j := 0; j < len(colPart); j++ {
+			col = col*26 + int(colPart[j]-'A') + 1
+		}
+		col--
+		hasCol = true
+	}
+	if i < len(s) {
+		for j := i; j < len(s); j++ {
+			if !isDigit(s[j]) {
+				return 0, 0, false, false, false
+			}
+		}
+		n, err := strconv.Atoi(s[i:])
+		if err != nil || n < 1 {
+			return 0, 0, false, false, false
+		}
+		row = n - 1
+		hasRow = true
+	}
+	return row, col, hasRow, hasCol, true
+}
+
 func isLetter(b byte) bool {
 	return (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z')
 }
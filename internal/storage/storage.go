@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 
 	"sheet/internal/grid"
 )
@@ -16,9 +17,53 @@ type Document struct {
 	Grid       map[string]grid.Cell `json:"grid"`
 	ColWidths  []int                `json:"col_widths"`
 	RowHeights []int                `json:"row_heights"`
+	Names      map[string]string    `json:"names,omitempty"`       // именованные диапазоны и константы
+	FrozenRows int                  `json:"frozen_rows,omitempty"` // закреплённые строки сверху
+	FrozenCols int                  `json:"frozen_cols,omitempty"` // закреплённые столбцы слева
+	HiddenRows []int                `json:"hidden_rows,omitempty"` // скрытые строки
+	HiddenCols []int                `json:"hidden_cols,omitempty"` // скрытые столбцы
+	RowLevels  map[int]int          `json:"row_levels,omitempty"`  // уровни группировки строк
+	ColLevels  map[int]int          `json:"col_levels,omitempty"`  // уровни группировки столбцов
+	Merges     [][4]int             `json:"merges,omitempty"`      // объединённые ячейки: строка и столбец левой верхней и правой нижней
+	Rules      []Rule               `json:"rules,omitempty"`       // условное форматирование
+	Checks     []Check              `json:"checks,omitempty"`      // проверка ввода
 	// Добавим другие поля документа по мере необходимости
 }
 
+// Sheet — содержимое документа в том виде, в котором с ним работает приложение
+type Sheet struct {
+	Grid       map[[2]int]grid.Cell
+	ColWidths  []int
+	RowHeights []int
+	Names      map[string]string
+	FrozenRows int
+	FrozenCols int
+	HiddenRows map[int]bool
+	HiddenCols map[int]bool
+	RowLevels  map[int]int
+	ColLevels  map[int]int
+	Merges     map[[2]int][2]int // объединённые ячейки: левая верхняя -> правая нижняя
+	Rules      []Rule
+	Checks     []Check
+}
+
+// Rule - правило условного форматирования диапазона (:cf)
+type Rule struct {
+	Range string `json:"range"`           // диапазон или ячейка, например B2:B20
+	Kind  string `json:"kind"`            // value, scale или bar
+	Op    string `json:"op,omitempty"`    // для value: <, <=, >, >=, = или <>
+	Value string `json:"value,omitempty"` // для value: с чем сравнивать (число, текст или формула)
+	Style string `json:"style,omitempty"` // стиль для value, цвета для scale и bar
+}
+
+// Check - правило проверки ввода для диапазона (:validate)
+type Check struct {
+	Range string `json:"range"`          // диапазон или ячейка, например C2:C100
+	Kind  string `json:"kind"`           // number, list, regex, date или formula
+	Args  string `json:"args"`           // границы, значения, выражение или формула
+	Warn  bool   `json:"warn,omitempty"` // только помечать неверные значения, а не отклонять
+}
+
 // Вспомогательные функции для преобразования ключей
 func keyToString(key [2]int) string {
 	return fmt.Sprintf("%d,%d", key[0], key[1])
@@ -30,6 +75,52 @@ func stringToKey(s string) ([2]int, error) {
 	return key, err
 }
 
+// indexList превращает множество номеров строк или столбцов в
+// упорядоченный список для JSON
+func indexList(set map[int]bool) []int {
+	list := make([]int, 0, len(set))
+	for i, ok := range set {
+		if ok {
+			list = append(list, i)
+		}
+	}
+	sort.Ints(list)
+	return list
+}
+
+// indexSet - обратное преобразование к indexList
+func indexSet(list []int) map[int]bool {
+	set := make(map[int]bool, len(list))
+	for _, i := range list {
+		set[i] = true
+	}
+	return set
+}
+
+// mergeList превращает объединённые ячейки в упорядоченный список для JSON
+func mergeList(merges map[[2]int][2]int) [][4]int {
+	list := make([][4]int, 0, len(merges))
+	for k, end := range merges {
+		list = append(list, [4]int{k[0], k[1], end[0], end[1]})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i][0] != list[j][0] {
+			return list[i][0] < list[j][0]
+		}
+		return list[i][1] < list[j][1]
+	})
+	return list
+}
+
+// mergeMap - обратное преобразование к mergeList
+func mergeMap(list [][4]int) map[[2]int][2]int {
+	merges := make(map[[2]int][2]int, len(list))
+	for _, m := range list {
+		merges[[2]int{m[0], m[1]}] = [2]int{m[2], m[3]}
+	}
+	return merges
+}
+
 // ensureDocumentsDir проверяет существование директории "documents" и создает её при необходимости
 func ensureDocumentsDir() error {
 	dir := "documents"
@@ -155,7 +246,7 @@ func LoadCSV(filename string) (map[[2]int]grid.Cell, int, int, error) {
 }
 
 // SaveDocument сохраняет весь документ в JSON формате
-func SaveDocument(grid map[[2]int]grid.Cell, colWidths []int, rowHeights []int, filename string) error {
+func SaveDocument(sheet *Sheet, filename string) error {
 	// Проверяем, есть ли у файла расширение .grider
 	if filepath.Ext(filename) != ".grider" {
 		filename += ".grider"
@@ -170,12 +261,22 @@ func SaveDocument(grid map[[2]int]grid.Cell, colWidths []int, rowHeights []int,
 	}
 
 	// Преобразуем grid в формат, поддерживаемый JSON
-	docGrid := ConvertGridToDocumentGrid(grid)
+	docGrid := ConvertGridToDocumentGrid(sheet.Grid)
 
 	doc := &Document{
 		Grid:       docGrid,
-		ColWidths:  colWidths,
-		RowHeights: rowHeights,
+		ColWidths:  sheet.ColWidths,
+		RowHeights: sheet.RowHeights,
+		Names:      sheet.Names,
+		FrozenRows: sheet.FrozenRows,
+		FrozenCols: sheet.FrozenCols,
+		HiddenRows: indexList(sheet.HiddenRows),
+		HiddenCols: indexList(sheet.HiddenCols),
+		RowLevels:  sheet.RowLevels,
+		ColLevels:  sheet.ColLevels,
+		Merges:     mergeList(sheet.Merges),
+		Rules:      sheet.Rules,
+		Checks:     sheet.Checks,
 	}
 
 	data, err := json.MarshalIndent(doc, "", "  ")
@@ -192,7 +293,7 @@ func SaveDocument(grid map[[2]int]grid.Cell, colWidths []int, rowHeights []int,
 }
 
 // LoadDocument загружает документ из JSON формата
-func LoadDocument(filename string) (map[[2]int]grid.Cell, []int, []int, error) {
+func LoadDocument(filename string) (*Sheet, error) {
 	// Проверяем, есть ли у файла расширение .grider
 	if filepath.Ext(filename) != ".grider" {
 		filename += ".grider"
@@ -203,20 +304,34 @@ func LoadDocument(filename string) (map[[2]int]grid.Cell, []int, []int, error) {
 
 	data, err := os.ReadFile(docPath)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("error reading file: %w", err)
+		return nil, fmt.Errorf("error reading file: %w", err)
 	}
 
 	var doc Document
 	err = json.Unmarshal(data, &doc)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("error unmarshaling document: %w", err)
+		return nil, fmt.Errorf("error unmarshaling document: %w", err)
 	}
 
 	// Преобразуем grid обратно в формат map[[2]int]grid.Cell
 	grid, err := ConvertDocumentGridToGrid(doc.Grid)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("error converting grid: %w", err)
+		return nil, fmt.Errorf("error converting grid: %w", err)
 	}
 
-	return grid, doc.ColWidths, doc.RowHeights, nil
+	return &Sheet{
+		Grid:       grid,
+		ColWidths:  doc.ColWidths,
+		RowHeights: doc.RowHeights,
+		Names:      doc.Names,
+		FrozenRows: doc.FrozenRows,
+		FrozenCols: doc.FrozenCols,
+		HiddenRows: indexSet(doc.HiddenRows),
+		HiddenCols: indexSet(doc.HiddenCols),
+		RowLevels:  doc.RowLevels,
+		ColLevels:  doc.ColLevels,
+		Merges:     mergeMap(doc.Merges),
+		Rules:      doc.Rules,
+		Checks:     doc.Checks,
+	}, nil
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"strings"
 
 	"github.com/gdamore/tcell/v2"
 
@@ -19,12 +20,16 @@ func main() {
 		log.Fatalf("Ошибка инициализации экрана: %v", err)
 	}
 	defer s.Fini()
-
-	// Показ экрана приветствия
-	app.LoginScreen(s)
+	s.EnableMouse()
 
 	// Создание приложения
 	a := app.NewApp()
+	if err := a.LoadConfig(app.ConfigPath()); err != nil {
+		a.StatusMsg = "config: " + strings.ReplaceAll(err.Error(), "\n", "; ")
+	}
+
+	// Показ экрана приветствия в цветах темы
+	a.LoginScreen(s)
 
 	// Основной цикл приложения
 	for !a.Quit {
@@ -37,6 +42,8 @@ func main() {
 		switch ev := ev.(type) {
 		case *tcell.EventKey:
 			a.HandleKeyEvent(s, ev)
+		case *tcell.EventMouse:
+			a.HandleMouseEvent(s, ev)
 		case *tcell.EventResize:
 			s.Sync()
 		}